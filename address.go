@@ -0,0 +1,45 @@
+package gochain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Address identifies the owner of coins. It is the hex encoding of a 20 byte
+// public key hash followed by a 4 byte checksum, the beginning of the SHA-256
+// of the hash, so that a mistyped address is rejected instead of receiving
+// coins nobody can spend.
+type Address string
+
+const (
+	addressHashSize     = 20
+	addressChecksumSize = 4
+)
+
+// NewAddress returns the address of the public key hash pkh.
+func NewAddress(pkh []byte) Address {
+	sum := sha256.Sum256(pkh)
+	return Address(hex.EncodeToString(append(append([]byte(nil), pkh...), sum[:addressChecksumSize]...)))
+}
+
+// ValidateAddress checks that s is a well-formed address with a valid
+// checksum.
+func ValidateAddress(s string) error {
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) != addressHashSize+addressChecksumSize {
+		return fmt.Errorf("%w: %q is not %d hex encoded bytes", ErrInvalidAddress, s, addressHashSize+addressChecksumSize)
+	}
+	pkh, checksum := raw[:addressHashSize], raw[addressHashSize:]
+	sum := sha256.Sum256(pkh)
+	if !bytes.Equal(checksum, sum[:addressChecksumSize]) {
+		return fmt.Errorf("%w: checksum of %q doesn't match", ErrInvalidAddress, s)
+	}
+	// Balances are keyed by the address string, so only the lowercase form
+	// is valid.
+	if NewAddress(pkh) != Address(s) {
+		return fmt.Errorf("%w: %q must be lowercase", ErrInvalidAddress, s)
+	}
+	return nil
+}
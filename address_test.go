@@ -0,0 +1,57 @@
+package gochain
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateAddress(t *testing.T) {
+	address := testAddress("alice")
+	if err := ValidateAddress(address); err != nil {
+		t.Fatal(err)
+	}
+	if len(address) != 2*(addressHashSize+addressChecksumSize) {
+		t.Errorf("address %q has %d characters", address, len(address))
+	}
+
+	// Changing any single digit breaks the checksum.
+	const digits = "0123456789abcdef"
+	for i := range address {
+		next := digits[(strings.IndexByte(digits, address[i])+1)%len(digits)]
+		typo := address[:i] + string(next) + address[i+1:]
+		if err := ValidateAddress(typo); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("digit %d changed: %v, want ErrInvalidAddress", i, err)
+		}
+	}
+	for _, s := range []string{"", "alice", address[:len(address)-2], address + "00", strings.ToUpper(address), "zz" + address[2:]} {
+		if err := ValidateAddress(s); !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("%q: %v, want ErrInvalidAddress", s, err)
+		}
+	}
+}
+
+func TestTransactionAddresses(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	h := NewHandler(bc, testAddress("node"))
+	typo := testAddress("alice")[:len(testAddress("alice"))-1] + "x"
+
+	for _, body := range []string{
+		`{"sender": "miner", "recipient": "` + testAddress("alice") + `", "amount": 1}`,
+		`{"sender": "` + miner + `", "recipient": "` + typo + `", "amount": 1}`,
+		`{"sender": "` + miner + `", "outputs": [{"recipient": "` + testAddress("alice") + `", "amount": 1}, {"recipient": "bob", "amount": 1}]}`,
+	} {
+		if rec := serve(h, http.MethodPost, "/transactions/new", body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+	if n := len(bc.PendingTransactions()); n != 0 {
+		t.Errorf("%d transactions with invalid addresses pending", n)
+	}
+	if rec := serve(h, http.MethodGet, "/balance/"+typo, "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("balance of an invalid address: status %d, want 400", rec.Code)
+	}
+}
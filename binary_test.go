@@ -0,0 +1,98 @@
+package gochain
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sameHashes reports whether the blocks of a and b hash the same. Decoding
+// may turn empty slices into nil ones, which DeepEqual tells apart.
+func sameHashes(bc *Blockchain, a, b []Block) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if bc.BlockHash(a[i]) != bc.BlockHash(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBinaryChainRoundTrip(t *testing.T) {
+	bc := chainWithTransactions(t, 2)
+	var buf bytes.Buffer
+	if err := encodeChain(&buf, blockchainInfo{Length: len(bc.Chain()), Chain: bc.Chain()}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeChain(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameHashes(bc, decoded.Chain, bc.Chain()) {
+		t.Error("decoded blocks hash differently from the encoded ones")
+	}
+}
+
+func TestDecodeChainSanityChecks(t *testing.T) {
+	if _, err := decodeChain(nil); err == nil {
+		t.Error("empty chain decoded")
+	}
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	var buf bytes.Buffer
+	if err := encodeChain(&buf, blockchainInfo{Length: 1, Chain: bc.Chain()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeChain(buf.Bytes()); err == nil {
+		t.Error("chain holding more blocks than its length decoded")
+	}
+}
+
+func TestPeerResponseLimit(t *testing.T) {
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 3, testAddress("peer"))
+	srv, _ := recordingPeer(t, peer)
+
+	bc := newTestBlockchain(t, WithPeerResponseLimit(64))
+	if _, err := bc.getChainFromPeer(srv.URL, "/chain"); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("answer over the limit returned %v", err)
+	}
+
+	bc = newTestBlockchain(t)
+	chain, err := bc.getChainFromPeer(srv.URL, "/chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameHashes(bc, chain.Chain, peer.Chain()) {
+		t.Error("chain downloaded under the limit differs from the peer's")
+	}
+}
+
+func TestWithoutBinarySync(t *testing.T) {
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 2, testAddress("peer"))
+	h := NewHandler(peer, testAddress("peer"))
+	var accepts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepts = append(accepts, r.Header.Get("Accept"))
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	bc := newTestBlockchain(t, WithoutBinarySync())
+	chain, err := bc.getChainFromPeer(srv.URL, "/chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(chain.Chain, peer.Chain()) {
+		t.Error("chain downloaded in JSON differs from the peer's")
+	}
+	if len(accepts) != 1 || strings.Contains(accepts[0], BinaryChainType) {
+		t.Errorf("asked the peer for %q", accepts)
+	}
+}
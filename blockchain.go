@@ -2,12 +2,20 @@ package gochain
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/big"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,10 +31,13 @@ type BlockchainService interface {
 	ResolveConflicts() bool
 
 	// Create a new Block in the Blockchain
-	NewBlock(proof int64, previousHash string) Block
+	NewBlock(proof int64, previousHash string) (Block, error)
+
+	// Returns the pending transactions the next block will contain
+	SelectTransactions() []Transaction
 
 	// Creates a new transaction to go into the next mined Block
-	NewTransaction(tx Transaction) int64
+	NewTransaction(tx Transaction) (int64, error)
 
 	// Returns the last block on the chain
 	LastBlock() Block
@@ -38,6 +49,9 @@ type BlockchainService interface {
 
 	// Validates the Proof: Does hash(lastProof, proof) contain 4 leading zeroes?
 	ValidProof(lastProof, proof int64) bool
+
+	// Same as ValidProof
+	VerifyProof(lastProof, proof int64) bool
 }
 
 type Block struct {
@@ -46,154 +60,1675 @@ type Block struct {
 	Transactions []Transaction `json:"transactions"`
 	Proof        int64         `json:"proof"`
 	PreviousHash string        `json:"previous_hash"`
-}
+	Difficulty   int           `json:"difficulty"`
+
+	// The miner of a block may sign its header, see WithMinerKey.
+	MinerPubKey    []byte `json:"miner_pub_key,omitempty"`
+	MinerSignature []byte `json:"miner_signature,omitempty"`
 
-type Transaction struct {
-	Sender    string `json:"sender"`
-	Recipient string `json:"recipient"`
-	Amount    int64  `json:"amount"`
-	Fee       int64  `json:"fee"`	// Improvement (1): We introduce the transaction fee.
+	// Version is the BlockVersion the block was mined with. From version 2
+	// on, the hash covers the MerkleRoot of the transactions instead of the
+	// transactions themselves.
+	Version    int    `json:"version,omitempty"`
+	MerkleRoot string `json:"merkle_root,omitempty"`
 }
 
 type Blockchain struct {
+	mu           sync.RWMutex
 	chain        []Block
+	hashes       []string // hashes[i] is the hash of chain[i]
+	state        *State   // what chain adds up to
 	transactions []Transaction
+	received     map[string]time.Time // transaction id -> when it was added to the mempool
 	nodes        StringSet
+	self         string // address of this node, never registered as a peer
+	hasher       Hasher
+	difficulty   int32
+
+	peerFailures         map[string]int
+	peerFailureThreshold int
+	peerRetryAttempts    int
+	peerRetryDelay       time.Duration
+	peerSample           int
+	peerCacheTTL         time.Duration
+	peerResponseLimit    int64
+	noBinarySync         bool
+	peerCacheMu          sync.Mutex
+	peerCache            map[string]peerResponse // node and path -> answer
+	httpClient           *http.Client
+
+	onReorg  func(ReorgEvent)
+	orphaned []Transaction
+
+	rejectedBlocks map[string]rejectedBlock // hash -> why it was rejected
+	synced         bool                     // no peer had more work when conflicts were last resolved
+
+	coinbaseMaturity int64
+	coinbaseSender   string
+	allowBurn        bool
+	proofMode        ProofMode
+	maxTxPerBlock    int
+	feeRate          float64
+	maxTxData        int
+	maxMempoolSize   int
+	mempoolPolicy    MempoolPolicy
+	gossipTxs        bool
+	networkSecret    string
+	checkpoints      map[int64]string // block index -> hash
+	minerKey         ed25519.PrivateKey
+
+	signatureMu        sync.Mutex
+	verifiedSignatures map[string]bool // hashes of blocks with a valid signature
+
+	webhooks             map[string][]string // transaction id -> callbacks
+	webhookConfirmations int64
+
+	// The goroutines running in the background are tracked by background,
+	// and stop once closing is closed. closingCtx is done at the same time,
+	// to cancel the requests to peers they may be waiting for.
+	closeMu       sync.Mutex
+	closed        bool
+	closing       chan struct{}
+	closingCtx    context.Context
+	cancelClosing context.CancelFunc
+	background    sync.WaitGroup
+}
+
+// defaultDifficulty is the number of leading zeroes a proof hash needs.
+const defaultDifficulty = 6
+
+// ProofMode is how the difficulty of the proof of work is interpreted.
+type ProofMode int
+
+const (
+	// ProofPrefix requires the hex digest of a proof to start with
+	// difficulty zeroes, so every step of difficulty is 4 bits.
+	ProofPrefix ProofMode = iota
+	// ProofTarget reads the digest of a proof as a number and requires it to
+	// be below a target with difficulty leading zero bits, which allows
+	// finer grained difficulties.
+	ProofTarget
+)
+
+// miningReward is the number of coins minted for the miner of a block, on top
+// of the fees of the transactions in it.
+const miningReward = 1
+
+// Hasher turns data into the hex encoded digest used for block hashes and
+// proof of work.
+type Hasher func(data []byte) string
+
+// ChainStats summarizes the state of a blockchain.
+type ChainStats struct {
+	Height            int64 `json:"height"`
+	TotalTransactions int   `json:"total_transactions"`
+	TotalSupply       int64 `json:"total_supply"`
+	Difficulty        int   `json:"difficulty"`
+	MempoolSize       int   `json:"mempool_size"`
+	Peers             int   `json:"peers"`
+	LatestBlockTime   int64 `json:"latest_block_timestamp"`
+}
+
+// NodeStatus is a one glance summary of the health of a node.
+type NodeStatus struct {
+	// Synced is whether the last time conflicts were resolved no peer had a
+	// chain with more work than ours. It is false until conflicts are
+	// resolved once.
+	Synced              bool  `json:"synced"`
+	Height              int64 `json:"height"`
+	Peers               int   `json:"peers"`
+	Mempool             int   `json:"mempool"`
+	LastBlockAgeSeconds int64 `json:"last_block_age_seconds"`
+}
+
+// Snapshot is the complete state of a node: its chain, its mempool and the
+// nodes it knows about. Version is the SnapshotVersion of the format it was
+// written in.
+type Snapshot struct {
+	Version      int           `json:"version"`
+	Chain        []Block       `json:"chain"`
+	Transactions []Transaction `json:"transactions"`
+	Nodes        []string      `json:"nodes"`
+}
+
+// BlockchainOption configures the blockchain created by NewBlockchain.
+type BlockchainOption func(*Blockchain)
+
+// WithHasher replaces the default SHA-256 hashing of blocks and proofs.
+// Every node of a network has to use the same hasher to agree on the chain.
+func WithHasher(hasher Hasher) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.hasher = hasher
+	}
 }
 
-func (bc *Blockchain) NewBlock(proof int64, previousHash string) Block {
+// NewBlock adds a block holding all pending transactions to the chain. The
+// block is linked to the current tip, whose hash previousHash may give to
+// make sure the chain didn't change meanwhile: if it isn't the hash of the
+// tip, no block is added and ErrStaleTip is returned. On an empty chain the
+// block becomes the genesis block, following previousHash.
+//
+// The block pays no mining reward, which only the genesis block may lack:
+// mine the other blocks with ForgeBlock.
+func (bc *Blockchain) NewBlock(proof int64, previousHash string) (Block, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if len(bc.chain) > 0 && previousHash != "" {
+		if tip := bc.tipHash(); previousHash != tip {
+			return Block{}, fmt.Errorf("%w: block would follow %s but the tip is %s", ErrStaleTip, previousHash, tip)
+		}
+	}
+	transactions, rest := bc.partitionMempool()
+	bc.transactions = rest
+	return bc.newBlock(proof, previousHash, transactions), nil
+}
+
+// newBlock appends a block to the chain. previousHash is only used for the
+// genesis block, the others always follow the current tip.
+func (bc *Blockchain) newBlock(proof int64, previousHash string, transactions []Transaction) Block {
 	prevHash := previousHash
-	if previousHash == "" {
-		prevBlock := bc.chain[len(bc.chain)-1]
-		prevHash = computeHashForBlock(prevBlock)
+	if len(bc.hashes) > 0 {
+		prevHash = bc.tipHash()
+	}
+
+	// Blocks are never older than their parent, even if the clock went
+	// backwards or the parent was mined by a node whose clock is ahead.
+	timestamp := time.Now().UnixNano()
+	if len(bc.chain) > 0 && timestamp <= bc.lastBlock().Timestamp {
+		timestamp = bc.lastBlock().Timestamp + 1
 	}
 
 	newBlock := Block{
 		Index:        int64(len(bc.chain) + 1),
-		Timestamp:    time.Now().UnixNano(),
-		Transactions: bc.transactions,
+		Timestamp:    timestamp,
+		Transactions: transactions,
 		Proof:        proof,
 		PreviousHash: prevHash,
+		Difficulty:   bc.Difficulty(),
+		Version:      BlockVersion,
+		MerkleRoot:   MerkleRoot(transactions),
 	}
+	bc.signBlock(&newBlock)
 
-	bc.transactions = nil
-	bc.chain = append(bc.chain, newBlock)
+	bc.appendBlock(newBlock, bc.computeHashForBlock(newBlock))
 	return newBlock
 }
 
-func (bc *Blockchain) NewTransaction(tx Transaction) int64 {
+// appendBlock adds block, whose hash is hash, on top of the chain and brings
+// everything that depends on the chain up to date.
+func (bc *Blockchain) appendBlock(block Block, hash string) {
+	bc.chain = append(bc.chain, block)
+	bc.hashes = append(bc.hashes, hash)
+	bc.state.apply(block)
+	bc.fireWebhooks()
+	bc.forgetOrphans(block)
+	for _, tx := range block.Transactions {
+		delete(bc.received, tx.ID())
+	}
+}
+
+// ForgeBlock adds a new block with the given proof to the chain. The block
+// holds the pending transactions returned by SelectTransactions plus the
+// reward for the miner, which is the mining reward and the fees of those
+// transactions. The other transactions stay in the mempool.
+//
+// The proof must be valid on top of the current tip. If the chain changed
+// since the proof was found, ErrStaleTip is returned and nothing is added.
+func (bc *Blockchain) ForgeBlock(proof int64, miner string) (Block, error) {
+	return bc.ForgeBlockSplit(proof, map[string]int{miner: 1})
+}
+
+// ForgeBlockSplit is ForgeBlock, except that the reward is split among the
+// addresses of split in proportion to their weights, e.g. among the members
+// of a mining pool. Every address gets a reward transaction of its own. The
+// shares are rounded down and what is left goes to the address with the
+// largest weight, so that they add up to the reward exactly.
+func (bc *Blockchain) ForgeBlockSplit(proof int64, split map[string]int) (Block, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if len(split) == 0 {
+		return Block{}, fmt.Errorf("reward split has no addresses")
+	}
+	for address, weight := range split {
+		if weight <= 0 {
+			return Block{}, fmt.Errorf("reward split: weight of %s must be positive", address)
+		}
+	}
+
+	if len(bc.chain) == 0 {
+		return Block{}, ErrEmptyChain
+	}
+	if last := bc.lastBlock(); !bc.validProof(last.Proof, proof, bc.Difficulty()) {
+		return Block{}, fmt.Errorf("%w: proof %d is not valid on top of block %d", ErrStaleTip, proof, last.Index)
+	}
+
+	transactions, rest := bc.partitionMempool()
+
+	// Improvement (1): The miner receives the transaction fee as a reward.
+	reward := bc.BlockReward(bc.lastBlock().Index + 1)
+	for _, tx := range transactions {
+		var ok bool
+		if reward, ok = addInt64(reward, tx.Fee); !ok {
+			return Block{}, fmt.Errorf("%w: the fees of the pending transactions exceed %d coins", ErrInvalidTransaction, int64(math.MaxInt64))
+		}
+	}
+	bc.transactions = rest
+	transactions = append(transactions, bc.rewardTransactions(reward, split)...)
+	return bc.newBlock(proof, "", transactions), nil
+}
+
+// rewardTransactions splits reward among the addresses of split in
+// proportion to their weights, as described by ForgeBlockSplit. Addresses
+// whose share rounds down to nothing get no transaction.
+func (bc *Blockchain) rewardTransactions(reward int64, split map[string]int) []Transaction {
+	addresses := make([]string, 0, len(split))
+	var total int64
+	for address, weight := range split {
+		addresses = append(addresses, address)
+		total += int64(weight)
+	}
+	// Sorted so that the block is the same whatever the order of the map,
+	// and so that ties for the largest weight are broken the same way.
+	sort.Strings(addresses)
+
+	largest := 0
+	shares := make([]int64, len(addresses))
+	rest := reward
+	for i, address := range addresses {
+		if split[address] > split[addresses[largest]] {
+			largest = i
+		}
+		// reward * weight may not fit in an int64.
+		share := new(big.Int).Mul(big.NewInt(reward), big.NewInt(int64(split[address])))
+		shares[i] = share.Div(share, big.NewInt(total)).Int64()
+		rest -= shares[i]
+	}
+	shares[largest] += rest
+
+	var transactions []Transaction
+	for i, address := range addresses {
+		if shares[i] > 0 {
+			// The sender is the coinbase sender to signify that this node has
+			// mined a new coin.
+			transactions = append(transactions, Transaction{Sender: bc.coinbaseSender, Recipient: address, Amount: shares[i], Fee: 0})
+		}
+	}
+	return transactions
+}
+
+// SelectTransactions returns the pending transactions the next mined block
+// will contain: the first ones in the order of the mempool policy that
+// aren't locked until a later block, up to the maximum number of
+// transactions per block.
+func (bc *Blockchain) SelectTransactions() []Transaction {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.selectTransactions()
+}
+
+func (bc *Blockchain) selectTransactions() []Transaction {
+	selected, _ := bc.partitionMempool()
+	return selected
+}
+
+// partitionMempool splits the pending transactions into those the next block
+// holds, as described by SelectTransactions, and those left for later.
+func (bc *Blockchain) partitionMempool() (selected, rest []Transaction) {
+	next := bc.lastBlock().Index + 1
+	chosen := make([]bool, len(bc.transactions))
+	for _, i := range bc.orderedMempool() {
+		tx := bc.transactions[i]
+		if tx.LockUntil > next || (bc.maxTxPerBlock > 0 && len(selected) >= bc.maxTxPerBlock) {
+			continue
+		}
+		chosen[i] = true
+		selected = append(selected, tx)
+	}
+	// The transactions left keep their place in the mempool.
+	for i, tx := range bc.transactions {
+		if !chosen[i] {
+			rest = append(rest, tx)
+		}
+	}
+	return selected, rest
+}
+
+// BlockReward returns the number of coins minted for the miner of the block
+// at index, not counting the fees.
+func (bc *Blockchain) BlockReward(index int64) int64 {
+	return miningReward
+}
+
+// NewTransaction adds tx to the mempool, with its fee set by withFee, and
+// returns the index of the block it will be mined in.
+func (bc *Blockchain) NewTransaction(tx Transaction) (int64, error) {
+	return bc.addTransaction(tx, bc.gossipTxs)
+}
+
+// addTransaction is NewTransaction, forwarding the transaction to the
+// registered nodes if relay is set.
+func (bc *Blockchain) addTransaction(tx Transaction, relay bool) (int64, error) {
+	tx = bc.withFee(tx)
+	bc.mu.Lock()
+	if err := bc.validateTransaction(tx); err != nil {
+		bc.mu.Unlock()
+		return 0, err
+	}
+	if bc.maxMempoolSize > 0 && len(bc.transactions) >= bc.maxMempoolSize {
+		if err := bc.evictForFee(tx.Fee); err != nil {
+			bc.mu.Unlock()
+			return 0, err
+		}
+	}
 	bc.transactions = append(bc.transactions, tx)
-	return bc.LastBlock().Index + 1
+	if _, ok := bc.received[tx.ID()]; !ok {
+		bc.received[tx.ID()] = time.Now()
+	}
+	index := bc.lastBlock().Index + 1
+	if tx.LockUntil > index {
+		index = tx.LockUntil
+	}
+	bc.mu.Unlock()
+
+	if relay {
+		bc.relayTransaction(tx)
+	}
+	return index, nil
+}
+
+// evictForFee makes room in the full mempool for a transaction paying fee by
+// dropping the pending transaction with the lowest fee, the most recent one
+// if there are several. It fails with ErrMempoolFull if no pending
+// transaction pays less than fee.
+func (bc *Blockchain) evictForFee(fee int64) error {
+	lowest := -1
+	for i, pending := range bc.transactions {
+		if lowest < 0 || pending.Fee <= bc.transactions[lowest].Fee {
+			lowest = i
+		}
+	}
+	if lowest < 0 || bc.transactions[lowest].Fee >= fee {
+		return fmt.Errorf("%w: %d transactions are pending", ErrMempoolFull, len(bc.transactions))
+	}
+	log.Printf("mempool full, evicting transaction %s paying a fee of %d", bc.transactions[lowest].ID(), bc.transactions[lowest].Fee)
+	bc.transactions = append(bc.transactions[:lowest:lowest], bc.transactions[lowest+1:]...)
+	return nil
+}
+
+// ValidateTransaction runs the checks NewTransaction does without adding the
+// transaction to the mempool: it must be well-formed, must not mint coins and
+// its sender must be able to afford it.
+func (bc *Blockchain) ValidateTransaction(tx Transaction) error {
+	tx = bc.withFee(tx)
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.validateTransaction(tx)
+}
+
+// withFee returns tx with the fee its sender pays. Without an explicit fee,
+// the sender pays the fee rate of the node on the amount sent, rounded down.
+// The fee is stored in the transaction, so that the miner's reward and the
+// validation of the block don't depend on the fee rate of the node.
+func (bc *Blockchain) withFee(tx Transaction) Transaction {
+	if tx.Fee != 0 || bc.feeRate <= 0 {
+		return tx
+	}
+	var amount int64
+	for _, out := range tx.payouts() {
+		amount += out.Amount
+	}
+	tx.Fee = int64(float64(amount) * bc.feeRate)
+	return tx
+}
+
+func (bc *Blockchain) validateTransaction(tx Transaction) error {
+	if tx.Sender == bc.coinbaseSender {
+		return fmt.Errorf("%w: only miners can mint coins", ErrInvalidTransaction)
+	}
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if len(tx.Data) > bc.maxTxData {
+		return fmt.Errorf("%w: data is %d bytes, the maximum is %d", ErrInvalidTransaction, len(tx.Data), bc.maxTxData)
+	}
+	if err := ValidateAddress(tx.Sender); err != nil {
+		return fmt.Errorf("%w: sender: %v", ErrInvalidTransaction, err)
+	}
+	for _, out := range tx.payouts() {
+		if out.Recipient == bc.coinbaseSender {
+			if !bc.allowBurn {
+				return fmt.Errorf("%w: sending coins to %s would burn them", ErrInvalidTransaction, bc.coinbaseSender)
+			}
+			continue
+		}
+		if err := ValidateAddress(out.Recipient); err != nil {
+			return fmt.Errorf("%w: recipient: %v", ErrInvalidTransaction, err)
+		}
+	}
+	if available := bc.availableBalance(tx.Sender); tx.cost() > available {
+		return fmt.Errorf("%w: %s has %d available but the transaction costs %d", ErrInsufficientFunds, tx.Sender, available, tx.cost())
+	}
+	return nil
+}
+
+// Balance returns the number of coins address owns according to the chain.
+func (bc *Blockchain) Balance(address string) int64 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.balance(address)
+}
+
+func (bc *Blockchain) balance(address string) int64 {
+	return bc.state.Balances[address]
+}
+
+// AvailableBalance returns what address can still spend: its balance minus
+// its immature mining rewards and its pending transactions.
+func (bc *Blockchain) AvailableBalance(address string) int64 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.availableBalance(address)
+}
+
+// availableBalance is the balance of address minus its immature mining
+// rewards and what its pending transactions will spend, so that the mempool
+// can't overdraw it.
+func (bc *Blockchain) availableBalance(address string) int64 {
+	available := bc.balance(address) - bc.immatureRewards(address)
+	for _, tx := range bc.transactions {
+		if tx.Sender == address {
+			available -= tx.cost()
+		}
+	}
+	return available
+}
+
+// immatureRewards returns the coins minted for address in the blocks that
+// don't have coinbaseMaturity blocks mined on top of them yet.
+func (bc *Blockchain) immatureRewards(address string) int64 {
+	var immature int64
+	tip := bc.lastBlock().Index
+	for i := len(bc.chain) - 1; i >= 0 && tip-bc.chain[i].Index < bc.coinbaseMaturity; i-- {
+		for _, tx := range bc.chain[i].Transactions {
+			if tx.Sender == bc.coinbaseSender {
+				immature += tx.balanceChange(address)
+			}
+		}
+	}
+	return immature
+}
+
+// PendingTransactions returns a copy of the transactions waiting to be mined.
+func (bc *Blockchain) PendingTransactions() []Transaction {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return append([]Transaction(nil), bc.transactions...)
+}
+
+// TotalSupply returns the number of coins in circulation: everything minted
+// by the coinbase sender on the chain minus the fees, which were paid back to
+// the miners as part of their reward, and minus the coins burnt by sending
+// them to the coinbase sender.
+func (bc *Blockchain) TotalSupply() int64 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.totalSupply()
+}
+
+func (bc *Blockchain) totalSupply() int64 {
+	return bc.state.Supply
+}
+
+// Stats returns a summary of the chain, the mempool and the known peers.
+func (bc *Blockchain) Stats() ChainStats {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	stats := ChainStats{
+		Height:          bc.lastBlock().Index,
+		TotalSupply:     bc.totalSupply(),
+		Difficulty:      bc.Difficulty(),
+		MempoolSize:     len(bc.transactions),
+		Peers:           len(bc.nodes.Keys()),
+		LatestBlockTime: bc.lastBlock().Timestamp,
+	}
+	for _, block := range bc.chain {
+		stats.TotalTransactions += len(block.Transactions)
+	}
+	return stats
+}
+
+// Status summarizes the chain, the peers and the mempool of the node.
+func (bc *Blockchain) Status() NodeStatus {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	status := NodeStatus{
+		Synced:  bc.synced,
+		Height:  bc.lastBlock().Index,
+		Peers:   len(bc.nodes.Keys()),
+		Mempool: len(bc.transactions),
+	}
+	if len(bc.chain) > 0 {
+		status.LastBlockAgeSeconds = int64(time.Since(time.Unix(0, bc.lastBlock().Timestamp)) / time.Second)
+	}
+	return status
+}
+
+// Genesis returns the first block of the chain together with its hash, or
+// ErrEmptyChain if the chain has no blocks.
+func (bc *Blockchain) Genesis() (HashedBlock, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if len(bc.chain) == 0 {
+		return HashedBlock{}, ErrEmptyChain
+	}
+	return hashedBlock(bc.chain[0], bc.hashes[0]), nil
+}
+
+// GenesisHash returns the hash of the first block. Nodes whose chains have a
+// different genesis hash can't agree on a chain.
+func (bc *Blockchain) GenesisHash() string {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if len(bc.hashes) == 0 {
+		return ""
+	}
+	return bc.hashes[0]
+}
+
+// Difficulty returns the number of leading zeroes a proof hash needs.
+func (bc *Blockchain) Difficulty() int {
+	return int(atomic.LoadInt32(&bc.difficulty))
+}
+
+// SetDifficulty changes the difficulty of the blocks mined from now on.
+// Blocks already on the chain keep the difficulty they were mined with.
+func (bc *Blockchain) SetDifficulty(difficulty int) {
+	atomic.StoreInt32(&bc.difficulty, int32(difficulty))
 }
 
 func (bc *Blockchain) LastBlock() Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.lastBlock()
+}
+
+// lastBlock returns the tip of the chain, or the zero Block if the chain is
+// empty, so that the next block has index 1.
+func (bc *Blockchain) lastBlock() Block {
+	if len(bc.chain) == 0 {
+		return Block{}
+	}
 	return bc.chain[len(bc.chain)-1]
 }
 
+// tipHash returns the hash of the tip of the chain, or "" if the chain is
+// empty.
+func (bc *Blockchain) tipHash() string {
+	if len(bc.hashes) == 0 {
+		return ""
+	}
+	return bc.hashes[len(bc.hashes)-1]
+}
+
+// GetBlockByHash returns the block of the chain whose hash is hash.
+func (bc *Blockchain) GetBlockByHash(hash string) (Block, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	for i, blockHash := range bc.hashes {
+		if blockHash == hash {
+			return bc.chain[i], nil
+		}
+	}
+	return Block{}, fmt.Errorf("%w: block %s", ErrNotFound, hash)
+}
+
+// GetBlockByIndex returns the block at index, counting from 1 like
+// Block.Index.
+func (bc *Blockchain) GetBlockByIndex(index int64) (Block, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if index < 1 || index > int64(len(bc.chain)) {
+		return Block{}, fmt.Errorf("%w: block %d", ErrNotFound, index)
+	}
+	return bc.chain[index-1], nil
+}
+
+// head returns the length of the chain and the hash of its last block.
+func (bc *Blockchain) head() (int, string) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return len(bc.chain), bc.tipHash()
+}
+
+// Chain returns a copy of the blocks of the chain, which the caller may
+// modify freely.
+func (bc *Blockchain) Chain() []Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	chain := make([]Block, len(bc.chain))
+	for i, block := range bc.chain {
+		chain[i] = block.copy()
+	}
+	return chain
+}
+
+// ForEachBlock calls fn for every block of the chain, from the first one on,
+// until fn returns false. Unlike Chain, it doesn't copy the chain, so fn must
+// not modify the transactions of the blocks. The chain can't change while
+// ForEachBlock runs: fn must not call the methods of the blockchain, which
+// could wait for ForEachBlock to return.
+func (bc *Blockchain) ForEachBlock(fn func(Block) bool) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	for _, block := range bc.chain {
+		if !fn(block) {
+			return
+		}
+	}
+}
+
+// HashedBlock is a block together with its hash, as served to clients so that
+// they can check it. The hash isn't part of the block: it is computed from
+// the block by BlockHash.
+type HashedBlock struct {
+	Block
+	Hash string `json:"hash"`
+	// LeadingZeros is the number of leading zero hex digits of Hash.
+	LeadingZeros int `json:"leading_zeros"`
+}
+
+// hashedBlock returns a copy of block with its hash.
+func hashedBlock(block Block, hash string) HashedBlock {
+	return HashedBlock{block.copy(), hash, leadingZeros(hash)}
+}
+
+// leadingZeros returns the number of leading zero digits of the hex encoded
+// hash.
+func leadingZeros(hash string) int {
+	return len(hash) - len(strings.TrimLeft(hash, "0"))
+}
+
+// HashedChain is Chain with the hash of every block.
+func (bc *Blockchain) HashedChain() []HashedBlock {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	chain := make([]HashedBlock, len(bc.chain))
+	for i, block := range bc.chain {
+		chain[i] = hashedBlock(block, bc.hashes[i])
+	}
+	return chain
+}
+
+// BlockRange returns the blocks from index from to index to, both included
+// and counting from 1 like Block.Index, with their hashes. Indexes past the
+// tip are left out.
+func (bc *Blockchain) BlockRange(from, to int64) []HashedBlock {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if from < 1 {
+		from = 1
+	}
+	if height := int64(len(bc.chain)); to > height {
+		to = height
+	}
+	var blocks []HashedBlock
+	for index := from; index <= to; index++ {
+		blocks = append(blocks, hashedBlock(bc.chain[index-1], bc.hashes[index-1]))
+	}
+	return blocks
+}
+
+// Len returns the height of the chain.
+func (bc *Blockchain) Len() int64 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return int64(len(bc.chain))
+}
+
+// copy returns a copy of the block that shares no memory with it.
+func (block Block) copy() Block {
+	transactions := make([]Transaction, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		transactions[i] = tx.copy()
+	}
+	block.Transactions = transactions
+	block.MinerPubKey = append([]byte(nil), block.MinerPubKey...)
+	block.MinerSignature = append([]byte(nil), block.MinerSignature...)
+	return block
+}
+
 func (bc *Blockchain) ProofOfWork(lastProof int64) int64 {
+	proof, _ := bc.ProofOfWorkContext(context.Background(), lastProof)
+	return proof
+}
+
+// ProofOfWorkContext is ProofOfWork, except that it gives up and returns
+// ctx.Err() once ctx is done.
+func (bc *Blockchain) ProofOfWorkContext(ctx context.Context, lastProof int64) (int64, error) {
 	var proof int64 = 0
-	authority := true
+	var replaced int32
+	done := make(chan struct{})
+	defer close(done)
 
 	// Improvement (2): Concurrently keeping an eye on whether the blockchain needs an update,
 	// interrupt the puzzle-solving procedure if an update is needed.
-	go func(auth *bool, bc *Blockchain) {
-		for !bc.ValidProof(lastProof, proof) && *auth {
-			time.Sleep(1*time.Second)	
-			*auth = !bc.ResolveConflicts()
+	started := bc.goBackground(func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-bc.closing:
+				return
+			case <-ticker.C:
+			}
+			if bc.ResolveConflicts() {
+				atomic.StoreInt32(&replaced, 1)
+				return
+			}
 		}
-	} (&authority, bc)
+	})
+	if !started {
+		return -1, ErrClosed
+	}
 
-	for !bc.ValidProof(lastProof, proof) && authority {
+	for !bc.ValidProof(lastProof, proof) {
 		proof += 1
+		if proof%1024 == 0 {
+			if ctx.Err() != nil {
+				return -1, ctx.Err()
+			}
+			if atomic.LoadInt32(&replaced) == 1 {
+				return -1, nil
+			}
+			select {
+			case <-bc.closing:
+				return -1, ErrClosed
+			default:
+			}
+		}
+	}
+	if atomic.LoadInt32(&replaced) == 1 {
+		return -1, nil
+	}
+	return proof, nil
+}
+
+// ProofOfWorkParallel is ProofOfWork spread over workers goroutines, worker i
+// trying the proofs i, i+workers, i+2*workers and so on. The first valid
+// proof found is returned, which isn't necessarily the smallest one. It
+// returns -1 if the blockchain is closed before a proof is found.
+func (bc *Blockchain) ProofOfWorkParallel(lastProof int64, workers int) int64 {
+	if workers < 1 {
+		workers = 1
+	}
+	var found int32
+	proofs := make(chan int64, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(proof int64) {
+			defer wg.Done()
+			for n := 1; ; n++ {
+				if bc.ValidProof(lastProof, proof) {
+					if atomic.CompareAndSwapInt32(&found, 0, 1) {
+						proofs <- proof
+					}
+					return
+				}
+				proof += int64(workers)
+				if n%1024 == 0 {
+					if atomic.LoadInt32(&found) == 1 {
+						return
+					}
+					select {
+					case <-bc.closing:
+						return
+					default:
+					}
+				}
+			}
+		}(int64(i))
 	}
-	if authority {
+	wg.Wait()
+	select {
+	case proof := <-proofs:
 		return proof
-	} else {
+	default:
 		return -1
 	}
-	
 }
 
 func (bc *Blockchain) ValidProof(lastProof, proof int64) bool {
-	guess := fmt.Sprintf("%d%d", lastProof, proof)
-	guessHash := ComputeHashSha256([]byte(guess))
-	return guessHash[:6] == "000000"
+	return bc.validProof(lastProof, proof, bc.Difficulty())
+}
+
+func (bc *Blockchain) validProof(lastProof, proof int64, difficulty int) bool {
+	guessHash := bc.hasher(proofInput(lastProof, proof))
+	if bc.proofMode == ProofTarget {
+		return belowTarget(guessHash, difficulty)
+	}
+	return strings.HasPrefix(guessHash, strings.Repeat("0", difficulty))
+}
+
+// proofInput returns the data hashed to check proof on top of lastProof:
+// both proofs as 8 bytes big endian. Unlike their decimal digits run
+// together, where 12 then 3 and 1 then 23 both read "123", every pair of
+// proofs gives different data.
+func proofInput(lastProof, proof int64) []byte {
+	var buf bytes.Buffer
+	writeInt64(&buf, lastProof)
+	writeInt64(&buf, proof)
+	return buf.Bytes()
+}
+
+// belowTarget reports whether the hex encoded hash, read as a number, has at
+// least difficulty leading zero bits.
+func belowTarget(hash string, difficulty int) bool {
+	bits := 4 * len(hash)
+	if difficulty > bits {
+		return false
+	}
+	value, ok := new(big.Int).SetString(hash, 16)
+	if !ok {
+		return false
+	}
+	target := new(big.Int).Lsh(big.NewInt(1), uint(bits-difficulty))
+	return value.Cmp(target) < 0
+}
+
+// MiningEstimate is how long mining a block is expected to take at a given
+// difficulty, from the hash rate measured on this node.
+type MiningEstimate struct {
+	Difficulty      int     `json:"difficulty"`
+	HashesPerSecond float64 `json:"hashes_per_second"`
+	ExpectedHashes  float64 `json:"expected_hashes"`
+	ExpectedSeconds float64 `json:"expected_seconds"`
+}
+
+// EstimateMining measures how many proofs a single goroutine checks per
+// second during sample, and estimates from it how long finding a proof of
+// the given difficulty takes on average. Nothing is mined.
+func (bc *Blockchain) EstimateMining(difficulty int, sample time.Duration) MiningEstimate {
+	start := time.Now()
+	var hashes int64
+	for elapsed := time.Duration(0); elapsed < sample || hashes == 0; elapsed = time.Since(start) {
+		for i := 0; i < 256; i++ {
+			bc.validProof(start.UnixNano(), hashes, difficulty)
+			hashes++
+		}
+	}
+	rate := float64(hashes) / time.Since(start).Seconds()
+
+	// Every hash meets the difficulty with a probability of 1/16 per hex
+	// digit, or 1/2 per bit.
+	base := 16.0
+	if bc.proofMode == ProofTarget {
+		base = 2
+	}
+	expected := math.Pow(base, float64(difficulty))
+	return MiningEstimate{
+		Difficulty:      difficulty,
+		HashesPerSecond: rate,
+		ExpectedHashes:  expected,
+		ExpectedSeconds: expected / rate,
+	}
+}
+
+// maxDifficulty is the highest difficulty a SHA-256 proof can meet.
+func (bc *Blockchain) maxDifficulty() int {
+	if bc.proofMode == ProofTarget {
+		return 256
+	}
+	return 64
+}
+
+// VerifyProof is an alias of ValidProof.
+func (bc *Blockchain) VerifyProof(lastProof, proof int64) bool {
+	return bc.ValidProof(lastProof, proof)
 }
 
 func (bc *Blockchain) ValidChain(chain *[]Block) bool {
-	lastBlock := (*chain)[0]
-	currentIndex := 1
-	for currentIndex < len(*chain) {
-		block := (*chain)[currentIndex]
-		// Check that the hash of the block is correct
-		if block.PreviousHash != computeHashForBlock(lastBlock) {
-			return false
+	return bc.ValidateChain(*chain) == nil
+}
+
+// BlockError reports the first invalid block of a chain.
+type BlockError struct {
+	Index int64 // position of the block in the chain, starting from 1
+	Err   error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %d: %v", e.Index, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateChain is ValidChain, except that it tells why chain is invalid.
+// The error wraps ErrInvalidChain and, unless chain is empty, is a
+// *BlockError pointing at the first invalid block.
+func (bc *Blockchain) ValidateChain(chain []Block) error {
+	_, err := bc.validChain(chain)
+	return err
+}
+
+// ValidateLocalChain validates our own chain, e.g. to detect a corrupted
+// node.
+func (bc *Blockchain) ValidateLocalChain() error {
+	return bc.ValidateChain(bc.Chain())
+}
+
+// ValidChainFrom is ValidChain for a chain whose blocks before position
+// startIndex, counted from 0, are already known to be valid, e.g. because
+// they are our own. Only the blocks from startIndex on are checked, including
+// their link to the trusted ones. With a startIndex of 0 the whole chain is
+// checked.
+func (bc *Blockchain) ValidChainFrom(chain []Block, startIndex int) bool {
+	_, err := bc.validChainFrom(chain, startIndex, nil)
+	return err == nil
+}
+
+// validChain validates chain and returns the hashes of its blocks, which are
+// computed once each.
+func (bc *Blockchain) validChain(chain []Block) ([]string, error) {
+	return bc.validChainFrom(chain, 0, nil)
+}
+
+// trustedPrefix is what is known of the blocks of a chain before the ones to
+// validate, e.g. of our own blocks: their hashes and the balances they add
+// up to. It spares hashing and replaying them again.
+type trustedPrefix struct {
+	hashes   []string
+	balances map[string]int64
+}
+
+// validChainFrom validates the blocks of chain from position start on. The
+// blocks before it are trusted; prefix, if not nil, holds their hashes and
+// balances, otherwise they are computed from the blocks.
+func (bc *Blockchain) validChainFrom(chain []Block, start int, prefix *trustedPrefix) ([]string, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%w: chain has no blocks", ErrInvalidChain)
+	}
+	if start < 0 || start > len(chain) {
+		return nil, fmt.Errorf("%w: start index %d is out of range", ErrInvalidChain, start)
+	}
+	if prefix != nil && len(prefix.hashes) != start {
+		return nil, fmt.Errorf("%w: %d trusted hashes for %d trusted blocks", ErrInvalidChain, len(prefix.hashes), start)
+	}
+	invalid := func(position int, format string, args ...interface{}) error {
+		return &BlockError{
+			Index: int64(position + 1),
+			Err:   fmt.Errorf("%w: %s", ErrInvalidChain, fmt.Sprintf(format, args...)),
 		}
-		// Check that the Proof of Work is correct
-		if !bc.ValidProof(lastBlock.Proof, block.Proof) {
-			return false
+	}
+	// The blocks up to a checkpoint are known to be right if the checkpoint
+	// matches, so their proofs don't need to be checked again.
+	var trusted int64
+	for index := range bc.checkpoints {
+		if index > trusted && index <= int64(len(chain)) {
+			trusted = index
 		}
-		lastBlock = block
-		currentIndex += 1
+	}
+
+	// The trusted blocks only add up to the balances the following blocks
+	// spend from.
+	hashes := make([]string, len(chain))
+	var balances map[string]int64
+	if prefix != nil {
+		copy(hashes, prefix.hashes)
+		balances = make(map[string]int64, len(prefix.balances))
+		for address, balance := range prefix.balances {
+			balances[address] = balance
+		}
+	} else {
+		state := newState(bc.coinbaseSender)
+		for i, block := range chain[:start] {
+			hashes[i] = bc.computeHashForBlock(block)
+			state.apply(block)
+		}
+		balances = state.Balances
+	}
+
+	for currentIndex := start; currentIndex < len(chain); currentIndex++ {
+		block := chain[currentIndex]
+		if currentIndex > 0 {
+			lastBlock := chain[currentIndex-1]
+			// Check that the hash of the block is correct
+			if block.PreviousHash != hashes[currentIndex-1] {
+				return nil, invalid(currentIndex, "previous hash %s isn't the hash of the block before", block.PreviousHash)
+			}
+			// Check that the Proof of Work is correct, with the difficulty
+			// the block was mined with
+			if int64(currentIndex+1) > trusted &&
+				(block.Difficulty <= 0 || !bc.validProof(lastBlock.Proof, block.Proof, block.Difficulty)) {
+				return nil, invalid(currentIndex, "proof %d isn't valid for difficulty %d", block.Proof, block.Difficulty)
+			}
+		}
+		var parent *Block
+		if currentIndex > 0 {
+			parent = &chain[currentIndex-1]
+		}
+		if err := checkBlockVersion(block, parent); err != nil {
+			return nil, invalid(currentIndex, "%v", err)
+		}
+		// Check that the transactions are well-formed and nobody spends
+		// coins they don't have
+		if err := bc.checkBlockTransactions(block, balances); err != nil {
+			return nil, invalid(currentIndex, "%v", err)
+		}
+		hashes[currentIndex] = bc.computeHashForBlock(block)
+		if err := bc.checkMinerSignatureCached(block, hashes[currentIndex]); err != nil {
+			return nil, invalid(currentIndex, "%v", err)
+		}
+		if !bc.matchesCheckpoint(int64(currentIndex+1), hashes[currentIndex]) {
+			return nil, invalid(currentIndex, "hash %s doesn't match the checkpoint", hashes[currentIndex])
+		}
+	}
+	return hashes, nil
+}
+
+// matchesCheckpoint reports whether hash is the hash of the block at index
+// given by the checkpoints, if they have one for this index.
+func (bc *Blockchain) matchesCheckpoint(index int64, hash string) bool {
+	expected, ok := bc.checkpoints[index]
+	if ok && expected != hash {
+		log.Printf("block %d has hash %s but the checkpoint is %s", index, hash, expected)
+		return false
 	}
 	return true
 }
 
+// checkBlockTransactions validates the transactions of a block and applies
+// them to balances, which holds the balances of the previous blocks. Only
+// the coinbase sender may create coins, and every block but the genesis
+// block must mint exactly its reward plus the fees of its transactions.
+// Apart from the minting transactions, a block can't hold more transactions
+// than we would put in one.
+func (bc *Blockchain) checkBlockTransactions(block Block, balances map[string]int64) error {
+	var minted, fees int64
+	transfers := 0
+	for _, tx := range block.Transactions {
+		if tx.Sender != bc.coinbaseSender {
+			transfers++
+		}
+	}
+	if bc.maxTxPerBlock > 0 && transfers > bc.maxTxPerBlock {
+		return fmt.Errorf("block holds %d transactions but at most %d are allowed", transfers, bc.maxTxPerBlock)
+	}
+	for _, tx := range block.Transactions {
+		if err := tx.check(); err != nil {
+			return err
+		}
+		if tx.LockUntil > block.Index {
+			return fmt.Errorf("transaction %s is locked until block %d", tx.ID(), tx.LockUntil)
+		}
+		var ok bool
+		if tx.Sender == bc.coinbaseSender {
+			if tx.Fee != 0 {
+				return fmt.Errorf("minting transaction has a fee")
+			}
+			if minted, ok = addInt64(minted, tx.cost()); !ok {
+				return fmt.Errorf("block mints more than %d coins", int64(math.MaxInt64))
+			}
+		} else {
+			if balances[tx.Sender] < tx.cost() {
+				return fmt.Errorf("%w: %s has %d but the transaction costs %d", ErrInsufficientFunds, tx.Sender, balances[tx.Sender], tx.cost())
+			}
+			balances[tx.Sender] -= tx.cost()
+			if fees, ok = addInt64(fees, tx.Fee); !ok {
+				return fmt.Errorf("block pays more than %d coins of fees", int64(math.MaxInt64))
+			}
+		}
+		for _, out := range tx.payouts() {
+			if balances[out.Recipient], ok = addInt64(balances[out.Recipient], out.Amount); !ok {
+				return fmt.Errorf("balance of %s would exceed %d coins", out.Recipient, int64(math.MaxInt64))
+			}
+		}
+	}
+	reward, ok := addInt64(bc.BlockReward(block.Index), fees)
+	if !ok {
+		return fmt.Errorf("block reward exceeds %d coins", int64(math.MaxInt64))
+	}
+	// The genesis block isn't mined, so it has no reward to claim.
+	if block.Index == 1 {
+		if minted > reward {
+			return fmt.Errorf("block mints %d coins but its reward is %d", minted, reward)
+		}
+		return nil
+	}
+	if minted == 0 {
+		return fmt.Errorf("block has no minting transaction")
+	}
+	if minted != reward {
+		return fmt.Errorf("block mints %d coins but its reward is %d", minted, reward)
+	}
+	return nil
+}
+
+// Export returns a copy of the whole state of the blockchain.
+func (bc *Blockchain) Export() Snapshot {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return Snapshot{
+		Version:      SnapshotVersion,
+		Chain:        append([]Block(nil), bc.chain...),
+		Transactions: append([]Transaction(nil), bc.transactions...),
+		Nodes:        bc.nodes.Keys(),
+	}
+}
+
+// SnapshotVersion is the version of the snapshots written by Export.
+// Snapshots without a version predate it and count as version 1.
+const SnapshotVersion = 2
+
+// snapshotMigrations[v] upgrades a snapshot of version v to version v+1.
+var snapshotMigrations = map[int]func(*Snapshot){
+	// Version 1 only lacks the version. The block and transaction fields
+	// added since, like lock_until, are left out of its JSON and decode to
+	// their zero value, which is their default.
+	1: func(snapshot *Snapshot) {},
+}
+
+// migrate upgrades snapshot to SnapshotVersion, or returns
+// ErrUnsupportedSnapshot if it was written by a newer gochain.
+func (snapshot Snapshot) migrate() (Snapshot, error) {
+	if snapshot.Version == 0 {
+		snapshot.Version = 1
+	}
+	if snapshot.Version < 0 || snapshot.Version > SnapshotVersion {
+		return Snapshot{}, fmt.Errorf("%w: version %d, this node reads versions 1 to %d", ErrUnsupportedSnapshot, snapshot.Version, SnapshotVersion)
+	}
+	for snapshot.Version < SnapshotVersion {
+		snapshotMigrations[snapshot.Version](&snapshot)
+		snapshot.Version++
+	}
+	return snapshot, nil
+}
+
+// Import replaces the whole state of the blockchain with the snapshot, after
+// upgrading it to the current SnapshotVersion. The snapshot's chain must be
+// valid, otherwise nothing is changed. The pending transactions of the
+// snapshot that aren't valid on top of its chain are dropped.
+func (bc *Blockchain) Import(snapshot Snapshot) error {
+	snapshot, err := snapshot.migrate()
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Chain) == 0 {
+		return fmt.Errorf("%w: snapshot has no blocks", ErrInvalidChain)
+	}
+	hashes, err := bc.validChain(snapshot.Chain)
+	if err != nil {
+		return fmt.Errorf("snapshot chain is not valid: %w", err)
+	}
+
+	nodes := NewStringSet()
+	for _, node := range snapshot.Nodes {
+		nodes.Add(node)
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.chain = append([]Block(nil), snapshot.Chain...)
+	bc.hashes = hashes
+	bc.rebuildState()
+	bc.fireWebhooks()
+	// What was pending, orphaned or rejected relates to the chain being
+	// replaced.
+	bc.transactions = nil
+	bc.received = make(map[string]time.Time)
+	bc.orphaned = nil
+	bc.rejectedBlocks = make(map[string]rejectedBlock)
+	bc.keepVerifiedSignatures(hashes)
+	// The pending transactions of the snapshot are checked in order against
+	// the imported chain like submitted ones, so that a forged snapshot
+	// can't have the node mine an invalid block.
+	for _, tx := range snapshot.Transactions {
+		if err := bc.validateTransaction(tx); err != nil {
+			log.Printf("dropping imported transaction %s: %v", tx.ID(), err)
+			continue
+		}
+		if bc.maxMempoolSize > 0 && len(bc.transactions) >= bc.maxMempoolSize {
+			log.Printf("dropping imported transaction %s: %v", tx.ID(), ErrMempoolFull)
+			continue
+		}
+		bc.transactions = append(bc.transactions, tx)
+	}
+	bc.nodes = nodes
+	bc.nodes.Remove(bc.self)
+	bc.peerFailures = make(map[string]int)
+	return nil
+}
+
+// RegisterNode adds the node at address to the registered nodes and reports
+// whether it was new. The node's own address, see SetSelfAddress, is never
+// registered.
 func (bc *Blockchain) RegisterNode(address string) bool {
-	u, err := url.Parse(address)
+	added, err := bc.AddNode(address)
 	if err != nil {
-		return false
+		log.Printf("not registering node %s: %v", address, err)
 	}
-	return bc.nodes.Add(u.Host)
+	return added
 }
 
+// AddNode is RegisterNode, but tells why a node wasn't registered: it fails
+// with ErrInvalidNode if address isn't a node URL and with ErrSelfNode if it
+// is the node's own address. It returns false without an error if the node
+// was already registered.
+func (bc *Blockchain) AddNode(address string) (bool, error) {
+	node, ok := nodeAddress(address)
+	if !ok {
+		return false, fmt.Errorf("%w: %q", ErrInvalidNode, address)
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if node == bc.self {
+		return false, fmt.Errorf("%w: %s", ErrSelfNode, node)
+	}
+	return bc.nodes.Add(node), nil
+}
+
+// nodeAddress returns the address a node given as a URL is registered under:
+// its host, prefixed with the scheme for HTTPS. Addresses without a scheme,
+// e.g. localhost:5000, are taken as HTTP.
+func nodeAddress(address string) (string, bool) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	switch u.Scheme {
+	case "http":
+		return u.Host, true
+	case "https":
+		return "https://" + u.Host, true
+	}
+	return "", false
+}
+
+// Nodes returns the addresses of the registered nodes.
+func (bc *Blockchain) Nodes() []string {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.nodes.Keys()
+}
+
+// ResolveConflicts replaces our chain with the valid chain of the registered
+// nodes that has the most work, if it has more work than ours.
 func (bc *Blockchain) ResolveConflicts() bool {
-	curmaxLength := len(bc.chain)
-	var authority bool
-	authority = true
-	tempChain := bc.chain
-	for _, node := range bc.nodes.Keys() {
-		anotherchain, err := findExternalChain(node)
+	return bc.ResolveConflictsQuorum(1)
+}
+
+// resolveConflictsEvery runs ResolveConflicts in the background until the
+// blockchain is closed.
+func (bc *Blockchain) resolveConflictsEvery(interval time.Duration) {
+	bc.goBackground(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bc.closing:
+				return
+			case <-ticker.C:
+			}
+			if bc.ResolveConflicts() {
+				log.Println("Chain replaced by a peer's chain")
+			}
+		}
+	})
+}
+
+// ResolveConflictsQuorum is ResolveConflicts, except that a longer chain is
+// only adopted if at least min nodes report it, i.e. report the same length
+// and the same hash for its last block. A single lying node can then no
+// longer make us adopt its chain.
+func (bc *Blockchain) ResolveConflictsQuorum(min int) bool {
+	bc.mu.RLock()
+	local := append([]Block(nil), bc.chain...)
+	trusted := &trustedPrefix{
+		hashes:   append([]string(nil), bc.hashes...),
+		balances: make(map[string]int64, len(bc.state.Balances)),
+	}
+	for address, balance := range bc.state.Balances {
+		trusted.balances[address] = balance
+	}
+	nodes := bc.samplePeers(bc.nodes.Keys())
+	bc.mu.RUnlock()
+	localWork := bc.TotalWork(local)
+
+	// Group the nodes by the chain they report, only looking at the chains
+	// that would replace ours.
+	reported := make(map[chainHead][]string)
+	works := make(map[chainHead]*big.Int)
+	for _, node := range nodes {
+		head, err := bc.findExternalHead(node)
 		if err != nil {
 			continue
 		}
-		if !bc.ValidChain(&anotherchain.Chain) {
+		work, ok := new(big.Int).SetString(head.Work, 10)
+		if !ok || work.Cmp(localWork) <= 0 {
 			continue
 		}
-		if anotherchain.Length > curmaxLength {
-			curmaxLength = anotherchain.Length
-			tempChain = anotherchain.Chain
-			authority = false
+		reported[head] = append(reported[head], node)
+		works[head] = work
+	}
+	bc.mu.Lock()
+	bc.synced = len(reported) == 0
+	bc.mu.Unlock()
+	var heads []chainHead
+	for head, nodes := range reported {
+		if len(nodes) >= min {
+			heads = append(heads, head)
+		}
+	}
+	// Chains with more work first. Between chains with the same work, the
+	// one with the smallest last hash wins, so that all nodes pick the same
+	// chain whatever the order they asked their peers in.
+	sort.Slice(heads, func(i, j int) bool {
+		if c := works[heads[i]].Cmp(works[heads[j]]); c != 0 {
+			return c > 0
+		}
+		return heads[i].LastHash < heads[j].LastHash
+	})
+
+	for _, head := range heads {
+		for _, node := range reported[head] {
+			chain, hashes, ok := bc.fetchChain(node, local, trusted)
+			// The node must send the chain it reported, which is the one the
+			// quorum vouched for.
+			if !ok || len(chain) != head.Length || hashes[len(hashes)-1] != head.LastHash {
+				continue
+			}
+			return bc.adoptChain(chain, hashes)
+		}
+	}
+	return false
+}
+
+// adoptChain replaces our chain with the valid chain of a peer.
+func (bc *Blockchain) adoptChain(chain []Block, hashes []string) bool {
+	bc.mu.Lock()
+	// Our chain may have grown while the peers were queried, only replace
+	// it if the peer's chain still has more work.
+	if bc.TotalWork(chain).Cmp(bc.TotalWork(bc.chain)) <= 0 {
+		bc.mu.Unlock()
+		return false
+	}
+	reorg := bc.replaceChain(chain, hashes)
+	bc.mu.Unlock()
+
+	log.Printf("chain replaced, %d blocks discarded and %d transactions requeued", reorg.Depth, len(reorg.Requeued))
+	if bc.onReorg != nil {
+		bc.onReorg(reorg)
+	}
+	return true
+}
+
+// fetchChain downloads the chain of node and validates it. As long as the
+// peer's chain extends local, whose hashes and balances are in trusted, only
+// the blocks we lack are downloaded and validated. Otherwise the chains
+// forked and the peer's chain is downloaded entirely.
+func (bc *Blockchain) fetchChain(node string, local []Block, trusted *trustedPrefix) ([]Block, []string, bool) {
+	suffix, err := bc.findExternalChainFrom(node, len(local)+1)
+	if err == nil && len(suffix.Chain) > 0 && len(local) > 0 &&
+		suffix.Chain[0].Index == int64(len(local)+1) &&
+		suffix.Chain[0].PreviousHash == trusted.hashes[len(trusted.hashes)-1] {
+		// Our own blocks don't need to be hashed nor replayed again.
+		chain := append(append([]Block(nil), local...), suffix.Chain...)
+		if hashes, err := bc.validChainFrom(chain, len(local), trusted); err == nil {
+			return chain, hashes, true
 		}
 	}
-	bc.chain = tempChain	
-	return (!authority)
+
+	anotherchain, err := bc.findExternalChain(node)
+	if err != nil {
+		return nil, nil, false
+	}
+	hashes, err := bc.validChain(anotherchain.Chain)
+	if err != nil {
+		log.Printf("rejected chain of %s: %v", node, err)
+		return nil, nil, false
+	}
+	return anotherchain.Chain, hashes, true
 }
 
-func NewBlockchain() *Blockchain {
+// WithCoinbaseMaturity makes mining rewards unspendable until maturity blocks
+// have been mined on top of the block that minted them, so that coins which
+// may still be orphaned by a reorg can't be spent.
+func WithCoinbaseMaturity(maturity int64) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.coinbaseMaturity = maturity
+	}
+}
+
+// DefaultCoinbaseSender is the sender of the transactions minting the mining
+// rewards, unless the blockchain is created with WithCoinbaseSender.
+const DefaultCoinbaseSender = "0"
+
+// WithCoinbaseSender makes sender the sender of the transactions minting the
+// mining rewards, instead of DefaultCoinbaseSender. Only blocks may hold
+// transactions from it, so it mustn't be empty nor an address anybody could
+// own. All nodes of a network must use the same sender.
+func WithCoinbaseSender(sender string) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.coinbaseSender = sender
+	}
+}
+
+// WithBurning lets transactions send coins to the coinbase sender, which
+// takes them out of circulation for good. Such transactions are refused by
+// default, as they are most likely mistakes.
+func WithBurning() BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.allowBurn = true
+	}
+}
+
+// WithProofMode sets how the difficulty is interpreted. With ProofTarget the
+// difficulty counts bits instead of hex digits. All nodes of a network must
+// use the same mode.
+func WithProofMode(mode ProofMode) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.proofMode = mode
+	}
+}
+
+// WithFeeRate makes the transactions submitted without a fee pay rate times
+// the amount they send, e.g. 0.01 for 1%. Transactions with an explicit fee
+// pay that fee instead.
+func WithFeeRate(rate float64) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.feeRate = rate
+	}
+}
+
+// WithMaxMempoolSize limits the number of pending transactions. Once the
+// mempool is full, a new transaction is only accepted if it pays a higher fee
+// than a pending one, which is dropped to make room.
+func WithMaxMempoolSize(max int) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.maxMempoolSize = max
+	}
+}
+
+// WithCheckpoints makes the chains of peers valid only if their blocks at
+// the given indexes have the given hashes. Checkpoints protect against deep
+// reorgs, and the proofs of the blocks up to a checkpoint aren't checked.
+func WithCheckpoints(checkpoints map[int64]string) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.checkpoints = checkpoints
+	}
+}
+
+// defaultMaxTxData is the number of bytes of data a transaction may carry.
+const defaultMaxTxData = 256
+
+// WithMaxTxData sets the number of bytes of data a new transaction may carry.
+func WithMaxTxData(max int) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.maxTxData = max
+	}
+}
+
+// WithMaxTxPerBlock limits the number of transactions in a block, not
+// counting the mining reward. Transactions that don't fit wait in the mempool
+// for the next block, and peer chains with larger blocks are rejected.
+func WithMaxTxPerBlock(max int) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.maxTxPerBlock = max
+	}
+}
+
+// WithDifficulty sets the number of leading zeroes a proof hash needs.
+func WithDifficulty(difficulty int) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.difficulty = int32(difficulty)
+	}
+}
+
+func NewBlockchain(opts ...BlockchainOption) *Blockchain {
 	newBlockchain := &Blockchain{
-		chain:        make([]Block, 0),
-		transactions: make([]Transaction, 0),
-		nodes:        NewStringSet(),
+		chain:          make([]Block, 0),
+		transactions:   make([]Transaction, 0),
+		received:       make(map[string]time.Time),
+		nodes:          NewStringSet(),
+		coinbaseSender: DefaultCoinbaseSender,
+		hasher:         ComputeHashSha256,
+		difficulty:     defaultDifficulty,
+
+		peerFailures:         make(map[string]int),
+		peerCache:            make(map[string]peerResponse),
+		peerFailureThreshold: defaultPeerFailureThreshold,
+		peerRetryAttempts:    defaultPeerRetryAttempts,
+		peerRetryDelay:       defaultPeerRetryDelay,
+		peerResponseLimit:    DefaultPeerResponseLimit,
+		httpClient:           &http.Client{Timeout: DefaultPeerTimeout},
+
+		maxTxData:            defaultMaxTxData,
+		webhooks:             make(map[string][]string),
+		webhookConfirmations: defaultWebhookConfirmations,
+
+		rejectedBlocks:     make(map[string]rejectedBlock),
+		verifiedSignatures: make(map[string]bool),
+
+		closing: make(chan struct{}),
+	}
+	newBlockchain.closingCtx, newBlockchain.cancelClosing = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(newBlockchain)
 	}
+	newBlockchain.state = newState(newBlockchain.coinbaseSender)
 	// Initial, sentinel block
 	newBlockchain.NewBlock(100, "1")
 	return newBlockchain
 }
 
-func computeHashForBlock(block Block) string {
+// Close stops the goroutines of the blockchain, like peer pruning and the
+// proof of work in progress, and waits for them to return. The requests to
+// peers in progress are cancelled. Calling it again does nothing.
+func (bc *Blockchain) Close() error {
+	bc.closeMu.Lock()
+	if !bc.closed {
+		bc.closed = true
+		close(bc.closing)
+		bc.cancelClosing()
+	}
+	bc.closeMu.Unlock()
+
+	bc.background.Wait()
+	return nil
+}
+
+// goBackground runs f in a goroutine that Close waits for. f must return
+// once bc.closing is closed. It returns false, without running f, if the
+// blockchain is already closed.
+func (bc *Blockchain) goBackground(f func()) bool {
+	bc.closeMu.Lock()
+	defer bc.closeMu.Unlock()
+	if bc.closed {
+		return false
+	}
+	bc.background.Add(1)
+	go func() {
+		defer bc.background.Done()
+		f()
+	}()
+	return true
+}
+
+// BlockHash returns the hash of block, which the next block refers to as its
+// previous hash.
+func (bc *Blockchain) BlockHash(block Block) string {
+	return bc.computeHashForBlock(block)
+}
+
+// computeHashForBlock hashes the canonical encoding of the consensus fields
+// of block: its header, see blockHeader, followed by the miner signature, as
+// a length prefixed string, if the block is signed. The fields are written in
+// a fixed order with an explicit byte layout instead of marshalling the
+// struct, so neither fields added to Block later (like its own hash) nor the
+// way encoding/json renders them can make nodes disagree on a hash. Changing
+// the encoding changes the hash of every block, and nodes that don't upgrade
+// together can no longer agree on a chain; the hashes pinned in
+// blockchain_test.go catch it.
+func (bc *Blockchain) computeHashForBlock(block Block) string {
+	return hashHeader(blockHeader(block), block.MinerSignature, bc.hasher)
+}
+
+// hashHeader hashes header followed by signature, if there is one.
+func hashHeader(header, signature []byte, hasher Hasher) string {
+	if len(signature) > 0 {
+		var buf bytes.Buffer
+		buf.Write(header)
+		writeString(&buf, string(signature))
+		header = buf.Bytes()
+	}
+	return hasher(header)
+}
+
+// blockHeader returns the data of block the miner signs: everything that is
+// hashed but the signature itself. Integers are 8 bytes big endian and
+// strings are prefixed by their length as such an integer. The layout of
+// blocks of version 2 or later is given by BlockHeader. That of the older
+// ones is:
+//
+//	index
+//	timestamp
+//	number of transactions
+//	for every transaction: its CanonicalBytes
+//	proof
+//	previous hash
+//	difficulty
+//	miner public key, if the block is signed
+func blockHeader(block Block) []byte {
+	if block.Version >= 2 {
+		return block.Header().bytes()
+	}
 	var buf bytes.Buffer
-	// Data for binary.Write must be a fixed-size value or a slice of fixed-size values,
-	// or a pointer to such data.
-	jsonblock, marshalErr := json.Marshal(block)
-	if marshalErr != nil {
-		log.Fatalf("Could not marshal block: %s", marshalErr.Error())
+	writeInt64(&buf, block.Index)
+	writeInt64(&buf, block.Timestamp)
+	writeInt64(&buf, int64(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		buf.Write(tx.CanonicalBytes())
 	}
-	hashingErr := binary.Write(&buf, binary.BigEndian, jsonblock)
-	if hashingErr != nil {
-		log.Fatalf("Could not hash block: %s", hashingErr.Error())
+	writeInt64(&buf, block.Proof)
+	writeString(&buf, block.PreviousHash)
+	// The difficulty is hashed too, otherwise a peer could lower it after
+	// the fact to make a cheap proof look valid.
+	writeInt64(&buf, int64(block.Difficulty))
+	// Unsigned blocks hash as they did before blocks could be signed.
+	if len(block.MinerPubKey) > 0 || len(block.MinerSignature) > 0 {
+		writeString(&buf, string(block.MinerPubKey))
 	}
-	return ComputeHashSha256(buf.Bytes())
+	return buf.Bytes()
 }
 
 type blockchainInfo struct {
@@ -201,14 +1736,152 @@ type blockchainInfo struct {
 	Chain  []Block `json:"chain"`
 }
 
-func findExternalChain(address string) (blockchainInfo, error) {
-	response, err := http.Get(fmt.Sprintf("http://%s/chain", address))
-	if err == nil && response.StatusCode == http.StatusOK {
-		var bi blockchainInfo
-		if err := json.NewDecoder(response.Body).Decode(&bi); err != nil {
-			return blockchainInfo{}, err
+// chainHead describes the tip of a chain, so that peers can compare chains
+// without downloading them.
+type chainHead struct {
+	Length   int    `json:"length"`
+	LastHash string `json:"last_hash"`
+	Work     string `json:"total_work"` // decimal, it doesn't fit in an int64
+}
+
+// chainHead returns the head of our chain.
+func (bc *Blockchain) chainHead() chainHead {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return chainHead{
+		Length:   len(bc.chain),
+		LastHash: bc.tipHash(),
+		Work:     bc.TotalWork(bc.chain).String(),
+	}
+}
+
+// TotalWork returns the work that went into chain: the sum over its blocks of
+// the number of hashes expected to find their proofs, 2^bits where bits is
+// the number of leading zero bits the difficulty requires. Consensus prefers
+// the chain with the most work, not the most blocks, so that many easy blocks
+// can't outweigh fewer hard ones.
+func (bc *Blockchain) TotalWork(chain []Block) *big.Int {
+	total := new(big.Int)
+	for _, block := range chain {
+		// No proof can meet more than the maximum difficulty, and the proof
+		// of the genesis block isn't checked, so its difficulty could be
+		// anything.
+		difficulty := block.Difficulty
+		if difficulty < 0 {
+			difficulty = 0
+		} else if difficulty > bc.maxDifficulty() {
+			difficulty = bc.maxDifficulty()
 		}
-		return bi, nil
+		bits := difficulty
+		if bc.proofMode == ProofPrefix {
+			bits *= 4
+		}
+		total.Add(total, new(big.Int).Lsh(big.NewInt(1), uint(bits)))
+	}
+	return total
+}
+
+func (bc *Blockchain) findExternalChain(address string) (blockchainInfo, error) {
+	return bc.getChainFromPeer(address, "/chain")
+}
+
+// findExternalChainFrom downloads the blocks of the peer's chain starting at
+// index from.
+func (bc *Blockchain) findExternalChainFrom(address string, from int) (blockchainInfo, error) {
+	return bc.getChainFromPeer(address, fmt.Sprintf("/chain?from=%d", from))
+}
+
+func (bc *Blockchain) findExternalHead(address string) (chainHead, error) {
+	var head chainHead
+	err := bc.getFromPeer(address, "/chain/head", &head)
+	return head, err
+}
+
+// getFromPeer decodes the JSON answer of the peer at address to a GET
+// request on path into v.
+func (bc *Blockchain) getFromPeer(address, path string, v interface{}) error {
+	body, _, err := bc.askPeer(address, path, "application/json")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// getChainFromPeer downloads a chain from the peer at address, in the
+// binary format if the peer knows it and binary sync isn't disabled, and in
+// JSON otherwise.
+func (bc *Blockchain) getChainFromPeer(address, path string) (blockchainInfo, error) {
+	accept := BinaryChainType + ", application/json;q=0.9"
+	if bc.noBinarySync {
+		accept = "application/json"
+	}
+	body, contentType, err := bc.askPeer(address, path, accept)
+	if err != nil {
+		return blockchainInfo{}, err
+	}
+	if contentType == BinaryChainType {
+		if bc.noBinarySync {
+			return blockchainInfo{}, fmt.Errorf("node %s answered %s, which wasn't asked for", address, contentType)
+		}
+		return decodeChain(body)
+	}
+	var bi blockchainInfo
+	err = json.Unmarshal(body, &bi)
+	return bi, err
+}
+
+// askPeer sends a GET request on path to the peer at address, accepting the
+// media types in accept, and returns the body and the type of its answer.
+// Answers over the peer response limit are refused without reading them
+// further.
+func (bc *Blockchain) askPeer(address, path, accept string) ([]byte, string, error) {
+	if resp, ok := bc.cachedPeerResponse(address, path); ok {
+		return resp.body, resp.contentType, nil
+	}
+
+	request, err := http.NewRequestWithContext(bc.closingCtx, http.MethodGet, nodeURL(address, path), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	request.Header.Set("Accept", accept)
+
+	var response *http.Response
+	// Only retry when the peer couldn't be reached at all, e.g. while it
+	// restarts. An HTTP error is an answer and asking again won't change it.
+	delay := bc.peerRetryDelay
+	for attempt := 1; ; attempt++ {
+		response, err = bc.httpClient.Do(request)
+		if err == nil || attempt >= bc.peerRetryAttempts {
+			break
+		}
+		select {
+		case <-bc.closing:
+			return nil, "", ErrClosed
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("node %s answered %s", address, response.Status)
+	}
+	if response.ContentLength > bc.peerResponseLimit {
+		return nil, "", fmt.Errorf("node %s answered %d bytes, more than the limit of %d", address, response.ContentLength, bc.peerResponseLimit)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, bc.peerResponseLimit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(body)) > bc.peerResponseLimit {
+		return nil, "", fmt.Errorf("node %s answered more than the limit of %d bytes", address, bc.peerResponseLimit)
+	}
+	contentType := response.Header.Get("Content-Type")
+	if bc.peerCacheTTL > 0 {
+		bc.cachePeerResponse(address, path, body, contentType)
 	}
-	return blockchainInfo{}, err
+	return body, contentType, nil
 }
@@ -0,0 +1,1467 @@
+package gochain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAddress returns a valid address derived from name.
+func testAddress(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return string(NewAddress(sum[:20]))
+}
+
+// newTestBlockchain returns a blockchain with the lowest difficulty, so that
+// tests mine quickly. It is closed when the test ends.
+func newTestBlockchain(t testing.TB, opts ...BlockchainOption) *Blockchain {
+	t.Helper()
+	bc := NewBlockchain(append([]BlockchainOption{WithDifficulty(1)}, opts...)...)
+	t.Cleanup(func() { bc.Close() })
+	return bc
+}
+
+// mineBlocks forges n blocks on top of the chain of bc, rewarding miner.
+func mineBlocks(t testing.TB, bc *Blockchain, n int, miner string) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := bc.ForgeBlock(bc.ProofOfWork(bc.LastBlock().Proof), miner); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 3, miner)
+	if _, err := source.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	source.RegisterNode("http://10.0.0.1:5000")
+
+	imported := newTestBlockchain(t)
+	if err := imported.Import(source.Export()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imported.Chain(), source.Chain()) {
+		t.Error("imported chain differs from the exported one")
+	}
+	if got := imported.Export(); len(got.Transactions) != 1 || !reflect.DeepEqual(got.Nodes, []string{"10.0.0.1:5000"}) {
+		t.Errorf("imported mempool %v and nodes %v", got.Transactions, got.Nodes)
+	}
+	if imported.Balance(miner) != source.Balance(miner) {
+		t.Errorf("imported balance is %d, want %d", imported.Balance(miner), source.Balance(miner))
+	}
+}
+
+func TestImportVersion1(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 3, miner)
+	if _, err := source.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Version 1 documents had no version.
+	data, err := json.Marshal(source.Export())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatal(err)
+	}
+	delete(document, "version")
+	if data, err = json.Marshal(document); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	bc := newTestBlockchain(t)
+	if err := bc.Import(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bc.Chain(), source.Chain()) {
+		t.Error("imported chain differs from the exported one")
+	}
+	got := bc.Export()
+	if got.Version != SnapshotVersion || len(got.Transactions) != 1 || got.Transactions[0].LockUntil != 0 {
+		t.Errorf("imported version %d with mempool %v", got.Version, got.Transactions)
+	}
+
+	for _, version := range []int{-1, SnapshotVersion + 1} {
+		snapshot.Version = version
+		if err := bc.Import(snapshot); !errors.Is(err, ErrUnsupportedSnapshot) {
+			t.Errorf("version %d: %v, want ErrUnsupportedSnapshot", version, err)
+		}
+	}
+}
+
+func TestImportRejectsInvalidChain(t *testing.T) {
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 2, testAddress("miner"))
+	snapshot := source.Export()
+	snapshot.Chain[1].Proof++
+
+	bc := newTestBlockchain(t)
+	before := bc.Chain()
+	if err := bc.Import(snapshot); !errors.Is(err, ErrInvalidChain) {
+		t.Fatalf("Import returned %v, want ErrInvalidChain", err)
+	}
+	if !reflect.DeepEqual(bc.Chain(), before) {
+		t.Error("chain changed after a refused import")
+	}
+}
+
+func TestImportDropsInvalidTransactions(t *testing.T) {
+	miner, alice, broke := testAddress("miner"), testAddress("alice"), testAddress("broke")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 3, miner)
+	valid := Transaction{Sender: miner, Recipient: alice, Amount: 1}
+	snapshot := source.Export()
+	snapshot.Transactions = []Transaction{
+		{Sender: DefaultCoinbaseSender, Recipient: alice, Amount: 1000},
+		{Sender: broke, Recipient: alice, Amount: 50},
+		valid,
+	}
+
+	bc := newTestBlockchain(t)
+	if err := bc.Import(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got := bc.Export().Transactions; !reflect.DeepEqual(got, []Transaction{valid}) {
+		t.Fatalf("mempool after import is %v, want only %v", got, valid)
+	}
+
+	// Mining what was imported must give a chain the node itself accepts.
+	mineBlocks(t, bc, 1, miner)
+	if err := bc.ValidateLocalChain(); err != nil {
+		t.Fatal(err)
+	}
+	if bc.Balance(broke) != 0 {
+		t.Errorf("balance of the unfunded sender is %d", bc.Balance(broke))
+	}
+}
+
+func TestImportResetsChainCaches(t *testing.T) {
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 2, testAddress("miner"))
+
+	bc := newTestBlockchain(t)
+	bc.orphaned = []Transaction{{Sender: testAddress("a"), Recipient: testAddress("b"), Amount: 1}}
+	bc.received["stale"] = time.Now()
+	bc.rejectedBlocks["stale"] = rejectedBlock{ErrInvalidChain, time.Now()}
+	if err := bc.Import(source.Export()); err != nil {
+		t.Fatal(err)
+	}
+	if len(bc.orphaned) != 0 || len(bc.received) != 0 || len(bc.rejectedBlocks) != 0 {
+		t.Errorf("orphaned %v, received %v and rejected %v survived the import", bc.orphaned, bc.received, bc.rejectedBlocks)
+	}
+}
+
+func TestCloseIsIdempotentAndStopsGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	bc := NewBlockchain(WithDifficulty(1))
+	bc.pruneUnreachableEvery(time.Millisecond)
+	bc.resolveConflictsEvery(time.Millisecond)
+	if err := bc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Goroutines of the runtime and the tests may still be winding down.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before, %d after Close", before, after)
+	}
+}
+
+func TestCloseCancelsPeerRequests(t *testing.T) {
+	release := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer peer.Close()
+	defer close(release)
+
+	bc := NewBlockchain(WithDifficulty(1))
+	bc.RegisterNode(peer.URL)
+	bc.resolveConflictsEvery(time.Millisecond)
+	// Let the loop get stuck on the peer.
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		bc.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close is still waiting for a peer that never answers")
+	}
+}
+
+// recordingPeer serves the chain of bc over HTTP and records the query of
+// every request for /chain.
+func recordingPeer(t testing.TB, bc *Blockchain) (*httptest.Server, *[]string) {
+	t.Helper()
+	h := NewHandler(bc, testAddress("peer"))
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chain" {
+			queries = append(queries, r.URL.RawQuery)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &queries
+}
+
+func TestResolveConflictsFetchesSuffix(t *testing.T) {
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 2, testAddress("peer"))
+	srv, queries := recordingPeer(t, peer)
+
+	bc := newTestBlockchain(t)
+	if err := bc.Import(peer.Export()); err != nil {
+		t.Fatal(err)
+	}
+	bc.RegisterNode(srv.URL)
+	mineBlocks(t, peer, 3, testAddress("peer"))
+
+	if !bc.ResolveConflicts() {
+		t.Fatal("longer chain of the peer not adopted")
+	}
+	if !reflect.DeepEqual(bc.Chain(), peer.Chain()) {
+		t.Error("chain differs from the peer's")
+	}
+	if !reflect.DeepEqual(*queries, []string{"from=4"}) {
+		t.Errorf("requested /chain with %q, want only the suffix from=4", *queries)
+	}
+}
+
+func TestResolveConflictsRejectsUnlinkedSuffix(t *testing.T) {
+	// Both chains have 3 blocks, but their genesis blocks differ, so the
+	// suffix of the peer doesn't follow our block 3.
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 4, testAddress("peer"))
+	srv, queries := recordingPeer(t, peer)
+
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, testAddress("local"))
+	bc.RegisterNode(srv.URL)
+
+	if !bc.ResolveConflicts() {
+		t.Fatal("chain with more work not adopted")
+	}
+	if !reflect.DeepEqual(*queries, []string{"from=4", ""}) {
+		t.Errorf("requested /chain with %q, want the suffix and then the whole chain", *queries)
+	}
+	if !reflect.DeepEqual(bc.Chain(), peer.Chain()) {
+		t.Error("chain differs from the peer's")
+	}
+}
+
+// pinnedGenesis and pinnedBlock are fixed blocks whose hashes are pinned by
+// TestPinnedBlockHashes.
+var (
+	pinnedGenesis = Block{
+		Index:        1,
+		Timestamp:    1600000000000000000,
+		Proof:        100,
+		PreviousHash: "1",
+		Difficulty:   4,
+	}
+	pinnedBlock = Block{
+		Index:     2,
+		Timestamp: 1600000000123456789,
+		Transactions: []Transaction{
+			{Sender: "alice", Recipient: "bob", Amount: 5, Fee: 1},
+			{Sender: "bob", Outputs: []Output{{Recipient: "carol", Amount: 2}, {Recipient: "dave", Amount: 3}}, Fee: 2, Data: []byte("memo"), LockUntil: 2},
+			{Sender: DefaultCoinbaseSender, Recipient: "miner", Amount: 103},
+		},
+		Proof:        35293,
+		PreviousHash: "7d7b5d5d5f1c2a8e9c3b1f0e6a4d2c8b7e5f3a1d9c7b5e3f1a2c4e6b8d0f2a4c",
+		Difficulty:   4,
+	}
+)
+
+// TestPinnedBlockHashes catches any change to the hashed encoding of blocks,
+// which would make nodes running different versions disagree on every hash.
+// Don't update the pinned hashes unless breaking consensus is intended.
+func TestPinnedBlockHashes(t *testing.T) {
+	bc := newTestBlockchain(t)
+	signed := pinnedBlock
+	signed.MinerPubKey = bytes.Repeat([]byte{1}, 32)
+	signed.MinerSignature = bytes.Repeat([]byte{2}, 64)
+	versioned := pinnedBlock
+	versioned.Version = 2
+	versioned.MerkleRoot = MerkleRoot(versioned.Transactions)
+	versionedSigned := versioned
+	versionedSigned.MinerPubKey, versionedSigned.MinerSignature = signed.MinerPubKey, signed.MinerSignature
+	for _, tc := range []struct {
+		name  string
+		block Block
+		want  string
+	}{
+		{"genesis", pinnedGenesis, "e908bbe6f1f1ca2f8e092ea3be579affbb1975f3a990c17aa4faacc78921cec8"},
+		{"sample", pinnedBlock, "b9561cd825ea5caf8336a5f48a62446ff1a642aa737049e5e0964695dc9b9c53"},
+		{"signed", signed, "7e38be33ac491afd30647af48264466b89768f7f0a11ff4f8153bda6f2b4ef86"},
+		{"version 2", versioned, "acae98e7aeb4e24d33e8c494766929f5483250452bff933dcf5e4e46838de892"},
+		{"signed version 2", versionedSigned, "f22c0247e71d82552146b249f05eee455c59788e83ae0d72e38e0a7be5ba3bd9"},
+	} {
+		if got := bc.BlockHash(tc.block); got != tc.want {
+			t.Errorf("hash of the %s block is %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// A block sent to a peer as JSON must hash the same there.
+func TestBlockHashSurvivesJSON(t *testing.T) {
+	bc := newTestBlockchain(t)
+	data, err := json.Marshal(pinnedBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Block
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bc.BlockHash(decoded), bc.BlockHash(pinnedBlock); got != want {
+		t.Errorf("hash after a JSON round trip is %s, want %s", got, want)
+	}
+}
+
+func TestValidChainFrom(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 3, miner)
+	if _, err := source.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 2}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, source, 2, miner)
+	chain := source.Chain()
+	tampered := append([]Block(nil), chain...)
+	tampered[2].Proof++
+	unlinked := append([]Block(nil), chain...)
+	unlinked[4].PreviousHash = unlinked[3].PreviousHash
+
+	bc := newTestBlockchain(t)
+	// From 0 nothing is trusted, like ValidateChain.
+	for _, c := range [][]Block{chain, tampered, unlinked} {
+		if got, want := bc.ValidChainFrom(c, 0), bc.ValidateChain(c) == nil; got != want {
+			t.Errorf("ValidChainFrom(chain, 0) is %v but ValidateChain succeeding is %v", got, want)
+		}
+	}
+	// Trusted blocks aren't checked, but the first untrusted one must follow
+	// them.
+	if !bc.ValidChainFrom(tampered, 4) {
+		t.Error("tampered trusted block checked")
+	}
+	if bc.ValidChainFrom(unlinked, 4) {
+		t.Error("block that doesn't follow the trusted ones accepted")
+	}
+	for _, start := range []int{-1, len(chain) + 1} {
+		if bc.ValidChainFrom(chain, start) {
+			t.Errorf("start index %d accepted", start)
+		}
+	}
+}
+
+func TestValidChainFromTrustedPrefix(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 3, miner)
+	if _, err := source.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 2}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, source, 1, miner)
+	chain := source.Chain()
+	full, err := source.validChain(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := newTestBlockchain(t)
+	prefix := &trustedPrefix{hashes: full[:4], balances: map[string]int64{miner: 3}}
+	hashes, err := bc.validChainFrom(chain, 4, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hashes, full) {
+		t.Errorf("hashes are %q, want %q", hashes, full)
+	}
+	if prefix.balances[miner] != 3 {
+		t.Error("balances of the trusted prefix changed")
+	}
+
+	// The balances come from the prefix, not from replaying its blocks.
+	broke := &trustedPrefix{hashes: full[:4], balances: map[string]int64{}}
+	if _, err := bc.validChainFrom(chain, 4, broke); err == nil || !strings.Contains(err.Error(), ErrInsufficientFunds.Error()) {
+		t.Errorf("spending coins the prefix doesn't have returned %v", err)
+	}
+	// The hashes too: a block must follow the trusted hash of its parent.
+	forked := &trustedPrefix{hashes: append(append([]string(nil), full[:3]...), "other"), balances: prefix.balances}
+	if _, err := bc.validChainFrom(chain, 4, forked); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("block following another trusted hash returned %v", err)
+	}
+	if _, err := bc.validChainFrom(chain, 4, &trustedPrefix{hashes: full[:3]}); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("prefix without a hash for every trusted block returned %v", err)
+	}
+}
+
+func TestWithHasher(t *testing.T) {
+	var calls int
+	hasher := func(data []byte) string {
+		calls++
+		sum := sha512.Sum512(data)
+		return hex.EncodeToString(sum[:])
+	}
+	bc := newTestBlockchain(t, WithHasher(hasher))
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	if calls == 0 {
+		t.Fatal("hasher never called")
+	}
+	hash := bc.BlockHash(bc.LastBlock())
+	if len(hash) != sha512.Size*2 {
+		t.Errorf("block hash %s isn't a SHA-512 one", hash)
+	}
+	if err := bc.ValidateLocalChain(); err != nil {
+		t.Fatal(err)
+	}
+	// Nodes hashing differently don't agree on the chain.
+	if err := newTestBlockchain(t).ValidateChain(bc.Chain()); err == nil {
+		t.Error("chain hashed with SHA-512 valid with SHA-256")
+	}
+}
+
+func TestBlockHashCoversConsensusFields(t *testing.T) {
+	bc := newTestBlockchain(t)
+	base := bc.BlockHash(pinnedBlock)
+	for name, change := range map[string]func(b *Block){
+		"index":         func(b *Block) { b.Index++ },
+		"timestamp":     func(b *Block) { b.Timestamp++ },
+		"proof":         func(b *Block) { b.Proof++ },
+		"previous hash": func(b *Block) { b.PreviousHash = "other" },
+		"difficulty":    func(b *Block) { b.Difficulty++ },
+		"amount":        func(b *Block) { b.Transactions[0].Amount++ },
+		"transactions":  func(b *Block) { b.Transactions = b.Transactions[1:] },
+	} {
+		block := pinnedBlock
+		block.Transactions = append([]Transaction(nil), pinnedBlock.Transactions...)
+		change(&block)
+		if bc.BlockHash(block) == base {
+			t.Errorf("changing the %s keeps the hash", name)
+		}
+	}
+
+	// The hash listed with a block by /chain isn't part of what is hashed.
+	data, err := json.Marshal(HashedBlock{Block: pinnedBlock, Hash: "listed hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed Block
+	if err := json.Unmarshal(data, &listed); err != nil {
+		t.Fatal(err)
+	}
+	if got := bc.BlockHash(listed); got != base {
+		t.Errorf("block listed with its hash hashes to %s, want %s", got, base)
+	}
+}
+
+func TestStats(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	if _, err := bc.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	bc.RegisterNode("http://10.0.0.1:5000")
+
+	want := ChainStats{
+		Height:            3,
+		TotalTransactions: 2, // the rewards of the mined blocks
+		TotalSupply:       2,
+		Difficulty:        1,
+		MempoolSize:       1,
+		Peers:             1,
+		LatestBlockTime:   bc.LastBlock().Timestamp,
+	}
+	if got := bc.Stats(); got != want {
+		t.Errorf("stats are %+v, want %+v", got, want)
+	}
+
+	var got ChainStats
+	decodeBody(t, serve(NewHandler(bc, testAddress("node")), http.MethodGet, "/stats", "", nil), &got)
+	if got != want {
+		t.Errorf("/stats answered %+v, want %+v", got, want)
+	}
+}
+
+func TestVerifyProof(t *testing.T) {
+	bc := newTestBlockchain(t, WithDifficulty(2))
+	last := bc.LastBlock().Proof
+	proof := bc.ProofOfWork(last)
+	for _, p := range []int64{proof, proof + 1, proof - 1, 0} {
+		if got, want := bc.VerifyProof(last, p), bc.ValidProof(last, p); got != want {
+			t.Errorf("VerifyProof(%d, %d) is %v but ValidProof is %v", last, p, got, want)
+		}
+	}
+	if !bc.VerifyProof(last, proof) {
+		t.Error("proof found by ProofOfWork not verified")
+	}
+}
+
+// reseal makes chain consistent again after its blocks from position from
+// on were changed: their Merkle roots and links are recomputed. Proofs only
+// depend on the previous proof, so they stay valid.
+func reseal(bc *Blockchain, chain []Block, from int) {
+	for i := from; i < len(chain); i++ {
+		chain[i].Transactions = append([]Transaction(nil), chain[i].Transactions...)
+		if chain[i].Version >= 2 {
+			chain[i].MerkleRoot = MerkleRoot(chain[i].Transactions)
+		}
+		if i > 0 {
+			chain[i].PreviousHash = bc.BlockHash(chain[i-1])
+		}
+	}
+}
+
+func TestValidChainChecksTransactions(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 3, miner)
+	if _, err := source.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, source, 1, miner)
+	chain := source.Chain()
+	if err := source.ValidateChain(chain); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func(txs []Transaction)
+		reason string
+	}{
+		{"over-reward mint", func(txs []Transaction) { txs[1].Amount = 100 }, "mints"},
+		{"negative transfer", func(txs []Transaction) { txs[0].Amount = -1 }, "amount must be positive"},
+		{"negative fee", func(txs []Transaction) { txs[0].Fee = -1 }, "fee must not be negative"},
+		{"overspending", func(txs []Transaction) { txs[0].Amount = 50; txs[1].Amount = 1 }, "insufficient funds"},
+		{"minting by a user", func(txs []Transaction) { txs[1].Sender = alice }, "no minting transaction"},
+	} {
+		forged := append([]Block(nil), chain...)
+		forged[4].Transactions = append([]Transaction(nil), chain[4].Transactions...)
+		tc.change(forged[4].Transactions)
+		reseal(source, forged, 4)
+
+		err := newTestBlockchain(t).ValidateChain(forged)
+		var blockErr *BlockError
+		if !errors.As(err, &blockErr) || blockErr.Index != 5 || !strings.Contains(err.Error(), tc.reason) {
+			t.Errorf("%s: chain refused with %v, want block 5 refused for %q", tc.name, err, tc.reason)
+		}
+	}
+}
+
+func TestBlockRewardPolicy(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 3, miner)
+	if _, err := source.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1, Fee: 2}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, source, 1, miner)
+	chain := source.Chain()
+	// The miner of block 5 claims its reward and the fee.
+	if err := newTestBlockchain(t).ValidateChain(chain); err != nil {
+		t.Fatal(err)
+	}
+	if got := source.Balance(miner); got != 3 {
+		t.Errorf("miner owns %d, want 4 rewards and the fee minus the payment of 3", got)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		minted []Transaction
+		reason string
+	}{
+		{"fee claimed twice", []Transaction{{Sender: DefaultCoinbaseSender, Recipient: miner, Amount: 5}}, "mints 5 coins but its reward is 3"},
+		{"fee not claimed", []Transaction{{Sender: DefaultCoinbaseSender, Recipient: miner, Amount: 1}}, "mints 1 coins but its reward is 3"},
+		{"reward split too far", []Transaction{
+			{Sender: DefaultCoinbaseSender, Recipient: miner, Amount: 3},
+			{Sender: DefaultCoinbaseSender, Recipient: alice, Amount: 1},
+		}, "mints 4 coins but its reward is 3"},
+		{"no reward", nil, "no minting transaction"},
+	} {
+		forged := append([]Block(nil), chain...)
+		forged[4].Transactions = append([]Transaction{chain[4].Transactions[0]}, tc.minted...)
+		reseal(source, forged, 4)
+
+		err := newTestBlockchain(t).ValidateChain(forged)
+		var blockErr *BlockError
+		if !errors.As(err, &blockErr) || blockErr.Index != 5 || !strings.Contains(err.Error(), tc.reason) {
+			t.Errorf("%s: chain refused with %v, want block 5 refused for %q", tc.name, err, tc.reason)
+		}
+	}
+
+	// The reward may be split, as long as the total is right.
+	split := append([]Block(nil), chain...)
+	split[4].Transactions = []Transaction{
+		chain[4].Transactions[0],
+		{Sender: DefaultCoinbaseSender, Recipient: miner, Amount: 2},
+		{Sender: DefaultCoinbaseSender, Recipient: alice, Amount: 1},
+	}
+	reseal(source, split, 4)
+	if err := newTestBlockchain(t).ValidateChain(split); err != nil {
+		t.Errorf("split reward: %v", err)
+	}
+}
+
+func TestPerBlockDifficulty(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	bc.SetDifficulty(3)
+	mineBlocks(t, bc, 1, testAddress("miner"))
+	bc.SetDifficulty(2)
+	mineBlocks(t, bc, 1, testAddress("miner"))
+
+	chain := bc.Chain()
+	var difficulties []int
+	for _, block := range chain[1:] {
+		difficulties = append(difficulties, block.Difficulty)
+	}
+	if !reflect.DeepEqual(difficulties, []int{1, 1, 3, 2}) {
+		t.Fatalf("blocks were mined with difficulties %v, want [1 1 3 2]", difficulties)
+	}
+	// Validation uses the difficulty of each block, whatever the current one.
+	for _, difficulty := range []int{1, 4} {
+		if err := newTestBlockchain(t, WithDifficulty(difficulty)).ValidateChain(chain); err != nil {
+			t.Errorf("at difficulty %d: %v", difficulty, err)
+		}
+	}
+
+	// Lowering the difficulty of a block after the fact changes its hash.
+	lowered := append([]Block(nil), chain...)
+	lowered[3].Difficulty = 1
+	if err := bc.ValidateChain(lowered); err == nil {
+		t.Error("chain with a lowered difficulty accepted")
+	}
+}
+
+func TestResolveConflictsKeepsChainWithoutLongerPeer(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, testAddress("local"))
+	same := newTestBlockchain(t)
+	if err := same.Import(bc.Export()); err != nil {
+		t.Fatal(err)
+	}
+	shorter := newTestBlockchain(t)
+	mineBlocks(t, shorter, 1, testAddress("peer"))
+	var downloads []*[]string
+	for _, peer := range []*Blockchain{same, shorter} {
+		srv, queries := recordingPeer(t, peer)
+		bc.RegisterNode(srv.URL)
+		downloads = append(downloads, queries)
+	}
+
+	before := bc.Chain()
+	if bc.ResolveConflicts() {
+		t.Fatal("chain replaced without a longer peer")
+	}
+	// Their heads are enough to tell that their chains aren't longer.
+	for i, queries := range downloads {
+		if len(*queries) != 0 {
+			t.Errorf("chain of peer %d downloaded: %q", i, *queries)
+		}
+	}
+	if !reflect.DeepEqual(bc.Chain(), before) {
+		t.Error("chain changed without a longer peer")
+	}
+	// The chain handed out is a copy.
+	before[1].Proof++
+	if bc.Chain()[1].Proof == before[1].Proof {
+		t.Error("changing the returned chain changed the blockchain")
+	}
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	miner, other, alice := testAddress("miner"), testAddress("other"), testAddress("alice")
+	bc := newTestBlockchain(t, WithCoinbaseMaturity(2))
+	spend := Transaction{Sender: miner, Recipient: alice, Amount: 1}
+
+	mineBlocks(t, bc, 1, miner)
+	if bc.Balance(miner) != 1 || bc.AvailableBalance(miner) != 0 {
+		t.Fatalf("balance %d, available %d, want 1 and 0", bc.Balance(miner), bc.AvailableBalance(miner))
+	}
+	if _, err := bc.NewTransaction(spend); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("spending a fresh reward returned %v", err)
+	}
+	mineBlocks(t, bc, 1, other)
+	if _, err := bc.NewTransaction(spend); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("spending a reward with 1 block on top returned %v", err)
+	}
+	mineBlocks(t, bc, 1, other)
+	if bc.AvailableBalance(miner) != 1 {
+		t.Fatalf("available %d once mature, want 1", bc.AvailableBalance(miner))
+	}
+	if _, err := bc.NewTransaction(spend); err != nil {
+		t.Fatalf("spending a mature reward: %v", err)
+	}
+}
+
+// checkHashCache fails unless the cached hashes of bc are those of its
+// blocks.
+func checkHashCache(t *testing.T, bc *Blockchain) {
+	t.Helper()
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if len(bc.hashes) != len(bc.chain) {
+		t.Fatalf("%d hashes cached for %d blocks", len(bc.hashes), len(bc.chain))
+	}
+	for i, block := range bc.chain {
+		if bc.hashes[i] != bc.computeHashForBlock(block) {
+			t.Errorf("cached hash of block %d is stale", block.Index)
+		}
+	}
+}
+
+func TestHashCache(t *testing.T) {
+	bc := newTestBlockchain(t)
+	checkHashCache(t, bc)
+	mineBlocks(t, bc, 2, testAddress("local"))
+	checkHashCache(t, bc)
+
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 4, testAddress("peer"))
+	srv, _ := recordingPeer(t, peer)
+	bc.RegisterNode(srv.URL)
+	if !bc.ResolveConflicts() {
+		t.Fatal("chain of the peer not adopted")
+	}
+	checkHashCache(t, bc)
+
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 1, testAddress("source"))
+	if err := bc.Import(source.Export()); err != nil {
+		t.Fatal(err)
+	}
+	checkHashCache(t, bc)
+}
+
+// BenchmarkBlockByHash compares looking up a missing block, which goes
+// through every block, among the cached hashes with hashing every block
+// again, as lookups did before the cache.
+func BenchmarkBlockByHash(b *testing.B) {
+	bc := newTestBlockchain(b)
+	mineBlocks(b, bc, 500, testAddress("miner"))
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := bc.GetBlockByHash("missing"); err == nil {
+				b.Fatal("missing block found")
+			}
+		}
+	})
+	b.Run("recomputed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, block := range bc.Chain() {
+				if bc.BlockHash(block) == "missing" {
+					b.Fatal("missing block found")
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkResolveSuffix compares validating a peer chain that extends ours
+// from the cached hashes and state of our blocks with validating all of it.
+func BenchmarkResolveSuffix(b *testing.B) {
+	bc := newTestBlockchain(b)
+	mineBlocks(b, bc, 500, testAddress("miner"))
+	chain := bc.Chain()
+	state := newState(bc.coinbaseSender)
+	for _, block := range chain[:490] {
+		state.apply(block)
+	}
+	bc.mu.RLock()
+	trusted := &trustedPrefix{hashes: append([]string(nil), bc.hashes[:490]...), balances: state.Balances}
+	bc.mu.RUnlock()
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := bc.validChainFrom(chain, 490, trusted); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("full", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := bc.validChain(chain); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestProofOfWorkParallel(t *testing.T) {
+	bc := newTestBlockchain(t, WithDifficulty(3))
+	for lastProof := int64(0); lastProof < 5; lastProof++ {
+		if got, want := bc.ProofOfWorkParallel(lastProof, 1), bc.ProofOfWork(lastProof); got != want {
+			t.Errorf("one worker found %d on top of %d, want %d", got, lastProof, want)
+		}
+		for _, workers := range []int{0, 4} {
+			if proof := bc.ProofOfWorkParallel(lastProof, workers); !bc.ValidProof(lastProof, proof) {
+				t.Errorf("%d workers found invalid proof %d on top of %d", workers, proof, lastProof)
+			}
+		}
+	}
+
+	// No proof can be found, so the workers run until the blockchain closes.
+	bc = NewBlockchain(WithDifficulty(64))
+	done := make(chan int64)
+	go func() { done <- bc.ProofOfWorkParallel(1, 4) }()
+	bc.Close()
+	select {
+	case proof := <-done:
+		if proof != -1 {
+			t.Errorf("closed blockchain found proof %d, want -1", proof)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers kept running after the blockchain closed")
+	}
+}
+
+// BenchmarkProofOfWork compares finding a proof at difficulty 5 alone with
+// finding it with a worker per CPU.
+func BenchmarkProofOfWork(b *testing.B) {
+	bc := newTestBlockchain(b, WithDifficulty(5))
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bc.ProofOfWork(int64(i))
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bc.ProofOfWorkParallel(int64(i), runtime.NumCPU())
+		}
+	})
+}
+
+func TestBelowTarget(t *testing.T) {
+	tests := []struct {
+		hash       string
+		difficulty int
+		want       bool
+	}{
+		{"ff", 0, true},
+		{"7f", 1, true},
+		{"80", 1, false},
+		{"0f", 4, true},
+		{"10", 4, false},
+		{"00", 8, true},
+		{"00", 9, false},
+		{"zz", 0, false},
+	}
+	for _, tt := range tests {
+		if got := belowTarget(tt.hash, tt.difficulty); got != tt.want {
+			t.Errorf("belowTarget(%q, %d) = %v, want %v", tt.hash, tt.difficulty, got, tt.want)
+		}
+	}
+}
+
+func TestProofTarget(t *testing.T) {
+	bc := newTestBlockchain(t, WithProofMode(ProofTarget), WithDifficulty(6))
+	mineBlocks(t, bc, 3, testAddress("miner"))
+	if err := bc.ValidateChain(bc.Chain()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Six bits are less work than six hex digits, so a chain mined in one
+	// mode doesn't pass in the other.
+	prefix := newTestBlockchain(t, WithDifficulty(6))
+	if err := prefix.ValidateChain(bc.Chain()); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("chain mined for 6 bits checked for 6 digits: %v, want ErrInvalidChain", err)
+	}
+	if got := bc.EstimateMining(6, time.Millisecond).ExpectedHashes; got != 64 {
+		t.Errorf("expected hashes for 6 bits: %v, want 64", got)
+	}
+}
+
+func TestMaxTxPerBlock(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 3, miner)
+	for i := 0; i < 3; i++ {
+		if _, err := source.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mineBlocks(t, source, 1, miner)
+	chain := source.Chain()
+
+	// The reward doesn't count against the limit.
+	if err := newTestBlockchain(t, WithMaxTxPerBlock(3)).ValidateChain(chain); err != nil {
+		t.Errorf("block of 3 transactions with a limit of 3: %v", err)
+	}
+	err := newTestBlockchain(t, WithMaxTxPerBlock(2)).ValidateChain(chain)
+	var blockErr *BlockError
+	if !errors.As(err, &blockErr) || blockErr.Index != 5 || !strings.Contains(err.Error(), "at most 2") {
+		t.Errorf("block of 3 transactions with a limit of 2: %v, want block 5 refused", err)
+	}
+
+	// Mining with a limit leaves the rest in the mempool for the next block.
+	bc := newTestBlockchain(t, WithMaxTxPerBlock(2))
+	mineBlocks(t, bc, 3, miner)
+	for i := 0; i < 3; i++ {
+		if _, err := bc.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mineBlocks(t, bc, 1, miner)
+	if got := len(bc.LastBlock().Transactions); got != 3 {
+		t.Errorf("block mined with a limit of 2 holds %d transactions, want 2 and the reward", got)
+	}
+	if got := len(bc.PendingTransactions()); got != 1 {
+		t.Errorf("%d transactions left pending, want 1", got)
+	}
+}
+
+func TestFeeRate(t *testing.T) {
+	miner, alice, other := testAddress("miner"), testAddress("alice"), testAddress("other")
+	bc := newTestBlockchain(t, WithFeeRate(0.5))
+	mineBlocks(t, bc, 12, miner)
+
+	for _, tx := range []Transaction{
+		{Sender: miner, Recipient: alice, Amount: 2, Fee: 1},
+		{Sender: miner, Recipient: alice, Amount: 5},
+		{Sender: miner, Recipient: alice, Amount: 1},
+	} {
+		if _, err := bc.NewTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An explicit fee is kept, the others are half the amount rounded down.
+	var fees []int64
+	for _, tx := range bc.PendingTransactions() {
+		fees = append(fees, tx.Fee)
+	}
+	if want := []int64{1, 2, 0}; !reflect.DeepEqual(fees, want) {
+		t.Fatalf("fees are %v, want %v", fees, want)
+	}
+
+	before := bc.Balance(miner)
+	mineBlocks(t, bc, 1, other)
+	if got, want := bc.Balance(miner), before-8-3; got != want {
+		t.Errorf("balance of the sender is %d, want %d", got, want)
+	}
+	if got := bc.Balance(other); got != 1+3 {
+		t.Errorf("the miner earned %d, want the reward and 3 in fees", got)
+	}
+	// The fees are part of the transactions, so a node without the rate
+	// accepts the chain.
+	if err := newTestBlockchain(t).ValidateChain(bc.Chain()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChainIsACopy(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	tx := Transaction{Sender: miner, Outputs: []Output{
+		{Recipient: testAddress("alice"), Amount: 1},
+		{Recipient: testAddress("bob"), Amount: 1},
+	}}
+	if _, err := bc.NewTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, miner)
+	if got := bc.Len(); got != 4 {
+		t.Fatalf("Len is %d, want 4", got)
+	}
+
+	chain := bc.Chain()
+	want := bc.Chain()
+	chain[3].Transactions[0].Amount = 100
+	chain[3].Transactions[0].Outputs[0].Amount = 100
+	chain[3].Transactions = append(chain[3].Transactions[:1], tx)
+	chain[1].Proof++
+	if got := bc.Chain(); !reflect.DeepEqual(got, want) {
+		t.Error("changing the returned chain changed the blockchain")
+	}
+
+	var visited []int64
+	bc.ForEachBlock(func(block Block) bool {
+		visited = append(visited, block.Index)
+		return block.Index < 2
+	})
+	if !reflect.DeepEqual(visited, []int64{1, 2}) {
+		t.Errorf("ForEachBlock visited %v, want 1 and 2", visited)
+	}
+}
+
+func TestForEachBlock(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, miner)
+	for _, amount := range []int64{1, 2} {
+		if _, err := bc.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: amount}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mineBlocks(t, bc, 1, miner)
+
+	balances := make(map[string]int64)
+	blocks := 0
+	bc.ForEachBlock(func(block Block) bool {
+		blocks++
+		for _, tx := range block.Transactions {
+			balances[tx.Sender] -= tx.cost()
+			for _, out := range tx.payouts() {
+				balances[out.Recipient] += out.Amount
+			}
+		}
+		return true
+	})
+	if blocks != 5 {
+		t.Errorf("ForEachBlock visited %d blocks, want 5", blocks)
+	}
+	for _, address := range []string{miner, alice} {
+		if got, want := balances[address], bc.Balance(address); got != want {
+			t.Errorf("scanned balance of %s is %d, want %d", address, got, want)
+		}
+	}
+
+	blocks = 0
+	bc.ForEachBlock(func(Block) bool {
+		blocks++
+		return false
+	})
+	if blocks != 1 {
+		t.Errorf("ForEachBlock visited %d blocks after the first returned false", blocks)
+	}
+}
+
+func TestChainWhileMining(t *testing.T) {
+	bc := newTestBlockchain(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if _, err := bc.ForgeBlock(bc.ProofOfWork(bc.LastBlock().Proof), testAddress("miner")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if n := len(bc.Chain()); n != 21 {
+				t.Errorf("chain has %d blocks, want 21", n)
+			}
+			return
+		default:
+		}
+		chain := bc.Chain()
+		if err := bc.ValidateChain(chain); err != nil {
+			t.Fatalf("chain of %d blocks read while mining: %v", len(chain), err)
+		}
+	}
+}
+
+func TestStaleTip(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	if _, err := bc.NewTransaction(Transaction{Sender: miner, Recipient: testAddress("alice"), Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	stale := bc.Chain()[1]
+	tip := bc.LastBlock()
+
+	if _, err := bc.NewBlock(bc.ProofOfWork(tip.Proof), bc.BlockHash(stale)); !errors.Is(err, ErrStaleTip) {
+		t.Errorf("block on top of block 2: %v, want ErrStaleTip", err)
+	}
+	// A proof found for another tip is refused too.
+	proof := int64(0)
+	for bc.ValidProof(tip.Proof, proof) {
+		proof++
+	}
+	if _, err := bc.ForgeBlock(proof, miner); !errors.Is(err, ErrStaleTip) {
+		t.Errorf("proof not valid on top of the tip: %v, want ErrStaleTip", err)
+	}
+	if bc.Len() != 3 || len(bc.PendingTransactions()) != 1 {
+		t.Fatalf("refused blocks left %d blocks and %d pending transactions", bc.Len(), len(bc.PendingTransactions()))
+	}
+
+	block, err := bc.NewBlock(bc.ProofOfWork(tip.Proof), bc.BlockHash(tip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.PreviousHash != bc.BlockHash(tip) || len(block.Transactions) != 1 {
+		t.Errorf("block %+v doesn't follow the tip with the pending transaction", block)
+	}
+}
+
+func TestMaxMempoolSize(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t, WithMaxMempoolSize(2))
+	mineBlocks(t, bc, 8, miner)
+	h := NewHandler(bc, testAddress("node"))
+	pay := func(amount, fee int64) Transaction {
+		return Transaction{Sender: miner, Recipient: alice, Amount: amount, Fee: fee}
+	}
+
+	for _, tx := range []Transaction{pay(1, 1), pay(2, 1)} {
+		if _, err := bc.NewTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bc.NewTransaction(pay(1, 0)); !errors.Is(err, ErrMempoolFull) {
+		t.Errorf("lower fee in a full mempool: %v, want ErrMempoolFull", err)
+	}
+	body := `{"sender": "` + miner + `", "recipient": "` + alice + `", "amount": 1, "fee": 1}`
+	if rec := serve(h, http.MethodPost, "/transactions/new", body, nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("same fee in a full mempool: status %d, want 503", rec.Code)
+	}
+
+	// A higher fee evicts the most recent of the cheapest transactions.
+	if _, err := bc.NewTransaction(pay(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bc.PendingTransactions(), []Transaction{pay(1, 1), pay(1, 2)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pending transactions are %v, want %v", got, want)
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 4, testAddress("miner"))
+	chain := source.Chain()
+	checkpoint := map[int64]string{3: source.BlockHash(chain[2])}
+
+	if err := newTestBlockchain(t, WithCheckpoints(checkpoint)).ValidateChain(chain); err != nil {
+		t.Errorf("chain matching the checkpoint: %v", err)
+	}
+	err := newTestBlockchain(t, WithCheckpoints(map[int64]string{3: "ff"})).ValidateChain(chain)
+	var blockErr *BlockError
+	if !errors.As(err, &blockErr) || blockErr.Index != 3 {
+		t.Errorf("chain not matching the checkpoint: %v, want block 3 refused", err)
+	}
+	// A checkpoint beyond the chain doesn't apply to it.
+	if err := newTestBlockchain(t, WithCheckpoints(map[int64]string{9: "ff"})).ValidateChain(chain); err != nil {
+		t.Errorf("checkpoint beyond the chain: %v", err)
+	}
+
+	// The proofs up to the checkpoint aren't checked.
+	forged := append([]Block(nil), chain...)
+	for source.ValidProof(forged[0].Proof, forged[1].Proof) {
+		forged[1].Proof++
+	}
+	reseal(source, forged, 1)
+	if err := newTestBlockchain(t).ValidateChain(forged); !errors.Is(err, ErrInvalidChain) {
+		t.Fatalf("chain with an invalid proof: %v, want ErrInvalidChain", err)
+	}
+	trusted := map[int64]string{3: source.BlockHash(forged[2])}
+	if err := newTestBlockchain(t, WithCheckpoints(trusted)).ValidateChain(forged); err != nil {
+		t.Errorf("invalid proof below the checkpoint: %v", err)
+	}
+}
+
+func TestTotalWork(t *testing.T) {
+	bc := newTestBlockchain(t)
+	chain := []Block{{Difficulty: 1}, {Difficulty: 2}, {Difficulty: -1}, {Difficulty: 100}}
+	// 16 and 256 hashes per hex digit, none for a negative difficulty, and
+	// no more than the 256 bits of a hash.
+	want := new(big.Int).Lsh(big.NewInt(1), 256)
+	want.Add(want, big.NewInt(16+256+1))
+	if got := bc.TotalWork(chain); got.Cmp(want) != 0 {
+		t.Errorf("total work is %v, want %v", got, want)
+	}
+	bits := newTestBlockchain(t, WithProofMode(ProofTarget))
+	if got := bits.TotalWork(chain[:2]); got.Cmp(big.NewInt(2+4)) != 0 {
+		t.Errorf("total work counting bits is %v, want 6", got)
+	}
+
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	var head struct {
+		Work string `json:"total_work"`
+	}
+	decodeBody(t, serve(NewHandler(bc, testAddress("node")), http.MethodGet, "/chain/head", "", nil), &head)
+	if want := bc.TotalWork(bc.Chain()).String(); head.Work != want {
+		t.Errorf("head reports a total work of %s, want %s", head.Work, want)
+	}
+}
+
+func TestResolveConflictsPrefersWork(t *testing.T) {
+	// The longer chain was mined with less work.
+	long := newTestBlockchain(t)
+	mineBlocks(t, long, 4, testAddress("long"))
+	heavy := newTestBlockchain(t, WithDifficulty(2))
+	mineBlocks(t, heavy, 2, testAddress("heavy"))
+	if heavy.TotalWork(heavy.Chain()).Cmp(long.TotalWork(long.Chain())) <= 0 {
+		t.Fatal("the shorter chain doesn't have more work")
+	}
+
+	bc := newTestBlockchain(t)
+	for _, peer := range []*Blockchain{long, heavy} {
+		srv, _ := recordingPeer(t, peer)
+		bc.RegisterNode(srv.URL)
+	}
+	if !bc.ResolveConflicts() {
+		t.Fatal("no chain adopted")
+	}
+	if !reflect.DeepEqual(bc.Chain(), heavy.Chain()) {
+		t.Errorf("adopted a chain of %d blocks, want the 3 blocks with the most work", bc.Len())
+	}
+}
+
+func TestEmptyChain(t *testing.T) {
+	bc := newTestBlockchain(t)
+	bc.mu.Lock()
+	bc.chain, bc.hashes = nil, nil
+	bc.mu.Unlock()
+
+	if got := bc.LastBlock(); !reflect.DeepEqual(got, Block{}) {
+		t.Errorf("last block of an empty chain is %+v", got)
+	}
+	if got := bc.GenesisHash(); got != "" {
+		t.Errorf("genesis hash of an empty chain is %q", got)
+	}
+	for _, index := range []int64{-1, 0, 1} {
+		if _, err := bc.GetBlockByIndex(index); !errors.Is(err, ErrNotFound) {
+			t.Errorf("block %d: %v, want ErrNotFound", index, err)
+		}
+	}
+	if _, err := bc.GetBlockByHash("ff"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("block by hash: %v, want ErrNotFound", err)
+	}
+	if _, err := bc.ForgeBlock(bc.ProofOfWork(0), testAddress("miner")); !errors.Is(err, ErrEmptyChain) {
+		t.Errorf("forging: %v, want ErrEmptyChain", err)
+	}
+	if err := bc.AcceptBlock(Block{Index: 1}); !errors.Is(err, ErrEmptyChain) {
+		t.Errorf("accepting a block: %v, want ErrEmptyChain", err)
+	}
+	h := NewHandler(bc, testAddress("node"))
+	for _, target := range []string{"/chain", "/chain/head"} {
+		if rec := serve(h, http.MethodGet, target, "", nil); rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d", target, rec.Code)
+		}
+	}
+
+	// NewBlock seeds a new genesis block.
+	block, err := bc.NewBlock(100, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Index != 1 || block.PreviousHash != "1" || bc.Len() != 1 {
+		t.Errorf("block %+v added to an empty chain, want a genesis block", block)
+	}
+	mineBlocks(t, bc, 1, testAddress("miner"))
+}
+
+func TestForgeBlockSplit(t *testing.T) {
+	miner, a, b, c := testAddress("miner"), testAddress("a"), testAddress("b"), testAddress("c")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 10, miner)
+	if _, err := bc.NewTransaction(Transaction{Sender: miner, Recipient: testAddress("alice"), Amount: 1, Fee: 9}); err != nil {
+		t.Fatal(err)
+	}
+	forge := func(split map[string]int) (Block, error) {
+		return bc.ForgeBlockSplit(bc.ProofOfWork(bc.LastBlock().Proof), split)
+	}
+
+	// The reward of 1 and the fee of 9 are split 2:1:1, rounded down, and
+	// what is left goes to the largest weight.
+	block, err := forge(map[string]int{a: 2, b: 1, c: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewards := func(block Block) map[string]int64 {
+		got := make(map[string]int64)
+		for _, tx := range block.Transactions {
+			if tx.Sender == "0" {
+				got[tx.Recipient] += tx.Amount
+			}
+		}
+		return got
+	}
+	if got, want := rewards(block), map[string]int64{a: 6, b: 2, c: 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rewards are %v, want %v", got, want)
+	}
+
+	// Shares that round down to nothing get no transaction. Between equal
+	// weights, the smallest address gets what is left.
+	block, err = forge(map[string]int{a: 1, b: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := a
+	if b < a {
+		first = b
+	}
+	if got, want := rewards(block), map[string]int64{first: 1}; len(block.Transactions) != 1 || !reflect.DeepEqual(got, want) {
+		t.Errorf("reward of 1 split in two: %v, want %v", block.Transactions, want)
+	}
+	if err := newTestBlockchain(t).ValidateChain(bc.Chain()); err != nil {
+		t.Error(err)
+	}
+
+	for _, split := range []map[string]int{nil, {a: 0}, {a: 1, b: -1}} {
+		if _, err := forge(split); err == nil {
+			t.Errorf("split %v accepted", split)
+		}
+	}
+}
+
+func TestProofInput(t *testing.T) {
+	// Decimal digits run together would read "123" for both pairs.
+	if bytes.Equal(proofInput(12, 3), proofInput(1, 23)) {
+		t.Error("proofs 12 then 3 hash like 1 then 23")
+	}
+	want, _ := hex.DecodeString("000000000000000cfffffffffffffffd")
+	if got := proofInput(12, -3); !bytes.Equal(got, want) {
+		t.Errorf("input of 12 then -3 is %x, want %x", got, want)
+	}
+}
+
+func TestValidProofDifficulty(t *testing.T) {
+	bc := newTestBlockchain(t, WithDifficulty(2))
+	proof := bc.ProofOfWork(42)
+	digest := bc.hasher(proofInput(42, proof))
+	if !strings.HasPrefix(digest, "00") {
+		t.Fatalf("proof %d hashes to %s, without 2 leading zeros", proof, digest)
+	}
+	zeros := len(digest) - len(strings.TrimLeft(digest, "0"))
+	for difficulty := 0; difficulty <= zeros+1; difficulty++ {
+		if got, want := bc.validProof(42, proof, difficulty), difficulty <= zeros; got != want {
+			t.Errorf("proof with %d leading zeros valid for difficulty %d: %v, want %v", zeros, difficulty, got, want)
+		}
+	}
+}
+
+func TestTimestampsIncrease(t *testing.T) {
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 2, testAddress("peer"))
+	// The peer's clock is an hour ahead.
+	snapshot := source.Export()
+	future := time.Now().Add(time.Hour).UnixNano()
+	snapshot.Chain[2].Timestamp = future
+
+	bc := newTestBlockchain(t)
+	if err := bc.Import(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	chain := bc.Chain()
+	if got := chain[3].Timestamp; got != future+1 {
+		t.Errorf("block mined after a block from the future has timestamp %d, want %d", got, future+1)
+	}
+	for i := 1; i < len(chain); i++ {
+		if chain[i].Timestamp <= chain[i-1].Timestamp {
+			t.Errorf("block %d isn't later than block %d", i+1, i)
+		}
+	}
+}
+
+func TestCoinbaseSender(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t, WithCoinbaseSender("mint"))
+	mineBlocks(t, bc, 2, miner)
+	for _, block := range bc.Chain()[1:] {
+		if len(block.Transactions) != 1 || block.Transactions[0].Sender != "mint" {
+			t.Fatalf("block %d rewards with %v, want a transaction from mint", block.Index, block.Transactions)
+		}
+	}
+	if got := bc.Balance(miner); got != 2 {
+		t.Errorf("miner owns %d, want 2", got)
+	}
+	if got := bc.RichList(10); !reflect.DeepEqual(got, []AddressBalance{{miner, 2}}) {
+		t.Errorf("rich list is %v, want only the miner", got)
+	}
+
+	// Only blocks mint coins, and the coins can't be sent to the minting
+	// sender.
+	for _, tx := range []Transaction{
+		{Sender: "mint", Recipient: alice, Amount: 1},
+		{Sender: miner, Recipient: "mint", Amount: 1},
+	} {
+		if _, err := bc.NewTransaction(tx); !errors.Is(err, ErrInvalidTransaction) {
+			t.Errorf("%s to %s: %v, want ErrInvalidTransaction", tx.Sender, tx.Recipient, err)
+		}
+	}
+
+	// The networks don't accept each other's rewards.
+	other := newTestBlockchain(t)
+	mineBlocks(t, other, 2, miner)
+	if err := bc.ValidateChain(other.Chain()); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("chain minting from %q: %v, want ErrInvalidChain", DefaultCoinbaseSender, err)
+	}
+	if err := other.ValidateChain(bc.Chain()); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("chain minting from mint: %v, want ErrInvalidChain", err)
+	}
+}
+
+func TestBurning(t *testing.T) {
+	miner := testAddress("miner")
+	burn := Transaction{Sender: miner, Recipient: DefaultCoinbaseSender, Amount: 2}
+
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, miner)
+	if _, err := bc.NewTransaction(burn); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("burning by default: %v, want ErrInvalidTransaction", err)
+	}
+	// Nor may a payment to several recipients burn some of the coins.
+	split := Transaction{Sender: miner, Outputs: []Output{{Recipient: testAddress("alice"), Amount: 1}, {Recipient: DefaultCoinbaseSender, Amount: 1}}}
+	if _, err := bc.NewTransaction(split); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("burning an output by default: %v, want ErrInvalidTransaction", err)
+	}
+
+	bc = newTestBlockchain(t, WithBurning())
+	mineBlocks(t, bc, 3, miner)
+	if got := bc.TotalSupply(); got != 3 {
+		t.Fatalf("supply is %d before burning, want 3", got)
+	}
+	if _, err := bc.NewTransaction(burn); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, miner)
+	// The block mints 1 and 2 go out of circulation.
+	if got := bc.TotalSupply(); got != 2 {
+		t.Errorf("supply is %d after burning 2, want 2", got)
+	}
+	if got := bc.Balance(miner); got != 2 {
+		t.Errorf("miner owns %d, want 2", got)
+	}
+	if got := bc.RichList(10); !reflect.DeepEqual(got, []AddressBalance{{miner, 2}}) {
+		t.Errorf("rich list is %v, want only the miner", got)
+	}
+	if err := newTestBlockchain(t, WithBurning()).ValidateChain(bc.Chain()); err != nil {
+		t.Errorf("chain with a burn: %v", err)
+	}
+}
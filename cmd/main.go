@@ -1,23 +1,278 @@
 package main
 
 import (
+    "context"
+    "crypto/ed25519"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
     "flag"
     "fmt"
     "gochain"
     "log"
     "net/http"
+    "os"
+    "os/signal"
+    "strconv"
     "strings"
+    "time"
 )
 
 func main() {
     serverPort := flag.String("port", "8000", "http port number where server will run")
+    txRate := flag.Float64("tx-rate", 0, "transactions per second a single client may submit (0 disables rate limiting)")
+    txBurst := flag.Int("tx-burst", 10, "number of transactions a single client may submit in a burst")
+    difficulty := flag.Int("difficulty", 6, "number of leading zeroes a proof hash needs")
+    targetMode := flag.Bool("target-proof", false, "count the difficulty in leading zero bits of the proof hash instead of hex digits")
+    apiKey := flag.String("api-key", "", "bearer token required by the endpoints that modify the node (empty disables authentication)")
+    pruneInterval := flag.Duration("prune-interval", 0, "how often to health check peers and drop dead ones (0 disables pruning)")
+    skipResolve := flag.Bool("no-resolve-before-mining", false, "start mining without resolving conflicts with the peers first (use with -resolve-interval)")
+    peerSample := flag.Int("peer-sample", 0, "number of random peers asked per consensus round (0 asks all of them)")
+    peerResponseLimit := flag.Int64("peer-response-limit", gochain.DefaultPeerResponseLimit, "maximum number of bytes read from a single peer answer")
+    noBinarySync := flag.Bool("no-binary-sync", false, "download the chains of the peers in JSON only, without decoding gob from them")
+    peerCacheTTL := flag.Duration("peer-cache-ttl", 0, "how long to reuse what the peers answered in consecutive consensus rounds (0 disables caching)")
+    resolveInterval := flag.Duration("resolve-interval", 0, "how often to resolve conflicts with the peers in the background (0 disables it)")
+    feeRate := flag.Float64("fee-rate", 0, "fee paid by transactions without an explicit fee, as a fraction of the amount sent (e.g. 0.01 for 1%)")
+    maxTxData := flag.Int("max-tx-data", 256, "maximum number of bytes of data a transaction may carry")
+    maxMempool := flag.Int("max-mempool", 0, "maximum number of pending transactions (0 means no limit)")
+    mempoolPolicy := flag.String("mempool-policy", "fifo", "order in which pending transactions are mined: fifo, fee (highest fee first) or oldest (first received first)")
+    maxBlockTxs := flag.Int("max-block-txs", 0, "maximum number of transactions in a block, not counting the mining reward (0 means no limit)")
+    coinbaseSender := flag.String("coinbase-sender", gochain.DefaultCoinbaseSender, "sender of the transactions minting the mining rewards, the same for all nodes of a network")
+    allowBurn := flag.Bool("allow-burn", false, "accept transactions sending coins to the coinbase sender, which burns them")
+    rewardAddress := flag.String("reward-address", "", "address the mining rewards are paid to, which is also the node id (a random address by default)")
+    rewardSplit := flag.String("reward-split", "", "comma separated address:weight pairs to split the mining rewards among, instead of paying them to the node id")
+    listenOnly := flag.Bool("listen-only", false, "serve the chain and relay transactions without ever mining")
+    webhookConfirmations := flag.Int64("webhook-confirmations", 1, "number of blocks, counting its own, that must confirm a transaction before its webhooks fire")
+    checkpoints := flag.String("checkpoints", "", "comma separated index:hash pairs the blocks of peer chains must match")
+    readTimeout := flag.Duration("read-timeout", 0, "how long reading a request may take (0 means no limit)")
+    writeTimeout := flag.Duration("write-timeout", 0, "how long handling a request and writing its response may take (0 means no limit)")
+    idleTimeout := flag.Duration("idle-timeout", 0, "how long an idle keep-alive connection stays open (0 means no limit)")
+    mineTimeout := flag.Duration("mine-timeout", 0, "how long a synchronous /mine request may search for a proof before answering 503 (0 means no limit)")
+    tlsCert := flag.String("tls-cert", "", "PEM certificate to serve HTTPS with, together with -tls-key")
+    tlsKey := flag.String("tls-key", "", "PEM private key of the -tls-cert certificate")
+    minerKey := flag.String("miner-key", "", "file holding the hex encoded 32 byte ed25519 seed to sign the mined blocks with (empty disables signing)")
+    peerCA := flag.String("peer-ca", "", "PEM certificates to trust, in addition to the system ones, when talking to peers over HTTPS")
+    networkSecret := flag.String("network-secret", "", "secret shared by the nodes of the network to sign the requests they send each other (empty disables signing)")
+    gossip := flag.Bool("gossip", false, "forward the transactions submitted to this node to its registered nodes")
+    advertiseAddress := flag.String("advertise-address", "", "address the node is reachable at, e.g. http://127.0.0.1:8000, which is never registered as a peer")
+    peersFile := flag.String("peers-file", "", "file listing the nodes to register at startup, one per line or as a JSON array")
     flag.Parse()
 
-    blockchain := gochain.NewBlockchain()
-    nodeID := strings.Replace(gochain.PseudoUUID(), "-", "", -1)
+    var opts []gochain.HandlerOption
+    if *apiKey != "" {
+        opts = append(opts, gochain.WithAPIKey(*apiKey))
+    }
+    if *pruneInterval > 0 {
+        opts = append(opts, gochain.WithPeerPruning(*pruneInterval))
+    }
+    if *resolveInterval > 0 {
+        opts = append(opts, gochain.WithAutoResolve(*resolveInterval))
+    }
+    if *rewardSplit != "" {
+        split, err := parseRewardSplit(*rewardSplit)
+        if err != nil {
+            log.Fatalf("invalid reward split: %v", err)
+        }
+        opts = append(opts, gochain.WithRewardSplit(split))
+    }
+    if *skipResolve {
+        opts = append(opts, gochain.WithoutResolveBeforeMining())
+    }
+    if *listenOnly {
+        opts = append(opts, gochain.WithoutMining())
+    }
+    if *advertiseAddress != "" {
+        opts = append(opts, gochain.WithAdvertisedAddress(*advertiseAddress))
+    }
+    if *txRate > 0 {
+        opts = append(opts, gochain.WithRateLimit(*txRate, *txBurst))
+    }
+    if *mineTimeout > 0 {
+        opts = append(opts, gochain.WithMineTimeout(*mineTimeout))
+    }
+
+    chainOpts := []gochain.BlockchainOption{
+        gochain.WithDifficulty(*difficulty),
+        gochain.WithMaxTxPerBlock(*maxBlockTxs),
+        gochain.WithPeerSample(*peerSample),
+        gochain.WithPeerCache(*peerCacheTTL),
+        gochain.WithFeeRate(*feeRate),
+        gochain.WithMaxTxData(*maxTxData),
+        gochain.WithMaxMempoolSize(*maxMempool),
+        gochain.WithWebhookConfirmations(*webhookConfirmations),
+        gochain.WithCoinbaseSender(*coinbaseSender),
+        gochain.WithPeerResponseLimit(*peerResponseLimit),
+    }
+    if *noBinarySync {
+        chainOpts = append(chainOpts, gochain.WithoutBinarySync())
+    }
+    switch *mempoolPolicy {
+    case "fifo":
+    case "fee":
+        chainOpts = append(chainOpts, gochain.WithMempoolPolicy(gochain.MempoolHighestFee))
+    case "oldest":
+        chainOpts = append(chainOpts, gochain.WithMempoolPolicy(gochain.MempoolOldestFirst))
+    default:
+        log.Fatalf("invalid mempool policy %q, must be fifo, fee or oldest", *mempoolPolicy)
+    }
+    if *checkpoints != "" {
+        parsed, err := parseCheckpoints(*checkpoints)
+        if err != nil {
+            log.Fatalf("invalid checkpoints: %v", err)
+        }
+        chainOpts = append(chainOpts, gochain.WithCheckpoints(parsed))
+    }
+    if *peerCA != "" {
+        client, err := httpClientTrusting(*peerCA)
+        if err != nil {
+            log.Fatalf("could not load peer certificates: %v", err)
+        }
+        chainOpts = append(chainOpts, gochain.WithHTTPClient(client))
+    }
+    if *minerKey != "" {
+        key, err := readMinerKey(*minerKey)
+        if err != nil {
+            log.Fatalf("could not load miner key: %v", err)
+        }
+        chainOpts = append(chainOpts, gochain.WithMinerKey(key))
+    }
+    if *networkSecret != "" {
+        chainOpts = append(chainOpts, gochain.WithNetworkSecret(*networkSecret))
+    }
+    if *allowBurn {
+        chainOpts = append(chainOpts, gochain.WithBurning())
+    }
+    if *gossip {
+        chainOpts = append(chainOpts, gochain.WithTxGossip())
+    }
+    if *targetMode {
+        chainOpts = append(chainOpts, gochain.WithProofMode(gochain.ProofTarget))
+    }
+    blockchain := gochain.NewBlockchain(chainOpts...)
+    if *peersFile != "" {
+        added, err := blockchain.RegisterNodesFromFile(*peersFile)
+        if err != nil {
+            log.Fatalf("could not read peers file: %v", err)
+        }
+        log.Printf("Registered %d nodes from %s", added, *peersFile)
+    }
+    // The node's mining rewards are paid to its id, so it must be an address.
+    nodeID := *rewardAddress
+    if nodeID == "" {
+        pkh := sha256.Sum256([]byte(gochain.PseudoUUID()))
+        nodeID = string(gochain.NewAddress(pkh[:20]))
+    } else if err := gochain.ValidateAddress(nodeID); err != nil {
+        log.Fatalf("invalid reward address: %v", err)
+    }
 
     log.Printf("Starting gochain HTTP Server. Listening at port %q", *serverPort)
 
-    http.Handle("/", gochain.NewHandler(blockchain, nodeID))
-    http.ListenAndServe(fmt.Sprintf(":%s", *serverPort), nil)
+    server := gochain.NewServer(
+        gochain.NewHandler(blockchain, nodeID, opts...),
+        gochain.WithReadTimeout(*readTimeout),
+        gochain.WithWriteTimeout(*writeTimeout),
+        gochain.WithIdleTimeout(*idleTimeout),
+    )
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        interrupt := make(chan os.Signal, 1)
+        signal.Notify(interrupt, os.Interrupt)
+        <-interrupt
+
+        log.Println("Shutting down gochain HTTP Server")
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        if err := server.Shutdown(ctx); err != nil {
+            log.Printf("could not shut down gracefully: %v", err)
+        }
+        blockchain.Close()
+    }()
+
+    addr := fmt.Sprintf(":%s", *serverPort)
+    var err error
+    if *tlsCert != "" || *tlsKey != "" {
+        err = server.StartTLS(addr, *tlsCert, *tlsKey)
+    } else {
+        err = server.Start(addr)
+    }
+    if err != nil {
+        log.Fatal(err)
+    }
+    <-stopped
+}
+
+// parseCheckpoints reads checkpoints written as "index:hash,index:hash".
+func parseCheckpoints(s string) (map[int64]string, error) {
+    checkpoints := make(map[int64]string)
+    for _, pair := range strings.Split(s, ",") {
+        parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("%q is not index:hash", pair)
+        }
+        index, err := strconv.ParseInt(parts[0], 10, 64)
+        if err != nil || index < 1 {
+            return nil, fmt.Errorf("%q has an invalid index", pair)
+        }
+        checkpoints[index] = parts[1]
+    }
+    return checkpoints, nil
+}
+
+// parseRewardSplit reads a reward split written as
+// "address:weight,address:weight".
+func parseRewardSplit(s string) (map[string]int, error) {
+    split := make(map[string]int)
+    for _, pair := range strings.Split(s, ",") {
+        parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("%q is not address:weight", pair)
+        }
+        if err := gochain.ValidateAddress(parts[0]); err != nil {
+            return nil, err
+        }
+        weight, err := strconv.Atoi(parts[1])
+        if err != nil || weight < 1 {
+            return nil, fmt.Errorf("%q has an invalid weight", pair)
+        }
+        split[parts[0]] = weight
+    }
+    return split, nil
+}
+
+// readMinerKey reads an ed25519 private key from a file holding its seed,
+// hex encoded.
+func readMinerKey(path string) (ed25519.PrivateKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil {
+        return nil, fmt.Errorf("%s is not hex encoded: %v", path, err)
+    }
+    if len(seed) != ed25519.SeedSize {
+        return nil, fmt.Errorf("%s holds %d bytes instead of %d", path, len(seed), ed25519.SeedSize)
+    }
+    return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// httpClientTrusting returns a client that trusts the certificates in the PEM
+// file caFile as well as the system ones.
+func httpClientTrusting(caFile string) (*http.Client, error) {
+    pem, err := os.ReadFile(caFile)
+    if err != nil {
+        return nil, err
+    }
+    pool, err := x509.SystemCertPool()
+    if err != nil {
+        pool = x509.NewCertPool()
+    }
+    if !pool.AppendCertsFromPEM(pem) {
+        return nil, fmt.Errorf("no certificate found in %s", caFile)
+    }
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+    return &http.Client{Transport: transport, Timeout: gochain.DefaultPeerTimeout}, nil
 }
@@ -0,0 +1,66 @@
+package gochain
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Errors returned by the blockchain and the handler. They are wrapped with
+// more details, so compare them with errors.Is.
+var (
+	ErrInvalidTransaction  = errors.New("invalid transaction")
+	ErrInsufficientFunds   = errors.New("insufficient funds")
+	ErrInvalidChain        = errors.New("invalid chain")
+	ErrInvalidAddress      = errors.New("invalid address")
+	ErrMethodNotAllowed    = errors.New("method not allowed")
+	ErrNotFound            = errors.New("not found")
+	ErrMiningDisabled      = errors.New("mining is disabled on this node")
+	ErrClosed              = errors.New("blockchain closed")
+	ErrStaleTip            = errors.New("chain tip changed")
+	ErrMempoolFull         = errors.New("mempool full")
+	ErrEmptyChain          = errors.New("chain has no blocks")
+	ErrUnsupportedSnapshot = errors.New("unsupported snapshot version")
+	ErrKnownBlock          = errors.New("block already in the chain")
+	ErrRejectedBlock       = errors.New("block already rejected")
+	ErrInvalidNode         = errors.New("invalid node address")
+	ErrSelfNode            = errors.New("node address is this node")
+)
+
+// statusFor returns the HTTP status for err, or fallback if err isn't one
+// of the package errors.
+func statusFor(err error, fallback int) int {
+	switch {
+	case isBodyTooLarge(err):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrInvalidTransaction),
+		errors.Is(err, ErrInsufficientFunds),
+		errors.Is(err, ErrInvalidChain),
+		errors.Is(err, ErrInvalidAddress),
+		errors.Is(err, ErrInvalidNode),
+		errors.Is(err, ErrSelfNode),
+		errors.Is(err, ErrUnsupportedSnapshot):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrStaleTip),
+		errors.Is(err, ErrRejectedBlock):
+		return http.StatusConflict
+	case errors.Is(err, ErrMempoolFull),
+		errors.Is(err, ErrEmptyChain):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrMiningDisabled):
+		return http.StatusForbidden
+	}
+	return fallback
+}
+
+// isBodyTooLarge reports whether err comes from reading a request body over
+// the limit set by limitBody. http.MaxBytesReader has no error type to check
+// for before Go 1.19, and the handlers don't always wrap the decoding errors,
+// so compare the message.
+func isBodyTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "http: request body too large")
+}
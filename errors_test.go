@@ -0,0 +1,61 @@
+package gochain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestStatusFor(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{ErrInvalidTransaction, http.StatusBadRequest},
+		{ErrInsufficientFunds, http.StatusBadRequest},
+		{ErrInvalidChain, http.StatusBadRequest},
+		{ErrInvalidAddress, http.StatusBadRequest},
+		{ErrUnsupportedSnapshot, http.StatusBadRequest},
+		{ErrInvalidNode, http.StatusBadRequest},
+		{ErrSelfNode, http.StatusBadRequest},
+		{ErrMethodNotAllowed, http.StatusMethodNotAllowed},
+		{ErrNotFound, http.StatusNotFound},
+		{ErrStaleTip, http.StatusConflict},
+		{ErrRejectedBlock, http.StatusConflict},
+		{ErrMempoolFull, http.StatusServiceUnavailable},
+		{ErrEmptyChain, http.StatusServiceUnavailable},
+		{ErrMiningDisabled, http.StatusForbidden},
+		{errors.New("http: request body too large"), http.StatusRequestEntityTooLarge},
+		{errors.New("something else"), http.StatusTeapot},
+	} {
+		// The errors are mapped however deeply they are wrapped.
+		wrapped := fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", tc.err))
+		if got := statusFor(wrapped, http.StatusTeapot); got != tc.want {
+			t.Errorf("%v: status %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestWrappedErrors(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 1, miner)
+
+	_, err := bc.NewTransaction(Transaction{Sender: miner, Recipient: testAddress("alice"), Amount: 5})
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("overspending returned %v, want ErrInsufficientFunds", err)
+	}
+	_, err = bc.NewTransaction(Transaction{Sender: miner, Recipient: "nobody", Amount: 1})
+	if !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("invalid recipient returned %v, want ErrInvalidTransaction", err)
+	}
+	if err := bc.ValidateChain(nil); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("empty chain returned %v, want ErrInvalidChain", err)
+	}
+	bc.Close()
+	if _, err := bc.ProofOfWorkContext(context.Background(), bc.LastBlock().Proof); !errors.Is(err, ErrClosed) {
+		t.Errorf("mining on a closed blockchain returned %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,199 @@
+package gochain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// relayedHeader marks the transactions a node forwards to its peers. They
+// are accepted like any other transaction but not forwarded again, so that a
+// transaction doesn't bounce between nodes forever.
+const relayedHeader = "X-Gochain-Relayed"
+
+// WithTxGossip makes the node forward the transactions it accepts to its
+// registered nodes, so that they get mined whichever node mines next. Only
+// transactions submitted to the node directly are forwarded.
+func WithTxGossip() BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.gossipTxs = true
+	}
+}
+
+// WithNetworkSecret makes the node sign the transactions and blocks it sends
+// to the other nodes with secret, and require the same of theirs, so that
+// hosts outside of the network can't announce blocks or register nodes. All
+// nodes of a network must share the secret.
+func WithNetworkSecret(secret string) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.networkSecret = secret
+	}
+}
+
+// postToPeer posts the JSON body to path on node, signed with the network
+// secret if there is one. The request is cancelled if the blockchain is
+// closed.
+func (bc *Blockchain) postToPeer(node, path string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(bc.closingCtx, http.MethodPost, nodeURL(node, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bc.networkSecret != "" {
+		req.Header.Set(signatureHeader, signBody(bc.networkSecret, body))
+	}
+	return bc.httpClient.Do(req)
+}
+
+// relayTransaction forwards tx to the registered nodes in the background.
+// Failures are only logged: the transaction is still pending here.
+func (bc *Blockchain) relayTransaction(tx Transaction) {
+	body, err := json.Marshal(tx)
+	if err != nil {
+		log.Printf("could not encode transaction %s: %v", tx.ID(), err)
+		return
+	}
+	nodes := bc.Nodes()
+	bc.goBackground(func() {
+		for _, node := range nodes {
+			resp, err := bc.postToPeer(node, "/transactions/new", body, http.Header{relayedHeader: {"1"}})
+			if err != nil {
+				log.Printf("could not relay transaction %s to %s: %v", tx.ID(), node, err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				log.Printf("node %s refused relayed transaction %s: %s", node, tx.ID(), resp.Status)
+			}
+		}
+	})
+}
+
+// rejectedBlockWindow is how long a node remembers the announced blocks it
+// found invalid, so that replays of them are turned away without validating
+// them again.
+const rejectedBlockWindow = 10 * time.Minute
+
+// rejectedBlock is an announced block found invalid.
+type rejectedBlock struct {
+	err error
+	at  time.Time
+}
+
+// AcceptBlock adds a block announced by a peer on top of the chain. The block
+// must directly follow the tip, otherwise ErrStaleTip is returned and the
+// peer's chain is left to ResolveConflicts. Its proof must meet at least our
+// current difficulty and its transactions must be valid; otherwise
+// ErrInvalidChain is returned. The transactions of the block are removed
+// from the mempool.
+//
+// Blocks already in the chain are answered with ErrKnownBlock, and blocks
+// found invalid in the last rejectedBlockWindow with ErrRejectedBlock and
+// the reason they were rejected, without validating them again.
+func (bc *Blockchain) AcceptBlock(block Block) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if len(bc.chain) == 0 {
+		return ErrEmptyChain
+	}
+	hash := bc.computeHashForBlock(block)
+	for i := len(bc.hashes) - 1; i >= 0; i-- {
+		if bc.hashes[i] == hash {
+			return fmt.Errorf("%w: block %d %s", ErrKnownBlock, block.Index, hash)
+		}
+	}
+	if rejected, ok := bc.rejectedBlocks[hash]; ok && time.Since(rejected.at) < rejectedBlockWindow {
+		return fmt.Errorf("%w: block %d %s: %v", ErrRejectedBlock, block.Index, hash, rejected.err)
+	}
+
+	last := bc.lastBlock()
+	if tip := bc.tipHash(); block.Index != last.Index+1 || block.PreviousHash != tip {
+		return fmt.Errorf("%w: block %d follows %s but the tip is block %d %s", ErrStaleTip, block.Index, block.PreviousHash, last.Index, tip)
+	}
+	if block.Difficulty < bc.Difficulty() || !bc.validProof(last.Proof, block.Proof, block.Difficulty) {
+		return bc.rejectBlock(hash, fmt.Errorf("%w: block %d has no valid proof of difficulty %d", ErrInvalidChain, block.Index, bc.Difficulty()))
+	}
+	if err := checkBlockVersion(block, &last); err != nil {
+		return bc.rejectBlock(hash, fmt.Errorf("%w: block %d: %v", ErrInvalidChain, block.Index, err))
+	}
+	balances := make(map[string]int64, len(bc.state.Balances))
+	for address, balance := range bc.state.Balances {
+		balances[address] = balance
+	}
+	if err := bc.checkBlockTransactions(block, balances); err != nil {
+		return bc.rejectBlock(hash, fmt.Errorf("%w: block %d: %v", ErrInvalidChain, block.Index, err))
+	}
+	if err := bc.checkMinerSignatureCached(block, hash); err != nil {
+		return bc.rejectBlock(hash, fmt.Errorf("%w: block %d: %v", ErrInvalidChain, block.Index, err))
+	}
+	if !bc.matchesCheckpoint(block.Index, hash) {
+		return bc.rejectBlock(hash, fmt.Errorf("%w: block %d doesn't match the checkpoint", ErrInvalidChain, block.Index))
+	}
+
+	bc.appendBlock(block.copy(), hash)
+	bc.forgetPending(block)
+	return nil
+}
+
+// rejectBlock remembers that the block with the given hash was found invalid
+// with err, forgets the rejections older than rejectedBlockWindow, and
+// returns err.
+func (bc *Blockchain) rejectBlock(hash string, err error) error {
+	now := time.Now()
+	for rejectedHash, rejected := range bc.rejectedBlocks {
+		if now.Sub(rejected.at) >= rejectedBlockWindow {
+			delete(bc.rejectedBlocks, rejectedHash)
+		}
+	}
+	bc.rejectedBlocks[hash] = rejectedBlock{err, now}
+	return err
+}
+
+// forgetPending removes the transactions of block from the mempool, once
+// for every time the block holds them, and drops the remaining ones that
+// block made invalid.
+func (bc *Blockchain) forgetPending(block Block) {
+	mined := make(map[string]int)
+	for _, tx := range block.Transactions {
+		mined[tx.ID()]++
+	}
+	var pending []Transaction
+	for _, tx := range bc.transactions {
+		if id := tx.ID(); mined[id] > 0 {
+			mined[id]--
+			continue
+		}
+		pending = append(pending, tx)
+	}
+	bc.revalidatePending(pending)
+}
+
+// announceBlock posts block to the registered nodes in the background, so
+// that they mine on top of it right away. A node accepting an announced block
+// announces it in turn; the nodes that already have it don't, which ends the
+// flood.
+func (bc *Blockchain) announceBlock(block Block) {
+	body, err := json.Marshal(block)
+	if err != nil {
+		log.Printf("could not encode block %d: %v", block.Index, err)
+		return
+	}
+	nodes := bc.Nodes()
+	bc.goBackground(func() {
+		for _, node := range nodes {
+			resp, err := bc.postToPeer(node, "/blocks/announce", body, nil)
+			if err != nil {
+				log.Printf("could not announce block %d to %s: %v", block.Index, node, err)
+				continue
+			}
+			resp.Body.Close()
+		}
+	})
+}
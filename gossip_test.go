@@ -0,0 +1,181 @@
+package gochain
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAnnounceBlock(t *testing.T) {
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 2, testAddress("peer"))
+	bc := newTestBlockchain(t)
+	if err := bc.Import(peer.Export()); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(bc, testAddress("node"))
+	announce := func(block Block) int {
+		t.Helper()
+		data, err := json.Marshal(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serve(h, http.MethodPost, "/blocks/announce", string(data), nil).Code
+	}
+
+	mineBlocks(t, peer, 1, testAddress("peer"))
+	next := peer.LastBlock()
+	// A proof may meet difficulty 1 by chance, a lower difficulty never does.
+	invalid := next
+	invalid.Difficulty = 0
+
+	for _, tc := range []struct {
+		name  string
+		block Block
+		want  int
+	}{
+		{"invalid block", invalid, http.StatusBadRequest},
+		{"rejected block again", invalid, http.StatusConflict},
+		{"next block", next, http.StatusCreated},
+		{"tip again", next, http.StatusOK},
+		{"old block", peer.Chain()[1], http.StatusOK},
+	} {
+		if got := announce(tc.block); got != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTxGossip(t *testing.T) {
+	miner := testAddress("miner")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 2, miner)
+
+	// Two nodes knowing each other, counting the transactions relayed to
+	// them.
+	var nodes [2]*Blockchain
+	var handlers [2]http.Handler
+	var relayed [2]int32
+	for i := range nodes {
+		nodes[i] = newTestBlockchain(t, WithTxGossip(), WithNetworkSecret("secret"))
+		if err := nodes[i].Import(source.Export()); err != nil {
+			t.Fatal(err)
+		}
+		handlers[i] = NewHandler(nodes[i], testAddress("node"))
+	}
+	for i := range nodes {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/transactions/new" && r.Header.Get(relayedHeader) != "" {
+				atomic.AddInt32(&relayed[i], 1)
+			}
+			handlers[i].ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		nodes[1-i].RegisterNode(srv.URL)
+	}
+
+	tx := `{"sender": "` + miner + `", "recipient": "` + testAddress("alice") + `", "amount": 1}`
+	if rec := serve(handlers[0], http.MethodPost, "/transactions/new", tx, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(nodes[1].PendingTransactions()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("transaction never reached the other node")
+		}
+	}
+	// The other node doesn't send it back.
+	time.Sleep(100 * time.Millisecond)
+	if got := [2]int32{atomic.LoadInt32(&relayed[0]), atomic.LoadInt32(&relayed[1])}; got != [2]int32{0, 1} {
+		t.Errorf("relayed transactions received are %v, want only one by the other node", got)
+	}
+
+	// Relayed transactions must be signed with the network secret.
+	header := http.Header{relayedHeader: {"1"}}
+	if rec := serve(handlers[1], http.MethodPost, "/transactions/new", tx, header); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned relayed transaction: status %d, want 401", rec.Code)
+	}
+}
+
+func TestMinedBlocksPropagate(t *testing.T) {
+	miner := testAddress("miner")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 2, miner)
+	tx := Transaction{Sender: miner, Recipient: testAddress("alice"), Amount: 1}
+
+	// A ring of nodes, each knowing only the next one, all with tx pending.
+	var nodes [3]*Blockchain
+	var urls [3]string
+	for i := range nodes {
+		nodes[i] = newTestBlockchain(t)
+		if err := nodes[i].Import(source.Export()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nodes[i].NewTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(NewHandler(nodes[i], testAddress("node")))
+		t.Cleanup(srv.Close)
+		urls[i] = srv.URL
+	}
+	for i := range nodes {
+		nodes[i].RegisterNode(urls[(i+1)%len(nodes)])
+	}
+
+	if rec := serve(NewHandler(nodes[0], miner), http.MethodGet, "/mine", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("mine: status %d: %s", rec.Code, rec.Body)
+	}
+	for deadline := time.Now().Add(5 * time.Second); nodes[2].Len() != 4; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("block never reached the last node")
+		}
+	}
+	for i, node := range nodes {
+		if !reflect.DeepEqual(node.Chain(), nodes[0].Chain()) {
+			t.Errorf("chain of node %d differs from the miner's", i)
+		}
+		// The mined transaction is no longer pending anywhere.
+		if n := len(node.PendingTransactions()); n != 0 {
+			t.Errorf("node %d has %d transactions pending", i, n)
+		}
+	}
+}
+
+func TestAcceptBlockDropsDoubleSpends(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 2, miner)
+	if _, err := source.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, source, 1, miner)
+
+	// Alice spends her only coin on both nodes, to different recipients.
+	var nodes [2]*Blockchain
+	for i, recipient := range []string{"bob", "carol"} {
+		nodes[i] = newTestBlockchain(t)
+		if err := nodes[i].Import(source.Export()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nodes[i].NewTransaction(Transaction{Sender: alice, Recipient: testAddress(recipient), Amount: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := nodes[0], nodes[1]
+
+	mineBlocks(t, b, 1, miner)
+	if err := a.AcceptBlock(b.LastBlock()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(a.PendingTransactions()); n != 0 {
+		t.Errorf("%d transactions pending after the double spend was mined, want 0", n)
+	}
+	mineBlocks(t, a, 1, miner)
+	if err := a.ValidateLocalChain(); err != nil {
+		t.Errorf("chain mined after accepting the block is invalid: %v", err)
+	}
+}
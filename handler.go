@@ -1,28 +1,289 @@
 package gochain
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func NewHandler(blockchain *Blockchain, nodeID string) http.Handler {
-	h := handler{blockchain, nodeID}
+// HandlerOption configures the handler returned by NewHandler.
+type HandlerOption func(*handler)
+
+// WithRateLimit limits how fast a single client (by IP) can submit
+// transactions: up to burst requests at once, refilled at rate per second.
+func WithRateLimit(rate float64, burst int) HandlerOption {
+	return func(h *handler) {
+		h.txLimiter = newRateLimiter(rate, burst)
+	}
+}
+
+// WithIdempotencyTTL sets how long the responses to transactions submitted
+// with an Idempotency-Key header are kept for retries, defaultIdempotencyTTL
+// by default.
+func WithIdempotencyTTL(ttl time.Duration) HandlerOption {
+	return func(h *handler) {
+		h.idempotencyTTL = ttl
+	}
+}
+
+// WithAPIKey protects the endpoints that change the node's state (mining,
+// new transactions and node management) with a bearer token. Reading the
+// chain stays public.
+func WithAPIKey(key string) HandlerOption {
+	return func(h *handler) {
+		h.apiKey = key
+	}
+}
+
+// WithPeerPruning periodically health checks the registered nodes and
+// removes the ones that keep failing.
+func WithPeerPruning(interval time.Duration) HandlerOption {
+	return func(h *handler) {
+		h.blockchain.pruneUnreachableEvery(interval)
+	}
+}
+
+// WithAutoResolve runs the consensus algorithm in the background every
+// interval, so that nodes which don't mine stay in sync with the network.
+// It stops when the blockchain is closed.
+func WithAutoResolve(interval time.Duration) HandlerOption {
+	return func(h *handler) {
+		h.blockchain.resolveConflictsEvery(interval)
+	}
+}
+
+// WithBodyLimit limits the size of the request bodies sent to path to limit
+// bytes. Larger bodies are rejected with 413 Request Entity Too Large.
+func WithBodyLimit(path string, limit int64) HandlerOption {
+	return func(h *handler) {
+		h.bodyLimits[path] = limit
+	}
+}
+
+// WithoutMining makes the node listen only: it serves the chain, accepts
+// transactions and takes part in consensus, but refuses to mine.
+func WithoutMining() HandlerOption {
+	return func(h *handler) {
+		h.listenOnly = true
+	}
+}
+
+// WithoutResolveBeforeMining makes mining start right away instead of
+// resolving conflicts with the peers first, which can take long when peers
+// don't answer. The node should then resolve conflicts in the background,
+// see WithAutoResolve. Peers are still checked in the background while the
+// proof of work runs.
+func WithoutResolveBeforeMining() HandlerOption {
+	return func(h *handler) {
+		h.skipResolve = true
+	}
+}
+
+// WithAdvertisedAddress sets the address, e.g. http://127.0.0.1:8000, the
+// node is reachable at. Registering it as a peer is refused, see
+// Blockchain.SetSelfAddress.
+func WithAdvertisedAddress(address string) HandlerOption {
+	return func(h *handler) {
+		h.blockchain.SetSelfAddress(address)
+	}
+}
+
+// WithMineTimeout makes synchronous /mine requests give up with 503 Service
+// Unavailable once they took longer than timeout. The deadline is soft: it
+// is only checked while searching for a proof, so waiting for another
+// mining job and resolving conflicts beforehand can make a request last
+// longer. Background mining jobs aren't limited.
+func WithMineTimeout(timeout time.Duration) HandlerOption {
+	return func(h *handler) {
+		h.mineTimeout = timeout
+	}
+}
+
+// WithRewardSplit splits the mining rewards among the addresses of split in
+// proportion to their weights, instead of paying them to the node id. See
+// Blockchain.ForgeBlockSplit.
+func WithRewardSplit(split map[string]int) HandlerOption {
+	return func(h *handler) {
+		h.rewardSplit = split
+	}
+}
+
+// NewHandler returns the HTTP API of a node. Unless mining is disabled or
+// the rewards are split with WithRewardSplit, nodeID must be a valid
+// address, as the mining rewards are paid to it; NewHandler panics
+// otherwise, as it does for a split with invalid addresses or weights.
+func NewHandler(blockchain *Blockchain, nodeID string, opts ...HandlerOption) http.Handler {
+	h := &handler{
+		blockchain: blockchain,
+		nodeId:     nodeID,
+		jobs:       make(map[string]*mineJob),
+		bodyLimits: make(map[string]int64),
+
+		idempotencyTTL: defaultIdempotencyTTL,
+	}
+	for path, limit := range defaultBodyLimits {
+		h.bodyLimits[path] = limit
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.idempotency = newIdempotencyCache(h.idempotencyTTL)
+	// The mining rewards are paid to the node id, coins sent elsewhere would
+	// be lost.
+	if !h.listenOnly && h.rewardSplit == nil {
+		if err := ValidateAddress(nodeID); err != nil {
+			panic(fmt.Sprintf("gochain: node id must be the address mining rewards are paid to: %v", err))
+		}
+	}
+	for address, weight := range h.rewardSplit {
+		if err := ValidateAddress(address); err != nil {
+			panic(fmt.Sprintf("gochain: reward split: %v", err))
+		}
+		if weight <= 0 {
+			panic(fmt.Sprintf("gochain: reward split: weight of %s must be positive", address))
+		}
+	}
+	if h.rewardSplit != nil && len(h.rewardSplit) == 0 {
+		panic("gochain: reward split has no addresses")
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/nodes/register", buildResponse(h.RegisterNode))
-	mux.HandleFunc("/nodes/resolve", buildResponse(h.ResolveConflicts))
-	mux.HandleFunc("/transactions/new", buildResponse(h.AddTransaction))
-	mux.HandleFunc("/mine", buildResponse(h.Mine))
+	mux.HandleFunc("/nodes/register", h.protect(h.signed(buildResponse(h.RegisterNode))))
+	mux.HandleFunc("/nodes/resolve", h.protect(buildResponse(h.ResolveConflicts)))
+	mux.HandleFunc("/transactions/new", h.protect(h.signedIfRelayed(idempotent(h.idempotency, limitRate(h.txLimiter, buildResponse(h.AddTransaction))))))
+	mux.HandleFunc("/transactions/batch", h.protect(limitRate(h.txLimiter, buildResponse(h.AddTransactions))))
+	mux.HandleFunc("/transactions/validate", buildResponse(h.ValidateTransaction))
+	mux.HandleFunc("/transactions/", h.protect(buildResponse(h.CancelTransaction)))
+	mux.HandleFunc("/mempool/prune", h.protect(buildResponse(h.PruneMempool)))
+	mux.HandleFunc("/mine", h.protect(buildResponse(h.Mine)))
+	mux.HandleFunc("/mine/status", buildResponse(h.MineStatus))
+	mux.HandleFunc("/mine/estimate", h.protect(buildResponse(h.MineEstimate)))
+	mux.HandleFunc("/blocks/announce", h.signed(buildResponse(h.AnnounceBlock)))
 	mux.HandleFunc("/chain", buildResponse(h.Blockchain))
-	return mux
+	mux.HandleFunc("/chain/head", buildResponse(h.ChainHead))
+	mux.HandleFunc("/chain/binary", buildResponse(h.ChainBinary))
+	mux.HandleFunc("/genesis", buildResponse(h.Genesis))
+	mux.HandleFunc("/chain/validate", buildResponse(h.ValidateChain))
+	mux.HandleFunc("/chain/reindex", h.protect(buildResponse(h.Reindex)))
+	mux.HandleFunc("/chain/pow-stats", buildResponse(h.PowStats))
+	mux.HandleFunc("/blocks", buildResponse(h.Blocks))
+	mux.HandleFunc("/block/hash/", buildResponse(h.BlockByHash))
+	mux.HandleFunc("/tx/proof/", buildResponse(h.TransactionProof))
+	mux.HandleFunc("/orphans", buildResponse(h.Orphans))
+	mux.HandleFunc("/supply", buildResponse(h.Supply))
+	mux.HandleFunc("/richlist", buildResponse(h.RichList))
+	mux.HandleFunc("/balance/", buildResponse(h.Balance))
+	mux.HandleFunc("/address/", buildResponse(h.AddressHistory))
+	mux.HandleFunc("/stats", buildResponse(h.Stats))
+	mux.HandleFunc("/status", buildResponse(h.Status))
+	mux.HandleFunc("/healthz", buildResponse(h.Health))
+	mux.HandleFunc("/info", buildResponse(h.Info))
+	mux.HandleFunc("/difficulty", h.protectWrites(buildResponse(h.Difficulty)))
+	mux.HandleFunc("/export", buildResponse(h.Export))
+	mux.HandleFunc("/import", h.protect(buildResponse(h.Import)))
+	mux.HandleFunc("/webhooks", h.protect(buildResponse(h.RegisterWebhook)))
+	mux.HandleFunc("/rpc", h.protect(limitRate(h.txLimiter, buildResponse(h.RPC))))
+	return compress(limitBody(h.bodyLimits, mux))
 }
 
 type handler struct {
 	blockchain *Blockchain
 	nodeId     string
+	txLimiter  *rateLimiter
+	apiKey     string
+	listenOnly bool
+	// skipResolve skips the consensus round before mining.
+	skipResolve bool
+	// mineTimeout, if set, is how long a synchronous /mine may take.
+	mineTimeout time.Duration
+	bodyLimits  map[string]int64
+	// idempotency holds the responses to requests with an Idempotency-Key.
+	idempotencyTTL time.Duration
+	idempotency    *idempotencyCache
+	// rewardSplit, if set, is who the mining rewards are paid to instead of
+	// the node id, address -> weight.
+	rewardSplit map[string]int
+
+	// mineMu makes sure only one mining job touches the mempool at a time,
+	// whether it was requested synchronously or in the background.
+	mineMu sync.Mutex
+	jobsMu sync.Mutex
+	jobs   map[string]*mineJob
+}
+
+// defaultIdempotencyTTL is how long the responses to requests with an
+// Idempotency-Key are kept by default.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// defaultMempoolMaxAge is how long transactions may wait in the mempool
+// before /mempool/prune drops them, unless the request sets another age.
+const defaultMempoolMaxAge = time.Hour
+
+// defaultRichListLimit is the number of addresses listed by /richlist when
+// the request sets no limit.
+const defaultRichListLimit = 10
+
+// defaultHistoryLimit is the number of transactions listed by
+// /address/{address}/transactions when the request sets no limit.
+const defaultHistoryLimit = 50
+
+// estimateSample is how long /mine/estimate measures the hash rate for.
+const estimateSample = 200 * time.Millisecond
+
+// mineJobTTL is how long /mine/status reports a background mining job once
+// it finished.
+const mineJobTTL = time.Hour
+
+const (
+	jobPending = "pending"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+type mineJob struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Block  *Block `json:"block,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	finished time.Time // zero while the job runs
+}
+
+func (h *handler) protect(next http.HandlerFunc) http.HandlerFunc {
+	return requireAPIKey(h.apiKey, next)
+}
+
+// signed requires the request body to be signed with the network secret, if
+// the blockchain has one.
+func (h *handler) signed(next http.HandlerFunc) http.HandlerFunc {
+	return requireSignature(h.blockchain.networkSecret, false, next)
+}
+
+// signedIfRelayed is signed for the requests relayed by other nodes only.
+func (h *handler) signedIfRelayed(next http.HandlerFunc) http.HandlerFunc {
+	return requireSignature(h.blockchain.networkSecret, true, next)
+}
+
+// protectWrites only requires the API key for requests that aren't reads.
+func (h *handler) protectWrites(next http.HandlerFunc) http.HandlerFunc {
+	protected := h.protect(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		protected(w, r)
+	}
 }
 
 type response struct {
@@ -31,58 +292,341 @@ type response struct {
 	err        error
 }
 
-func buildResponse(h func(io.Writer, *http.Request) response) http.HandlerFunc {
+func buildResponse(h func(http.ResponseWriter, *http.Request) response) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		resp := h(w, r)
 		msg := resp.value
+		status := resp.statusCode
 		if resp.err != nil {
 			msg = resp.err.Error()
+			status = statusFor(resp.err, resp.statusCode)
+		}
+		if r.Method == http.MethodHead || status == http.StatusNotModified || status == http.StatusNoContent {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.statusCode)
-		if err := json.NewEncoder(w).Encode(msg); err != nil {
-			log.Printf("could not encode response to output: %v", err)
+		if chain, ok := msg.(binaryChain); ok {
+			writeBinaryChain(w, status, chain)
+			return
 		}
+		// Compact by default, indented for people reading it with ?pretty=true.
+		indent := ""
+		if r.URL.Query().Get("pretty") == "true" {
+			indent = "  "
+		}
+		writeJSONIndent(w, status, msg, indent)
 	}
 }
 
-func (h *handler) AddTransaction(w io.Writer, r *http.Request) response {
+func writeJSON(w http.ResponseWriter, statusCode int, msg interface{}) {
+	writeJSONIndent(w, statusCode, msg, "")
+}
+
+// writeJSONIndent is writeJSON, indenting every level of the JSON with
+// indent. An empty indent writes compact JSON.
+func writeJSONIndent(w http.ResponseWriter, statusCode int, msg interface{}, indent string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(msg); err != nil {
+		log.Printf("could not encode response to output: %v", err)
+	}
+}
+
+func (h *handler) AddTransaction(w http.ResponseWriter, r *http.Request) response {
 	if r.Method != http.MethodPost {
 		return response{
 			nil,
 			http.StatusMethodNotAllowed,
-			fmt.Errorf("method %s not allowd", r.Method),
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
 		}
 	}
 
 	log.Printf("transaction to the blockchain...\n")
 
-	var tx Transaction
-	err := json.NewDecoder(r.Body).Decode(&tx)
-	index := h.blockchain.NewTransaction(tx)
+	tx, err := DecodeTransaction(r.Body)
+	if err != nil {
+		log.Printf("there was an error when trying to add a transaction %v\n", err)
+		return response{nil, http.StatusBadRequest, err}
+	}
+	// The fee is part of the id, so set it before the id is computed.
+	tx = h.blockchain.withFee(tx)
+	index, err := h.blockchain.addTransaction(tx, h.relays(r))
+	if err != nil {
+		log.Printf("rejected transaction: %v\n", err)
+		return response{nil, http.StatusBadRequest, err}
+	}
 
 	resp := map[string]string{
 		"message": fmt.Sprintf("Transaction will be added to Block %d", index),
+		"id":      tx.ID(),
+	}
+	return response{resp, http.StatusCreated, nil}
+}
+
+// relays reports whether the transactions of r should be forwarded to the
+// peers: only if gossip is on and they didn't come from a peer already.
+func (h *handler) relays(r *http.Request) bool {
+	return h.blockchain.gossipTxs && r.Header.Get(relayedHeader) == ""
+}
+
+type batchResult struct {
+	Index    int    `json:"index"`
+	Accepted bool   `json:"accepted"`
+	ID       string `json:"id,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// AddTransactions adds a batch of transactions. Each one is handled on its
+// own, so an invalid transaction doesn't prevent the others from being added.
+func (h *handler) AddTransactions(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
 	}
 
-	status := http.StatusCreated
+	var batch []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrInvalidTransaction, err)}
+	}
+
+	log.Printf("adding a batch of %d transactions to the blockchain...\n", len(batch))
+
+	results := make([]batchResult, len(batch))
+	for i, raw := range batch {
+		results[i].Index = i
+		tx, err := DecodeTransaction(bytes.NewReader(raw))
+		if err != nil {
+			results[i].Reason = err.Error()
+			continue
+		}
+		tx = h.blockchain.withFee(tx)
+		if _, err := h.blockchain.addTransaction(tx, h.relays(r)); err != nil {
+			results[i].Reason = err.Error()
+			continue
+		}
+		results[i].Accepted = true
+		results[i].ID = tx.ID()
+	}
+	return response{results, http.StatusOK, nil}
+}
+
+func (h *handler) ValidateTransaction(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	tx, err := DecodeTransaction(r.Body)
 	if err != nil {
-		status = http.StatusInternalServerError
-		log.Printf("there was an error when trying to add a transaction %v\n", err)
-		err = fmt.Errorf("fail to add transaction to the blockchain")
+		return response{nil, http.StatusBadRequest, err}
 	}
 
-	return response{resp, status, err}
+	resp := map[string]interface{}{"valid": true}
+	if err := h.blockchain.ValidateTransaction(tx); err != nil {
+		resp = map[string]interface{}{"valid": false, "reason": err.Error()}
+	}
+	return response{resp, http.StatusOK, nil}
 }
 
-func (h *handler) Mine(w io.Writer, r *http.Request) response {
+// CancelTransaction drops a pending transaction from the mempool before it is
+// mined.
+func (h *handler) CancelTransaction(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodDelete {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
 
-	log.Println("Before mining, resolving blockchain differences by consensus")
-	h.blockchain.ResolveConflicts()
-	transactions := h.blockchain.transactions
+	id := strings.TrimPrefix(r.URL.Path, "/transactions/")
+	if err := h.blockchain.CancelTransaction(id); err != nil {
+		return response{nil, http.StatusNotFound, err}
+	}
+	return response{map[string]string{"cancelled": id}, http.StatusOK, nil}
+}
+
+func (h *handler) PruneMempool(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	body := struct {
+		MaxAgeSeconds *int64 `json:"max_age_seconds"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		return response{nil, http.StatusBadRequest, err}
+	}
+	maxAge := defaultMempoolMaxAge
+	if body.MaxAgeSeconds != nil {
+		if *body.MaxAgeSeconds < 0 {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("max_age_seconds must not be negative")}
+		}
+		maxAge = time.Duration(math.MaxInt64)
+		if *body.MaxAgeSeconds < int64(maxAge/time.Second) {
+			maxAge = time.Duration(*body.MaxAgeSeconds) * time.Second
+		}
+	}
+
+	pruned := h.blockchain.PruneExpired(maxAge)
+	resp := map[string]interface{}{"pruned": pruned, "pending": len(h.blockchain.PendingTransactions())}
+	return response{resp, http.StatusOK, nil}
+}
+
+func (h *handler) Mine(w http.ResponseWriter, r *http.Request) response {
+	if h.listenOnly {
+		return response{nil, http.StatusForbidden, ErrMiningDisabled}
+	}
+	if r.URL.Query().Get("async") == "true" {
+		return h.mineAsync(r)
+	}
+
+	ctx := r.Context()
+	if h.mineTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.mineTimeout)
+		defer cancel()
+	}
+	block, err := h.mine(ctx)
+	if err != nil {
+		return response{nil, http.StatusServiceUnavailable, fmt.Errorf("mining cancelled: %v", err)}
+	}
+	resp := map[string]interface{}{"message": "New Block Forged", "block": block}
+	return response{resp, http.StatusOK, nil}
+}
+
+func (h *handler) mineAsync(r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	job := &mineJob{ID: PseudoUUID(), Status: jobPending}
+	now := time.Now()
+	h.jobsMu.Lock()
+	for id, old := range h.jobs {
+		if !old.finished.IsZero() && now.Sub(old.finished) > mineJobTTL {
+			delete(h.jobs, id)
+		}
+	}
+	h.jobs[job.ID] = job
+	h.jobsMu.Unlock()
+
+	log.Printf("Mining job %s queued", job.ID)
+	// The job runs in the background of the blockchain, so that closing it
+	// stops the job.
+	if !h.blockchain.goBackground(func() { h.runMineJob(job.ID) }) {
+		h.finishMineJob(job.ID, nil, ErrClosed)
+	}
+
+	resp := map[string]interface{}{"message": "Mining started", "id": job.ID}
+	return response{resp, http.StatusAccepted, nil}
+}
+
+func (h *handler) runMineJob(id string) {
+	defer func() {
+		// A panic in a background job would otherwise take the whole node down.
+		if r := recover(); r != nil {
+			log.Printf("mining job %s failed: %v", id, r)
+			h.finishMineJob(id, nil, fmt.Errorf("%v", r))
+		}
+	}()
+	block, err := h.mine(h.blockchain.closingCtx)
+	if err != nil {
+		h.finishMineJob(id, nil, err)
+		return
+	}
+	h.finishMineJob(id, &block, nil)
+}
+
+func (h *handler) finishMineJob(id string, block *Block, err error) {
+	h.jobsMu.Lock()
+	defer h.jobsMu.Unlock()
+	job := h.jobs[id]
+	job.finished = time.Now()
+	if err != nil {
+		job.Status = jobFailed
+		job.Error = err.Error()
+		return
+	}
+	job.Status = jobDone
+	job.Block = block
+}
+
+func (h *handler) MineStatus(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("missing job id")}
+	}
+
+	h.jobsMu.Lock()
+	defer h.jobsMu.Unlock()
+	job, ok := h.jobs[id]
+	if !ok {
+		return response{nil, http.StatusNotFound, fmt.Errorf("%w: mining job %s", ErrNotFound, id)}
+	}
+	return response{*job, http.StatusOK, nil}
+}
+
+// MineEstimate estimates how long mining a block takes at the difficulty of
+// the query, or the current one, without mining.
+func (h *handler) MineEstimate(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	difficulty := h.blockchain.Difficulty()
+	if v := r.URL.Query().Get("difficulty"); v != "" {
+		n, err := strconv.Atoi(v)
+		if max := h.blockchain.maxDifficulty(); err != nil || n < 1 || n > max {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("difficulty must be between 1 and %d", max)}
+		}
+		difficulty = n
+	}
+	return response{h.blockchain.EstimateMining(difficulty, estimateSample), http.StatusOK, nil}
+}
+
+// mine runs the proof of work and forges a new block. Calls are serialized so
+// that concurrent jobs never race on the same set of pending transactions.
+// Mining stops with an error when ctx is done.
+func (h *handler) mine(ctx context.Context) (Block, error) {
+	h.mineMu.Lock()
+	defer h.mineMu.Unlock()
+
+	if !h.skipResolve {
+		log.Println("Before mining, resolving blockchain differences by consensus")
+		h.blockchain.ResolveConflicts()
+	}
 
 	log.Println("Mining some coins")
-	var proof int64
 
 	// Improvement (2) (3): Restart the ProofOfWork procedure if to-be-found proof is meaningless.
 	for {
@@ -90,7 +634,11 @@ func (h *handler) Mine(w io.Writer, r *http.Request) response {
 		lastBlock := h.blockchain.LastBlock()
 		lastProof := lastBlock.Proof
 
-		proof = h.blockchain.ProofOfWork(lastProof)
+		proof, err := h.blockchain.ProofOfWorkContext(ctx, lastProof)
+		if err != nil {
+			log.Printf("Mining stopped: %v", err)
+			return Block{}, err
+		}
 
 		// Improvement (2): Restart the ProofOfWork procedure if the local chain has been replaced with an external chain.
 		if proof == -1 {
@@ -98,95 +646,602 @@ func (h *handler) Mine(w io.Writer, r *http.Request) response {
 			continue
 		}
 
-		// Improvement (3): Restart the ProofOfWork procedure if proof having been found is obsolete 
+		// Forge the new Block by adding it to the chain, we must receive a
+		// reward for finding the proof.
+		split := h.rewardSplit
+		if split == nil {
+			split = map[string]int{h.nodeId: 1}
+		}
+		block, err := h.blockchain.ForgeBlockSplit(proof, split)
+		// Improvement (3): Restart the ProofOfWork procedure if proof having been found is obsolete
 		// (i.e., if the local chain has been updated before a proof is found).
-		if !h.blockchain.ValidProof(h.blockchain.LastBlock().Proof, proof) {
+		if errors.Is(err, ErrStaleTip) {
 			log.Println("Proof obsolete, proof-of-work restarted")
 			continue
-		} 
-		break
-	}
-	
-	// Improvement (1): The miner receives the transaction fee as a reward.
-	for _, tx := range transactions {
-		h.blockchain.NewTransaction(Transaction{Sender: tx.Sender, Recipient: h.nodeId, Amount: tx.Fee, Fee: 0})
-	}
-	// We must receive a reward for finding the proof.
-	// The sender is "0" to signify that this node has mined a new coin.
-	newTX := Transaction{Sender: "0", Recipient: h.nodeId, Amount: 1, Fee: 0}
-	h.blockchain.NewTransaction(newTX)
-
-	// Forge the new Block by adding it to the chain
-	block := h.blockchain.NewBlock(proof, "")
-	
-	resp := map[string]interface{}{"message": "New Block Forged", "block": block}
-	log.Println("New block forged")
+		}
+		if err != nil {
+			return Block{}, err
+		}
+		log.Println("New block forged")
+		h.blockchain.announceBlock(block)
+		return block, nil
+	}
+}
+
+func (h *handler) AnnounceBlock(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	var block Block
+	if err := json.NewDecoder(r.Body).Decode(&block); err != nil {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrInvalidChain, err)}
+	}
+	if err := h.blockchain.AcceptBlock(block); errors.Is(err, ErrKnownBlock) {
+		resp := map[string]interface{}{"message": "Block already known", "index": block.Index}
+		return response{resp, http.StatusOK, nil}
+	} else if err != nil {
+		return response{nil, http.StatusBadRequest, err}
+	}
+	log.Printf("Accepted announced block %d", block.Index)
+	h.blockchain.announceBlock(block)
+
+	resp := map[string]interface{}{"message": "Block accepted", "index": block.Index}
+	return response{resp, http.StatusCreated, nil}
+}
+
+func (h *handler) Blockchain(w http.ResponseWriter, r *http.Request) response {
+	return h.chain(w, r, acceptsBinary(r))
+}
+
+func (h *handler) ChainBinary(w http.ResponseWriter, r *http.Request) response {
+	return h.chain(w, r, true)
+}
+
+// chain answers the chain, in the binary format if binary is true and in
+// JSON otherwise.
+func (h *handler) chain(w http.ResponseWriter, r *http.Request, binary bool) response {
+	if r.Method == http.MethodHead {
+		// Lets monitoring check the height without downloading the chain.
+		w.Header().Set("X-Chain-Length", strconv.FormatInt(h.blockchain.LastBlock().Index, 10))
+		return response{nil, http.StatusOK, nil}
+	}
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	// Peers that already have the beginning of the chain only ask for the
+	// blocks they lack.
+	from := 1
+	if v := r.URL.Query().Get("from"); v != "" {
+		var err error
+		from, err = strconv.Atoi(v)
+		if err != nil || from < 1 {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("invalid from %q", v)}
+		}
+	}
+
+	// The chain only changes when its tip does, so clients polling it only
+	// download it again when there is something new. Parts of the chain and
+	// the binary format get their own tags, as their bodies differ.
+	length, lastHash := h.blockchain.head()
+	etag := fmt.Sprintf("%d-%s", length, lastHash)
+	if from > 1 {
+		etag += fmt.Sprintf("-from-%d", from)
+	}
+	if binary {
+		etag += "-binary"
+	}
+	etag = `"` + etag + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Accept")
+	if r.Header.Get("If-None-Match") == etag {
+		return response{nil, http.StatusNotModified, nil}
+	}
+
+	chain := h.blockchain.HashedChain()
+	length = len(chain)
+	if from > len(chain) {
+		from = len(chain) + 1
+	}
+	chain = chain[from-1:]
+	if binary {
+		// The hashes are left out, peers compute them anyway.
+		blocks := make([]Block, len(chain))
+		for i, block := range chain {
+			blocks[i] = block.Block
+		}
+		return response{binaryChain{Length: length, Chain: blocks}, http.StatusOK, nil}
+	}
+	resp := map[string]interface{}{"chain": chain, "length": length}
 	return response{resp, http.StatusOK, nil}
 }
 
-func (h *handler) Blockchain(w io.Writer, r *http.Request) response {
+func (h *handler) ChainHead(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	return response{h.blockchain.chainHead(), http.StatusOK, nil}
+}
+
+func (h *handler) Genesis(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	genesis, err := h.blockchain.Genesis()
+	if err != nil {
+		return response{nil, http.StatusServiceUnavailable, err}
+	}
+	return response{genesis, http.StatusOK, nil}
+}
+
+func (h *handler) PowStats(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	return response{ComputePowStats(h.blockchain.HashedChain()), http.StatusOK, nil}
+}
+
+func (h *handler) ValidateChain(w http.ResponseWriter, r *http.Request) response {
 	if r.Method != http.MethodGet {
 		return response{
 			nil,
 			http.StatusMethodNotAllowed,
-			fmt.Errorf("method %s not allowd", r.Method),
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
 		}
 	}
 
-	resp := map[string]interface{}{"chain": h.blockchain.chain, "length": len(h.blockchain.chain)}
+	resp := map[string]interface{}{"valid": true}
+	if err := h.blockchain.ValidateLocalChain(); err != nil {
+		resp = map[string]interface{}{"valid": false, "reason": err.Error()}
+		var blockErr *BlockError
+		if errors.As(err, &blockErr) {
+			resp["bad_index"] = blockErr.Index
+			resp["reason"] = blockErr.Err.Error()
+		}
+	}
 	return response{resp, http.StatusOK, nil}
 }
 
-func (h *handler) RegisterNode(w io.Writer, r *http.Request) response {
+func (h *handler) Reindex(w http.ResponseWriter, r *http.Request) response {
 	if r.Method != http.MethodPost {
 		return response{
 			nil,
 			http.StatusMethodNotAllowed,
-			fmt.Errorf("method %s not allowd", r.Method),
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	return response{h.blockchain.Reindex(), http.StatusOK, nil}
+}
+
+func (h *handler) Blocks(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	query := r.URL.Query()
+	from := int64(1)
+	if v := query.Get("from"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("invalid from %q", v)}
+		}
+		from = n
+	}
+	// to is brought back to the tip by BlockRange.
+	to := int64(math.MaxInt64)
+	if v := query.Get("to"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("invalid to %q", v)}
+		}
+		to = n
+	}
+	if from > to {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("from %d is after to %d", from, to)}
+	}
+
+	blocks := h.blockchain.BlockRange(from, to)
+	if blocks == nil {
+		blocks = []HashedBlock{}
+	}
+	resp := map[string]interface{}{"blocks": blocks, "length": h.blockchain.Len()}
+	return response{resp, http.StatusOK, nil}
+}
+
+func (h *handler) BlockByHash(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	hash := strings.TrimPrefix(r.URL.Path, "/block/hash/")
+	block, err := h.blockchain.GetBlockByHash(hash)
+	if err != nil {
+		return response{nil, http.StatusNotFound, err}
+	}
+	return response{block, http.StatusOK, nil}
+}
+
+func (h *handler) TransactionProof(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/tx/proof/")
+	proof, err := h.blockchain.TransactionProof(id)
+	if err != nil {
+		return response{nil, http.StatusNotFound, err}
+	}
+	return response{proof, http.StatusOK, nil}
+}
+
+func (h *handler) Orphans(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	orphans := h.blockchain.Orphans()
+	resp := map[string]interface{}{"transactions": orphans, "count": len(orphans)}
+	return response{resp, http.StatusOK, nil}
+}
+
+func (h *handler) Supply(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	resp := map[string]interface{}{"total_supply": h.blockchain.TotalSupply()}
+	return response{resp, http.StatusOK, nil}
+}
+
+func (h *handler) Balance(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	address := strings.TrimPrefix(r.URL.Path, "/balance/")
+	if err := ValidateAddress(address); err != nil {
+		return response{nil, http.StatusBadRequest, err}
+	}
+	resp := map[string]interface{}{
+		"address":   address,
+		"balance":   h.blockchain.Balance(address),
+		"available": h.blockchain.AvailableBalance(address),
+	}
+	return response{resp, http.StatusOK, nil}
+}
+
+// AddressHistory lists the mined transactions of the address in the path
+// /address/{address}/transactions, a page at a time.
+func (h *handler) AddressHistory(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	address := strings.TrimPrefix(r.URL.Path, "/address/")
+	if !strings.HasSuffix(address, "/transactions") {
+		return response{nil, http.StatusNotFound, fmt.Errorf("%w: %s", ErrNotFound, r.URL.Path)}
+	}
+	address = strings.TrimSuffix(address, "/transactions")
+	if err := ValidateAddress(address); err != nil {
+		return response{nil, http.StatusBadRequest, err}
+	}
+
+	query := r.URL.Query()
+	limit := defaultHistoryLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v)}
+		}
+		limit = n
+	}
+	offset := 0
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("invalid offset %q", v)}
+		}
+		offset = n
+	}
+
+	history, total := h.blockchain.AddressHistory(address, limit, offset)
+	resp := map[string]interface{}{
+		"address":      address,
+		"transactions": history,
+		"total":        total,
+	}
+	return response{resp, http.StatusOK, nil}
+}
+
+func (h *handler) RichList(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	limit := defaultRichListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v)}
+		}
+		limit = n
+	}
+	return response{h.blockchain.RichList(limit), http.StatusOK, nil}
+}
+
+func (h *handler) Stats(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	return response{h.blockchain.Stats(), http.StatusOK, nil}
+}
+
+func (h *handler) Status(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	return response{h.blockchain.Status(), http.StatusOK, nil}
+}
+
+func (h *handler) Health(w http.ResponseWriter, r *http.Request) response {
+	return response{map[string]string{"status": "ok"}, http.StatusOK, nil}
+}
+
+type nodeInfo struct {
+	NodeID      string `json:"node_id"`
+	Version     string `json:"version"`
+	Difficulty  int    `json:"difficulty"`
+	GenesisHash string `json:"genesis_hash"`
+}
+
+func (h *handler) Info(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	info := nodeInfo{
+		NodeID:      h.nodeId,
+		Version:     Version,
+		Difficulty:  h.blockchain.Difficulty(),
+		GenesisHash: h.blockchain.GenesisHash(),
+	}
+	return response{info, http.StatusOK, nil}
+}
+
+func (h *handler) Export(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodGet {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	return response{h.blockchain.Export(), http.StatusOK, nil}
+}
+
+func (h *handler) Import(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	log.Println("Importing blockchain state")
+
+	var snapshot Snapshot
+	if err := json.NewDecoder(r.Body).Decode(&snapshot); err != nil {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrInvalidChain, err)}
+	}
+	if err := h.blockchain.Import(snapshot); err != nil {
+		log.Printf("rejected import: %v\n", err)
+		return response{nil, http.StatusBadRequest, err}
+	}
+
+	resp := map[string]interface{}{"message": "Blockchain state imported", "length": len(snapshot.Chain)}
+	return response{resp, http.StatusOK, nil}
+}
+
+func (h *handler) Difficulty(w http.ResponseWriter, r *http.Request) response {
+	switch r.Method {
+	case http.MethodGet:
+		resp := map[string]int{"difficulty": h.blockchain.Difficulty()}
+		return response{resp, http.StatusOK, nil}
+	case http.MethodPut:
+		var body struct {
+			Difficulty int `json:"difficulty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("invalid difficulty: %v", err)}
+		}
+		if max := h.blockchain.maxDifficulty(); body.Difficulty < 1 || body.Difficulty > max {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("difficulty must be between 1 and %d", max)}
+		}
+		h.blockchain.SetDifficulty(body.Difficulty)
+		log.Printf("Difficulty set to %d", body.Difficulty)
+		resp := map[string]int{"difficulty": body.Difficulty}
+		return response{resp, http.StatusOK, nil}
+	default:
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+}
+
+func (h *handler) RegisterNode(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
 		}
 	}
 
 	log.Println("Adding node to the blockchain")
 
 	var body map[string][]string
-	err := json.NewDecoder(r.Body).Decode(&body)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Printf("there was an error when trying to register a new node %v\n", err)
+		return response{
+			nil,
+			http.StatusBadRequest,
+			fmt.Errorf("fail to register nodes: %v", err),
+		}
+	}
 
+	// Registering is idempotent, tell the client which nodes were new to us,
+	// and which we won't register at all.
+	added := make([]string, 0)
+	known := make([]string, 0)
+	rejected := make([]string, 0)
 	for _, node := range body["nodes"] {
-		h.blockchain.RegisterNode(node)
+		ok, err := h.blockchain.AddNode(node)
+		switch {
+		case err != nil:
+			log.Printf("not registering node %s: %v", node, err)
+			rejected = append(rejected, node)
+		case ok:
+			added = append(added, node)
+		default:
+			known = append(known, node)
+		}
 	}
 
 	resp := map[string]interface{}{
-		"message": "New nodes have been added",
-		"nodes":   h.blockchain.nodes.Keys(),
+		"message":       "New nodes have been added",
+		"added":         added,
+		"already_known": known,
+		"rejected":      rejected,
+		"nodes":         h.blockchain.Nodes(),
 	}
+	return response{resp, http.StatusCreated, nil}
+}
 
-	status := http.StatusCreated
-	if err != nil {
-		status = http.StatusInternalServerError
-		err = fmt.Errorf("fail to register nodes")
-		log.Printf("there was an error when trying to register a new node %v\n", err)
+func (h *handler) RegisterWebhook(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
 	}
 
-	return response{resp, status, err}
+	var body struct {
+		TxID string `json:"tx_id"`
+		URL  string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return response{nil, http.StatusBadRequest, fmt.Errorf("fail to register webhook: %v", err)}
+	}
+	if err := h.blockchain.RegisterWebhook(body.TxID, body.URL); err != nil {
+		return response{nil, http.StatusBadRequest, err}
+	}
+	return response{map[string]string{"message": "Webhook registered"}, http.StatusCreated, nil}
 }
 
-func (h *handler) ResolveConflicts(w io.Writer, r *http.Request) response {
+func (h *handler) ResolveConflicts(w http.ResponseWriter, r *http.Request) response {
 	if r.Method != http.MethodGet {
 		return response{
 			nil,
 			http.StatusMethodNotAllowed,
-			fmt.Errorf("method %s not allowd", r.Method),
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	quorum := 1
+	if v := r.URL.Query().Get("quorum"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return response{nil, http.StatusBadRequest, fmt.Errorf("invalid quorum %q", v)}
 		}
+		quorum = n
 	}
 
 	log.Println("Resolving blockchain differences by consensus")
 
+	// Whoever asks explicitly wants the peers' chains as they are now.
+	h.blockchain.forgetPeerResponses()
 	msg := "Our chain is authoritative"
-	if h.blockchain.ResolveConflicts() {
+	if h.blockchain.ResolveConflictsQuorum(quorum) {
 		msg = "Our chain was replaced"
 	}
 
-	resp := map[string]interface{}{"message": msg, "chain": h.blockchain.chain}
+	resp := map[string]interface{}{"message": msg, "chain": h.blockchain.Chain()}
 	log.Println(msg)
 	return response{resp, http.StatusOK, nil}
 }
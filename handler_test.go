@@ -0,0 +1,871 @@
+package gochain
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve sends a request to h and returns the recorded response. The body,
+// if any, is sent as JSON.
+func serve(h http.Handler, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeBody decodes the JSON body of rec into v.
+func decodeBody(t testing.TB, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("could not decode %q: %v", rec.Body.String(), err)
+	}
+}
+
+func TestChainFrom(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 4, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+
+	rec := serve(h, http.MethodGet, "/chain?from=3", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		Length int           `json:"length"`
+		Chain  []HashedBlock `json:"chain"`
+	}
+	decodeBody(t, rec, &got)
+	if got.Length != 5 || len(got.Chain) != 3 || got.Chain[0].Index != 3 {
+		t.Errorf("got length %d and %d blocks from %d, want 5 and 3 from 3", got.Length, len(got.Chain), got.Chain[0].Index)
+	}
+
+	for _, from := range []string{"0", "-1", "abc"} {
+		if rec := serve(h, http.MethodGet, "/chain?from="+from, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("from=%s: status %d, want 400", from, rec.Code)
+		}
+	}
+}
+
+func TestChainETag(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+
+	etag := serve(h, http.MethodGet, "/chain", "", nil).Header().Get("ETag")
+	ifNoneMatch := http.Header{"If-None-Match": {etag}}
+	if rec := serve(h, http.MethodGet, "/chain", "", ifNoneMatch); rec.Code != http.StatusNotModified {
+		t.Errorf("unchanged chain: status %d, want 304", rec.Code)
+	}
+	// The tag of the whole chain doesn't stand for a part of it.
+	if rec := serve(h, http.MethodGet, "/chain?from=3", "", ifNoneMatch); rec.Code != http.StatusOK {
+		t.Errorf("from=3 with the tag of the whole chain: status %d, want 200", rec.Code)
+	}
+	if rec := serve(h, http.MethodGet, "/chain?from=abc", "", ifNoneMatch); rec.Code != http.StatusBadRequest {
+		t.Errorf("from=abc: status %d, want 400", rec.Code)
+	}
+	partial := serve(h, http.MethodGet, "/chain?from=3", "", nil).Header().Get("ETag")
+	if rec := serve(h, http.MethodGet, "/chain?from=3", "", http.Header{"If-None-Match": {partial}}); rec.Code != http.StatusNotModified {
+		t.Errorf("unchanged part: status %d, want 304", rec.Code)
+	}
+
+	mineBlocks(t, bc, 1, testAddress("miner"))
+	if rec := serve(h, http.MethodGet, "/chain", "", ifNoneMatch); rec.Code != http.StatusOK {
+		t.Errorf("grown chain: status %d, want 200", rec.Code)
+	}
+}
+
+func TestChainETagDistinguishesChains(t *testing.T) {
+	bc := newTestBlockchain(t)
+	other := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	mineBlocks(t, other, 2, testAddress("other"))
+	h := NewHandler(bc, testAddress("node"))
+
+	etag := serve(h, http.MethodGet, "/chain", "", nil).Header().Get("ETag")
+	binary := serve(h, http.MethodGet, "/chain", "", http.Header{"Accept": {BinaryChainType}}).Header().Get("ETag")
+	if binary == etag {
+		t.Errorf("binary and JSON bodies share the tag %s", etag)
+	}
+	// A chain of the same length with another tip is a different chain.
+	forked := serve(NewHandler(other, testAddress("node")), http.MethodGet, "/chain", "", nil).Header().Get("ETag")
+	if forked == etag {
+		t.Errorf("chains with different tips share the tag %s", etag)
+	}
+	if rec := serve(h, http.MethodGet, "/chain", "", http.Header{"If-None-Match": {forked}}); rec.Code != http.StatusOK {
+		t.Errorf("tag of another chain: status %d, want 200", rec.Code)
+	}
+}
+
+func TestRegisterNodes(t *testing.T) {
+	bc := newTestBlockchain(t)
+	h := NewHandler(bc, testAddress("node"), WithAdvertisedAddress("http://127.0.0.1:8000"))
+	register := func(nodes string) (got struct {
+		Added        []string `json:"added"`
+		AlreadyKnown []string `json:"already_known"`
+		Rejected     []string `json:"rejected"`
+	}) {
+		t.Helper()
+		rec := serve(h, http.MethodPost, "/nodes/register", `{"nodes": [`+nodes+`]}`, nil)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		decodeBody(t, rec, &got)
+		return got
+	}
+
+	first := register(`"http://10.0.0.1:5000", "localhost:5001"`)
+	if !reflect.DeepEqual(first.Added, []string{"http://10.0.0.1:5000", "localhost:5001"}) || len(first.AlreadyKnown) != 0 {
+		t.Errorf("first registration added %q, already knew %q", first.Added, first.AlreadyKnown)
+	}
+	second := register(`"http://localhost:5001", "http://10.0.0.2:5000", "http://10.0.0.1:5000", "127.0.0.1:8000", "ftp://10.0.0.3", "http://", "%zz"`)
+	if !reflect.DeepEqual(second.Added, []string{"http://10.0.0.2:5000"}) {
+		t.Errorf("second registration added %q", second.Added)
+	}
+	if !reflect.DeepEqual(second.AlreadyKnown, []string{"http://localhost:5001", "http://10.0.0.1:5000"}) {
+		t.Errorf("second registration already knew %q", second.AlreadyKnown)
+	}
+	if !reflect.DeepEqual(second.Rejected, []string{"127.0.0.1:8000", "ftp://10.0.0.3", "http://", "%zz"}) {
+		t.Errorf("second registration rejected %q", second.Rejected)
+	}
+
+	want := []string{"10.0.0.1:5000", "10.0.0.2:5000", "localhost:5001"}
+	got := bc.Nodes()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("registered nodes are %q, want %q", got, want)
+	}
+}
+
+func TestMineAsync(t *testing.T) {
+	bc := newTestBlockchain(t)
+	h := NewHandler(bc, testAddress("node"))
+
+	if rec := serve(h, http.MethodGet, "/mine?async=true", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", rec.Code)
+	}
+	rec := serve(h, http.MethodPost, "/mine?async=true", "", nil)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var started struct {
+		ID string `json:"id"`
+	}
+	decodeBody(t, rec, &started)
+
+	var job mineJob
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status != jobDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s", job.Status)
+		}
+		rec := serve(h, http.MethodGet, "/mine/status?id="+started.ID, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		decodeBody(t, rec, &job)
+		if job.Status == jobFailed {
+			t.Fatalf("job failed: %s", job.Error)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if job.ID != started.ID || job.Block == nil || job.Block.Index != 2 || bc.LastBlock().Index != 2 {
+		t.Errorf("done job %+v, chain of %d blocks", job, bc.LastBlock().Index)
+	}
+
+	if rec := serve(h, http.MethodGet, "/mine/status?id=unknown", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d, want 404", rec.Code)
+	}
+	if rec := serve(h, http.MethodGet, "/mine/status", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("missing id: status %d, want 400", rec.Code)
+	}
+}
+
+func TestMineAsyncStopsOnClose(t *testing.T) {
+	bc := newTestBlockchain(t, WithDifficulty(defaultDifficulty))
+	h := NewHandler(bc, testAddress("node"))
+	rec := serve(h, http.MethodPost, "/mine?async=true", "", nil)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var started struct {
+		ID string `json:"id"`
+	}
+	decodeBody(t, rec, &started)
+
+	closed := make(chan struct{})
+	go func() {
+		bc.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the mining job")
+	}
+	var job mineJob
+	decodeBody(t, serve(h, http.MethodGet, "/mine/status?id="+started.ID, "", nil), &job)
+	if job.Status != jobFailed {
+		t.Errorf("job %s once the blockchain is closed, want %s", job.Status, jobFailed)
+	}
+
+	// Jobs requested once closed fail right away.
+	decodeBody(t, serve(h, http.MethodPost, "/mine?async=true", "", nil), &started)
+	decodeBody(t, serve(h, http.MethodGet, "/mine/status?id="+started.ID, "", nil), &job)
+	if job.Status != jobFailed || job.Error != ErrClosed.Error() {
+		t.Errorf("job requested once closed is %s %q, want failed with %q", job.Status, job.Error, ErrClosed)
+	}
+}
+
+func TestMineJobsExpire(t *testing.T) {
+	h := &handler{blockchain: newTestBlockchain(t), nodeId: testAddress("node"), jobs: make(map[string]*mineJob)}
+	h.jobs["old"] = &mineJob{ID: "old", Status: jobDone, finished: time.Now().Add(-mineJobTTL - time.Minute)}
+	h.jobs["recent"] = &mineJob{ID: "recent", Status: jobFailed, finished: time.Now()}
+	h.jobs["running"] = &mineJob{ID: "running", Status: jobPending}
+
+	h.mineAsync(httptest.NewRequest(http.MethodPost, "/mine?async=true", nil))
+	h.jobsMu.Lock()
+	defer h.jobsMu.Unlock()
+	for id, want := range map[string]bool{"old": false, "recent": true, "running": true} {
+		if _, ok := h.jobs[id]; ok != want {
+			t.Errorf("job %s kept: %v, want %v", id, ok, want)
+		}
+	}
+}
+
+func TestAddTransaction(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	h := NewHandler(bc, testAddress("node"))
+
+	for _, body := range []string{"", "{", `{"sender": 1}`, `{"sender": "` + miner + `", "ammount": 1}`} {
+		req := httptest.NewRequest(http.MethodPost, "/transactions/new", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("body %q: status %d, want 400", body, rec.Code)
+		}
+	}
+	if n := len(bc.PendingTransactions()); n != 0 {
+		t.Fatalf("%d transactions pending after malformed requests", n)
+	}
+
+	rec := serve(h, http.MethodPost, "/transactions/new", `{"sender": "`+miner+`", "recipient": "`+testAddress("alice")+`", "amount": 1}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		ID string `json:"id"`
+	}
+	decodeBody(t, rec, &got)
+	if pending := bc.PendingTransactions(); len(pending) != 1 || pending[0].ID() != got.ID {
+		t.Errorf("pending transactions are %v, want only %s", pending, got.ID)
+	}
+}
+
+func TestExportImportEndpoints(t *testing.T) {
+	source := newTestBlockchain(t)
+	mineBlocks(t, source, 3, testAddress("miner"))
+	exported := serve(NewHandler(source, testAddress("source")), http.MethodGet, "/export", "", nil)
+	if exported.Code != http.StatusOK {
+		t.Fatalf("export: status %d: %s", exported.Code, exported.Body)
+	}
+
+	bc := newTestBlockchain(t)
+	h := NewHandler(bc, testAddress("node"))
+	if rec := serve(h, http.MethodPost, "/import", exported.Body.String(), nil); rec.Code != http.StatusOK {
+		t.Fatalf("import: status %d: %s", rec.Code, rec.Body)
+	}
+	if !reflect.DeepEqual(bc.Chain(), source.Chain()) {
+		t.Error("imported chain differs from the exported one")
+	}
+
+	before := bc.Chain()
+	for _, body := range []string{"{", `{"version": 99, "chain": []}`, `{"chain": []}`} {
+		if rec := serve(h, http.MethodPost, "/import", body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("import of %s: status %d, want 400", body, rec.Code)
+		}
+	}
+	if !reflect.DeepEqual(bc.Chain(), before) {
+		t.Error("chain changed after refused imports")
+	}
+}
+
+func TestDifficultyEndpoint(t *testing.T) {
+	bc := newTestBlockchain(t)
+	h := NewHandler(bc, testAddress("node"), WithAPIKey("secret"))
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+	difficulty := func() int {
+		var got struct {
+			Difficulty int `json:"difficulty"`
+		}
+		decodeBody(t, serve(h, http.MethodGet, "/difficulty", "", nil), &got)
+		return got.Difficulty
+	}
+
+	if got := difficulty(); got != 1 {
+		t.Fatalf("difficulty is %d, want 1", got)
+	}
+	mineBlocks(t, bc, 1, testAddress("miner"))
+	if rec := serve(h, http.MethodPut, "/difficulty", `{"difficulty": 2}`, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("PUT without the key: status %d, want 401", rec.Code)
+	}
+	if rec := serve(h, http.MethodPut, "/difficulty", `{"difficulty": 2}`, auth); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := difficulty(); got != 2 {
+		t.Fatalf("difficulty is %d after setting it to 2", got)
+	}
+	for _, body := range []string{`{"difficulty": 0}`, `{"difficulty": 65}`, `{"difficulty": "2"}`} {
+		if rec := serve(h, http.MethodPut, "/difficulty", body, auth); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: status %d, want 400", body, rec.Code)
+		}
+	}
+
+	// Blocks mined before the change still validate.
+	mineBlocks(t, bc, 1, testAddress("miner"))
+	if err := bc.ValidateLocalChain(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateTransactionEndpoint(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t, WithMaxTxData(4))
+	mineBlocks(t, bc, 2, miner)
+	h := NewHandler(bc, testAddress("node"))
+	tx := func(fields string) string {
+		return `{"sender": "` + miner + `", "recipient": "` + alice + `", ` + fields + `}`
+	}
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		reason string
+	}{
+		{"valid", tx(`"amount": 1, "fee": 1`), ""},
+		{"insufficient funds", tx(`"amount": 2, "fee": 1`), "insufficient funds"},
+		{"negative amount", tx(`"amount": -1`), "amount must be positive"},
+		{"negative fee", tx(`"amount": 1, "fee": -1`), "fee must not be negative"},
+		{"too much data", tx(`"amount": 1, "data": "aGVsbG8="`), "data is 5 bytes"},
+		{"minting", `{"sender": "0", "recipient": "` + alice + `", "amount": 1}`, "only miners can mint"},
+		{"invalid sender", `{"sender": "nobody", "recipient": "` + alice + `", "amount": 1}`, "sender"},
+		{"invalid recipient", `{"sender": "` + miner + `", "recipient": "nobody", "amount": 1}`, "recipient"},
+	} {
+		rec := serve(h, http.MethodPost, "/transactions/validate", tc.body, nil)
+		var got struct {
+			Valid  bool   `json:"valid"`
+			Reason string `json:"reason"`
+		}
+		decodeBody(t, rec, &got)
+		if rec.Code != http.StatusOK || got.Valid != (tc.reason == "") || !strings.Contains(got.Reason, tc.reason) {
+			t.Errorf("%s: status %d, valid %v, reason %q, want reason %q", tc.name, rec.Code, got.Valid, got.Reason, tc.reason)
+		}
+	}
+	if n := len(bc.PendingTransactions()); n != 0 {
+		t.Errorf("%d transactions pending after validating them", n)
+	}
+	if rec := serve(h, http.MethodPost, "/transactions/validate", "{", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed body: status %d, want 400", rec.Code)
+	}
+}
+
+func TestChainHead(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+
+	rec := serve(h, http.MethodHead, "/chain", "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Chain-Length") != "3" || rec.Body.Len() != 0 {
+		t.Errorf("HEAD answered %d with length %q and %d bytes, want 200 with length 3 and no body", rec.Code, rec.Header().Get("X-Chain-Length"), rec.Body.Len())
+	}
+	if rec := serve(h, http.MethodGet, "/chain", "", nil); rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Errorf("GET answered %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if rec := serve(h, http.MethodPost, "/chain", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
+
+func TestAddTransactionsBatch(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	h := NewHandler(bc, testAddress("node"))
+	tx := func(amount string) string {
+		return `{"sender": "` + miner + `", "recipient": "` + alice + `", "amount": ` + amount + `}`
+	}
+
+	// The second transfer of 1 coin leaves nothing for the third one.
+	batch := "[" + strings.Join([]string{tx("1"), tx("-1"), `{"ammount": 1}`, tx("1"), tx("1")}, ",") + "]"
+	rec := serve(h, http.MethodPost, "/transactions/batch", batch, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var results []batchResult
+	decodeBody(t, rec, &results)
+	var accepted []int
+	for i, result := range results {
+		if result.Index != i || result.Accepted != (result.ID != "") || result.Accepted == (result.Reason != "") {
+			t.Errorf("inconsistent result %+v", result)
+		}
+		if result.Accepted {
+			accepted = append(accepted, i)
+		}
+	}
+	if !reflect.DeepEqual(accepted, []int{0, 3}) {
+		t.Errorf("accepted %v, want [0 3]", accepted)
+	}
+	if !strings.Contains(results[4].Reason, "insufficient funds") {
+		t.Errorf("last transaction refused with %q, want insufficient funds", results[4].Reason)
+	}
+	if n := len(bc.PendingTransactions()); n != 2 {
+		t.Errorf("%d transactions pending, want 2", n)
+	}
+
+	if rec := serve(h, http.MethodPost, "/transactions/batch", tx("1"), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("batch that isn't an array: status %d, want 400", rec.Code)
+	}
+}
+
+func TestBlockByHash(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+
+	for _, block := range bc.Chain() {
+		rec := serve(h, http.MethodGet, "/block/hash/"+bc.BlockHash(block), "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("block %d: status %d", block.Index, rec.Code)
+		}
+		var got Block
+		decodeBody(t, rec, &got)
+		if got.Index != block.Index || bc.BlockHash(got) != bc.BlockHash(block) {
+			t.Errorf("block %d: got block %d", block.Index, got.Index)
+		}
+	}
+	if rec := serve(h, http.MethodGet, "/block/hash/"+strings.Repeat("0", 64), "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown hash: status %d, want 404", rec.Code)
+	}
+}
+
+func TestWithoutMining(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	// The node id of a node that doesn't mine needn't be an address.
+	h := NewHandler(bc, "listener", WithoutMining())
+
+	for _, target := range []string{"/mine", "/mine?async=true"} {
+		if rec := serve(h, http.MethodGet, target, "", nil); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", target, rec.Code)
+		}
+	}
+	if n := bc.Len(); n != 3 {
+		t.Errorf("chain grew to %d blocks", n)
+	}
+
+	// Everything else still works.
+	if rec := serve(h, http.MethodGet, "/chain", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("chain: status %d", rec.Code)
+	}
+	rec := serve(h, http.MethodPost, "/transactions/new", `{"sender": "`+miner+`", "recipient": "`+testAddress("alice")+`", "amount": 1}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("new transaction: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestWithoutResolveBeforeMining(t *testing.T) {
+	var requests int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer peer.Close()
+
+	for _, tc := range []struct {
+		opts    []HandlerOption
+		contact bool
+	}{
+		{nil, true},
+		{[]HandlerOption{WithoutResolveBeforeMining()}, false},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		bc := newTestBlockchain(t)
+		bc.RegisterNode(peer.URL)
+		h := NewHandler(bc, testAddress("node"), tc.opts...)
+		if rec := serve(h, http.MethodGet, "/mine", "", nil); rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		if n := bc.Len(); n != 2 {
+			t.Errorf("chain has %d blocks after mining, want 2", n)
+		}
+		if contacted := atomic.LoadInt32(&requests) > 0; contacted != tc.contact {
+			t.Errorf("with %d options, peer contacted: %t, want %t", len(tc.opts), contacted, tc.contact)
+		}
+	}
+}
+
+func TestGenesisEndpoint(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+
+	rec := serve(h, http.MethodGet, "/genesis", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var got HashedBlock
+	decodeBody(t, rec, &got)
+	if got.Index != 1 || got.Proof != 100 || got.PreviousHash != "1" {
+		t.Errorf("genesis is block %d with proof %d after %q, want block 1 with proof 100 after \"1\"", got.Index, got.Proof, got.PreviousHash)
+	}
+	if got.Hash != bc.GenesisHash() || got.Hash != bc.BlockHash(bc.Chain()[0]) {
+		t.Errorf("genesis hash is %s, want %s", got.Hash, bc.GenesisHash())
+	}
+
+	if rec := serve(h, http.MethodPost, "/genesis", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+	bc.mu.Lock()
+	bc.chain, bc.hashes = nil, nil
+	bc.mu.Unlock()
+	if rec := serve(h, http.MethodGet, "/genesis", "", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("empty chain: status %d, want 503", rec.Code)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	miner := testAddress("miner")
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 3, miner)
+	srv := httptest.NewServer(NewHandler(peer, testAddress("peer")))
+	defer srv.Close()
+
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 1, miner)
+	bc.RegisterNode(srv.URL)
+	if _, err := bc.NewTransaction(Transaction{Sender: miner, Recipient: testAddress("alice"), Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(bc, testAddress("node"))
+	status := func() (got NodeStatus) {
+		t.Helper()
+		rec := serve(h, http.MethodGet, "/status", "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		decodeBody(t, rec, &got)
+		return got
+	}
+
+	if got, want := status(), (NodeStatus{Height: 2, Peers: 1, Mempool: 1}); got != want {
+		t.Errorf("before resolving: %+v, want %+v", got, want)
+	}
+	// The resolve that finds a longer chain adopts it, the next one finds
+	// no longer chain.
+	if !bc.ResolveConflicts() {
+		t.Fatal("longer chain of the peer not adopted")
+	}
+	if got := status(); got.Synced || got.Height != 4 {
+		t.Errorf("after adopting the peer's chain: %+v, want height 4 and not synced", got)
+	}
+	bc.ResolveConflicts()
+	if got := status(); !got.Synced {
+		t.Errorf("after finding no longer chain: %+v, want synced", got)
+	}
+	mineBlocks(t, peer, 1, miner)
+	if !bc.ResolveConflicts() {
+		t.Fatal("new block of the peer not adopted")
+	}
+	if got := bc.Status(); got.Synced || got.Height != 5 {
+		t.Errorf("after the peer mined again: %+v, want height 5 and not synced", got)
+	}
+	if rec := serve(h, http.MethodPost, "/status", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
+
+func TestMineEstimate(t *testing.T) {
+	bc := newTestBlockchain(t)
+	h := NewHandler(bc, testAddress("node"))
+	estimate := func(target string) (got MiningEstimate) {
+		t.Helper()
+		rec := serve(h, http.MethodGet, target, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", target, rec.Code, rec.Body)
+		}
+		decodeBody(t, rec, &got)
+		return got
+	}
+
+	if got := estimate("/mine/estimate"); got.Difficulty != 1 || got.ExpectedHashes != 16 {
+		t.Errorf("estimate at the current difficulty: %+v, want difficulty 1 and 16 hashes", got)
+	}
+	previous := 0.0
+	for _, difficulty := range []string{"2", "4", "6"} {
+		got := estimate("/mine/estimate?difficulty=" + difficulty)
+		if got.HashesPerSecond <= 0 || got.ExpectedSeconds <= previous {
+			t.Errorf("difficulty %s: %+v, want a positive estimate above %v seconds", difficulty, got, previous)
+		}
+		previous = got.ExpectedSeconds
+	}
+	if n := bc.Len(); n != 1 {
+		t.Errorf("estimating grew the chain to %d blocks", n)
+	}
+
+	for _, difficulty := range []string{"0", "65", "x"} {
+		if rec := serve(h, http.MethodGet, "/mine/estimate?difficulty="+difficulty, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("difficulty %s: status %d, want 400", difficulty, rec.Code)
+		}
+	}
+}
+
+func TestMineTimeout(t *testing.T) {
+	// Finding a proof at this difficulty takes far longer than the test.
+	bc := newTestBlockchain(t, WithDifficulty(12))
+	h := NewHandler(bc, testAddress("node"), WithMineTimeout(50*time.Millisecond), WithoutResolveBeforeMining())
+
+	start := time.Now()
+	rec := serve(h, http.MethodGet, "/mine", "", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d: %s, want 503", rec.Code, rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("mining gave up after %v", elapsed)
+	}
+	if n := bc.Len(); n != 1 {
+		t.Errorf("chain grew to %d blocks", n)
+	}
+
+	// The deadline only cuts mining that takes too long.
+	bc.SetDifficulty(1)
+	if rec := serve(h, http.MethodGet, "/mine", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("easy block: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	bc := newTestBlockchain(t)
+	h := NewHandler(bc, testAddress("node"))
+
+	rec := serve(h, http.MethodGet, "/info", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var got nodeInfo
+	decodeBody(t, rec, &got)
+	want := nodeInfo{NodeID: testAddress("node"), Version: Version, Difficulty: 1, GenesisHash: bc.GenesisHash()}
+	if got != want {
+		t.Errorf("info is %+v, want %+v", got, want)
+	}
+	if rec := serve(h, http.MethodPost, "/info", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
+
+func TestNewHandlerValidatesRewardAddresses(t *testing.T) {
+	bc := newTestBlockchain(t)
+	for _, tc := range []struct {
+		name   string
+		nodeID string
+		opts   []HandlerOption
+	}{
+		{"empty node id", "", nil},
+		{"node id that isn't an address", "node-1", nil},
+		{"invalid address in the split", "", []HandlerOption{WithRewardSplit(map[string]int{testAddress("a"): 1, "b": 1})}},
+		{"weight of zero", "", []HandlerOption{WithRewardSplit(map[string]int{testAddress("a"): 0})}},
+		{"empty split", "", []HandlerOption{WithRewardSplit(map[string]int{})}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: NewHandler didn't panic", tc.name)
+				}
+			}()
+			NewHandler(bc, tc.nodeID, tc.opts...)
+		}()
+	}
+
+	// The node id isn't paid when the rewards are split or nothing is mined.
+	NewHandler(bc, "", WithRewardSplit(map[string]int{testAddress("a"): 1}))
+	NewHandler(bc, "", WithoutMining())
+}
+
+func TestValidateChainEndpoint(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+	validate := func() (got struct {
+		Valid    bool   `json:"valid"`
+		BadIndex int64  `json:"bad_index"`
+		Reason   string `json:"reason"`
+	}) {
+		t.Helper()
+		decodeBody(t, serve(h, http.MethodGet, "/chain/validate", "", nil), &got)
+		return got
+	}
+
+	if got := validate(); !got.Valid || got.Reason != "" {
+		t.Fatalf("valid chain reported as %+v", got)
+	}
+	// The chain on disk or in memory got corrupted.
+	bc.mu.Lock()
+	bc.chain[2].Transactions[0].Amount = 100
+	bc.mu.Unlock()
+	if got := validate(); got.Valid || got.BadIndex != 3 || got.Reason == "" {
+		t.Errorf("corrupted chain reported as %+v, want block 3 invalid", got)
+	}
+	if rec := serve(h, http.MethodPost, "/chain/validate", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
+
+func TestChainListsHashes(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, testAddress("miner"))
+	var got struct {
+		Chain  []HashedBlock `json:"chain"`
+		Length int           `json:"length"`
+	}
+	decodeBody(t, serve(NewHandler(bc, testAddress("node")), http.MethodGet, "/chain", "", nil), &got)
+	if got.Length != 4 || len(got.Chain) != 4 {
+		t.Fatalf("chain of %d blocks with a length of %d, want 4", len(got.Chain), got.Length)
+	}
+	for i, block := range got.Chain {
+		if want := bc.BlockHash(block.Block); block.Hash != want {
+			t.Errorf("block %d listed with hash %s, want %s", i+1, block.Hash, want)
+		}
+		if i+1 < len(got.Chain) && got.Chain[i+1].PreviousHash != block.Hash {
+			t.Errorf("block %d doesn't link to the hash listed for block %d", i+2, i+1)
+		}
+		if want := len(block.Hash) - len(strings.TrimLeft(block.Hash, "0")); block.LeadingZeros != want {
+			t.Errorf("block %d listed with %d leading zeros, want %d", i+1, block.LeadingZeros, want)
+		}
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 1, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+
+	compact := serve(h, http.MethodGet, "/chain", "", nil).Body.String()
+	pretty := serve(h, http.MethodGet, "/chain?pretty=true", "", nil).Body.String()
+	if strings.Count(compact, "\n") != 1 {
+		t.Errorf("compact chain spans several lines: %q", compact)
+	}
+	if !strings.Contains(pretty, "\n  \"chain\": [\n    {") {
+		t.Errorf("pretty chain isn't indented: %q", pretty)
+	}
+	var a, b interface{}
+	if err := json.Unmarshal([]byte(compact), &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(pretty), &b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Error("pretty and compact chains differ")
+	}
+	// Errors are formatted the same way.
+	if body := serve(h, http.MethodGet, "/block/hash/ff?pretty=true", "", nil).Body.String(); !strings.HasPrefix(body, `"`) {
+		t.Errorf("error body %q isn't a JSON string", body)
+	}
+}
+
+func TestMiningRewardsNodeID(t *testing.T) {
+	nodeID := testAddress("node")
+	bc := newTestBlockchain(t)
+	h := NewHandler(bc, nodeID)
+	for i := 0; i < 2; i++ {
+		if rec := serve(h, http.MethodGet, "/mine", "", nil); rec.Code != http.StatusOK {
+			t.Fatalf("mine: status %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	for _, block := range bc.Chain()[1:] {
+		reward := block.Transactions[len(block.Transactions)-1]
+		if reward.Sender != "0" || reward.Recipient != nodeID {
+			t.Errorf("block %d rewards %s, want %s", block.Index, reward.Recipient, nodeID)
+		}
+	}
+	var balance struct {
+		Address string `json:"address"`
+		Balance int64  `json:"balance"`
+	}
+	decodeBody(t, serve(h, http.MethodGet, "/balance/"+nodeID, "", nil), &balance)
+	if balance.Address != nodeID || balance.Balance != 2 {
+		t.Errorf("balance is %+v, want 2 for %s", balance, nodeID)
+	}
+	var info nodeInfo
+	decodeBody(t, serve(h, http.MethodGet, "/info", "", nil), &info)
+	if info.NodeID != nodeID {
+		t.Errorf("/info reports node %s, want %s", info.NodeID, nodeID)
+	}
+}
+
+func TestBlocksRange(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 4, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+
+	for _, tc := range []struct {
+		query string
+		want  []int64
+	}{
+		{"", []int64{1, 2, 3, 4, 5}},
+		{"?from=2&to=3", []int64{2, 3}},
+		{"?from=4", []int64{4, 5}},
+		{"?to=1", []int64{1}},
+		{"?from=3&to=99", []int64{3, 4, 5}},
+		{"?from=6", []int64{}},
+	} {
+		var got struct {
+			Blocks []HashedBlock `json:"blocks"`
+			Length int64         `json:"length"`
+		}
+		decodeBody(t, serve(h, http.MethodGet, "/blocks"+tc.query, "", nil), &got)
+		indexes := []int64{}
+		for _, block := range got.Blocks {
+			indexes = append(indexes, block.Index)
+			if block.Hash != bc.BlockHash(block.Block) {
+				t.Errorf("%s: block %d listed with the wrong hash", tc.query, block.Index)
+			}
+		}
+		if !reflect.DeepEqual(indexes, tc.want) || got.Length != 5 {
+			t.Errorf("%s: blocks %v of %d, want %v of 5", tc.query, indexes, got.Length, tc.want)
+		}
+	}
+	for _, query := range []string{"?from=0", "?to=-1", "?from=x", "?from=3&to=2"} {
+		if rec := serve(h, http.MethodGet, "/blocks"+query, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+	// With both bounds invalid, from is reported.
+	for i := 0; i < 10; i++ {
+		rec := serve(h, http.MethodGet, "/blocks?from=x&to=y", "", nil)
+		if !strings.Contains(rec.Body.String(), `invalid from \"x\"`) {
+			t.Fatalf("both bounds invalid: %s, want from reported", rec.Body)
+		}
+	}
+}
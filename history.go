@@ -0,0 +1,41 @@
+package gochain
+
+// AddressTransaction is a mined transaction touching an address, with the
+// block holding it.
+type AddressTransaction struct {
+	ID          string      `json:"id"`
+	BlockIndex  int64       `json:"block_index"`
+	Transaction Transaction `json:"transaction"`
+	// Change is what the transaction adds to the balance of the address,
+	// negative when the address spent more than it received.
+	Change int64 `json:"change"`
+}
+
+// AddressHistory returns the mined transactions that address sent or
+// received, in chain order, skipping the first offset ones and returning at
+// most limit. It also returns how many transactions touch the address in
+// total, so that clients can page through them.
+func (bc *Blockchain) AddressHistory(address string, limit, offset int) ([]AddressTransaction, int) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	history := make([]AddressTransaction, 0)
+	total := 0
+	for _, block := range bc.chain {
+		for _, tx := range block.Transactions {
+			if !tx.touches(address) {
+				continue
+			}
+			if total >= offset && len(history) < limit {
+				history = append(history, AddressTransaction{
+					ID:          tx.ID(),
+					BlockIndex:  block.Index,
+					Transaction: tx.copy(),
+					Change:      tx.balanceChange(address),
+				})
+			}
+			total++
+		}
+	}
+	return history, total
+}
@@ -0,0 +1,81 @@
+package gochain
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestAddressHistory(t *testing.T) {
+	miner, alice, bob := testAddress("miner"), testAddress("alice"), testAddress("bob")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	received := Transaction{Sender: miner, Recipient: alice, Amount: 2}
+	if _, err := bc.NewTransaction(received); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, miner)
+	sent := Transaction{Sender: alice, Recipient: bob, Amount: 1, Fee: 1}
+	if _, err := bc.NewTransaction(sent); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, miner)
+
+	history, total := bc.AddressHistory(alice, 10, 0)
+	if total != 2 || len(history) != 2 {
+		t.Fatalf("alice has %d of %d transactions, want 2", len(history), total)
+	}
+	for i, want := range []AddressTransaction{
+		{ID: received.ID(), BlockIndex: 4, Transaction: received, Change: 2},
+		{ID: sent.ID(), BlockIndex: 5, Transaction: sent, Change: -2},
+	} {
+		got := history[i]
+		if got.ID != want.ID || got.BlockIndex != want.BlockIndex || got.Change != want.Change || got.Transaction.ID() != want.ID {
+			t.Errorf("transaction %d is %+v, want %+v", i, got, want)
+		}
+	}
+	// The miner's rewards count too.
+	if _, total := bc.AddressHistory(miner, 10, 0); total != 5 {
+		t.Errorf("miner has %d transactions, want 4 rewards and 1 payment", total)
+	}
+
+	h := NewHandler(bc, testAddress("node"))
+	for _, tc := range []struct {
+		query string
+		ids   []string
+	}{
+		{"", []string{received.ID(), sent.ID()}},
+		{"?limit=1", []string{received.ID()}},
+		{"?limit=1&offset=1", []string{sent.ID()}},
+		{"?offset=2", nil},
+		{"?offset=5", nil},
+	} {
+		rec := serve(h, http.MethodGet, "/address/"+alice+"/transactions"+tc.query, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tc.query, rec.Code, rec.Body)
+		}
+		var got struct {
+			Transactions []AddressTransaction `json:"transactions"`
+			Total        int                  `json:"total"`
+		}
+		decodeBody(t, rec, &got)
+		var ids []string
+		for _, tx := range got.Transactions {
+			ids = append(ids, tx.ID)
+		}
+		if got.Total != 2 || !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("%q: got %v of %d, want %v of 2", tc.query, ids, got.Total, tc.ids)
+		}
+	}
+
+	for target, code := range map[string]int{
+		"/address/" + alice + "/transactions?limit=0":   http.StatusBadRequest,
+		"/address/" + alice + "/transactions?offset=-1": http.StatusBadRequest,
+		"/address/alice/transactions":                   http.StatusBadRequest,
+		"/address/" + alice:                             http.StatusNotFound,
+	} {
+		if rec := serve(h, http.MethodGet, target, "", nil); rec.Code != code {
+			t.Errorf("%s: status %d, want %d", target, rec.Code, code)
+		}
+	}
+}
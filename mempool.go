@@ -0,0 +1,125 @@
+package gochain
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// MempoolPolicy is the order in which pending transactions go into blocks,
+// which matters once blocks are full.
+type MempoolPolicy int
+
+const (
+	// MempoolFIFO mines the transactions in the order they entered the
+	// mempool. Transactions put back in the mempool by a reorg come last.
+	MempoolFIFO MempoolPolicy = iota
+	// MempoolHighestFee mines the transactions paying the highest fees
+	// first, the oldest first among equal fees.
+	MempoolHighestFee
+	// MempoolOldestFirst mines the transactions in the order they were
+	// received. Those put back by a reorg or an import, whose receipt isn't
+	// known, come first.
+	MempoolOldestFirst
+)
+
+// WithMempoolPolicy sets the order in which pending transactions go into
+// blocks. The default is MempoolFIFO.
+func WithMempoolPolicy(policy MempoolPolicy) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.mempoolPolicy = policy
+	}
+}
+
+// orderedMempool returns the indexes of the pending transactions in the
+// order of the mempool policy.
+func (bc *Blockchain) orderedMempool() []int {
+	order := make([]int, len(bc.transactions))
+	for i := range order {
+		order[i] = i
+	}
+	switch bc.mempoolPolicy {
+	case MempoolHighestFee:
+		sort.SliceStable(order, func(i, j int) bool {
+			return bc.transactions[order[i]].Fee > bc.transactions[order[j]].Fee
+		})
+	case MempoolOldestFirst:
+		sort.SliceStable(order, func(i, j int) bool {
+			// Unknown receipts are the zero time, which sorts first.
+			return bc.received[bc.transactions[order[i]].ID()].Before(bc.received[bc.transactions[order[j]].ID()])
+		})
+	}
+	return order
+}
+
+// revalidatePending replaces the mempool with the transactions of pending
+// that are still valid on top of the chain, checked in order like submitted
+// ones, so that a transaction the chain made invalid, like a double spend
+// mined by another node, doesn't end up in a block. bc.mu must be held.
+func (bc *Blockchain) revalidatePending(pending []Transaction) {
+	bc.transactions = nil
+	for _, tx := range pending {
+		if err := bc.validateTransaction(tx); err != nil {
+			log.Printf("dropping pending transaction %s: %v", tx.ID(), err)
+			delete(bc.received, tx.ID())
+			continue
+		}
+		bc.transactions = append(bc.transactions, tx)
+	}
+}
+
+// PruneExpired drops the pending transactions that were added to the mempool
+// more than maxAge ago and returns how many were dropped. Transactions put
+// back in the mempool by a reorg or an import count as added when they are
+// first seen by PruneExpired.
+func (bc *Blockchain) PruneExpired(maxAge time.Duration) int {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	now := time.Now()
+	pending := make(map[string]bool, len(bc.transactions))
+	kept := make([]Transaction, 0, len(bc.transactions))
+	for _, tx := range bc.transactions {
+		id := tx.ID()
+		received, ok := bc.received[id]
+		if !ok {
+			received = now
+			bc.received[id] = now
+		}
+		if now.Sub(received) > maxAge {
+			log.Printf("dropping expired transaction %s", id)
+			continue
+		}
+		pending[id] = true
+		kept = append(kept, tx)
+	}
+	// Forget the transactions that left the mempool without being mined,
+	// like the expired and the evicted ones.
+	for id := range bc.received {
+		if !pending[id] {
+			delete(bc.received, id)
+		}
+	}
+
+	pruned := len(bc.transactions) - len(kept)
+	bc.transactions = kept
+	return pruned
+}
+
+// CancelTransaction drops the pending transaction with the given id from the
+// mempool. It returns ErrNotFound if no pending transaction has that id,
+// either because it was already mined or because it was never submitted.
+func (bc *Blockchain) CancelTransaction(id string) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	for i, tx := range bc.transactions {
+		if tx.ID() == id {
+			bc.transactions = append(bc.transactions[:i:i], bc.transactions[i+1:]...)
+			delete(bc.received, id)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: pending transaction %s", ErrNotFound, id)
+}
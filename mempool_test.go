@@ -0,0 +1,152 @@
+package gochain
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPruneMempool(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, miner)
+	h := NewHandler(bc, testAddress("node"))
+	old := Transaction{Sender: miner, Recipient: alice, Amount: 1}
+	recent := Transaction{Sender: miner, Recipient: alice, Amount: 2}
+	for _, tx := range []Transaction{old, recent} {
+		if _, err := bc.NewTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bc.mu.Lock()
+	bc.received[old.ID()] = time.Now().Add(-2 * time.Hour)
+	bc.mu.Unlock()
+
+	prune := func(body string) (got struct {
+		Pruned  int `json:"pruned"`
+		Pending int `json:"pending"`
+	}) {
+		t.Helper()
+		rec := serve(h, http.MethodPost, "/mempool/prune", body, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: status %d: %s", body, rec.Code, rec.Body)
+		}
+		decodeBody(t, rec, &got)
+		return got
+	}
+
+	// Without a body, transactions older than an hour go.
+	if got := prune(""); got.Pruned != 1 || got.Pending != 1 {
+		t.Errorf("pruned %d with %d left, want 1 and 1", got.Pruned, got.Pending)
+	}
+	if got := bc.PendingTransactions(); !reflect.DeepEqual(got, []Transaction{recent}) {
+		t.Errorf("pending transactions are %v, want only the recent one", got)
+	}
+	if got := prune(`{"max_age_seconds": 3600}`); got.Pruned != 0 {
+		t.Errorf("pruned %d transactions younger than the maximum age", got.Pruned)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if got := prune(`{"max_age_seconds": 0}`); got.Pruned != 1 || got.Pending != 0 {
+		t.Errorf("pruned %d with %d left, want everything pruned", got.Pruned, got.Pending)
+	}
+
+	for _, body := range []string{`{"max_age_seconds": -1}`, `{"max_age_seconds": "1"}`} {
+		if rec := serve(h, http.MethodPost, "/mempool/prune", body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+	if rec := serve(h, http.MethodGet, "/mempool/prune", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", rec.Code)
+	}
+}
+
+func TestCancelTransaction(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	h := NewHandler(bc, testAddress("node"), WithAPIKey("secret"))
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+	mined := Transaction{Sender: miner, Recipient: alice, Amount: 1}
+	pending := Transaction{Sender: miner, Recipient: alice, Amount: 2}
+	if _, err := bc.NewTransaction(mined); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, miner)
+	if _, err := bc.NewTransaction(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := serve(h, http.MethodDelete, "/transactions/"+pending.ID(), "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without the API key: status %d, want 401", rec.Code)
+	}
+	if rec := serve(h, http.MethodGet, "/transactions/"+pending.ID(), "", auth); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", rec.Code)
+	}
+	rec := serve(h, http.MethodDelete, "/transactions/"+pending.ID(), "", auth)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if n := len(bc.PendingTransactions()); n != 0 {
+		t.Errorf("%d transactions pending after cancelling", n)
+	}
+
+	for _, id := range []string{pending.ID(), mined.ID(), "unknown"} {
+		if rec := serve(h, http.MethodDelete, "/transactions/"+id, "", auth); rec.Code != http.StatusNotFound {
+			t.Errorf("cancelling %s: status %d, want 404", id, rec.Code)
+		}
+	}
+	if err := bc.CancelTransaction(mined.ID()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("cancelling a mined transaction: %v, want ErrNotFound", err)
+	}
+}
+
+func TestMempoolPolicy(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	// Transactions in the order they enter the mempool, with their fee and
+	// how long ago they were received.
+	txs := []struct {
+		tx  Transaction
+		age time.Duration
+	}{
+		{Transaction{Sender: miner, Recipient: alice, Amount: 1, Fee: 1}, time.Minute},
+		{Transaction{Sender: miner, Recipient: alice, Amount: 2, Fee: 3}, time.Hour},
+		{Transaction{Sender: miner, Recipient: alice, Amount: 3, Fee: 2}, time.Second},
+		{Transaction{Sender: miner, Recipient: alice, Amount: 4, Fee: 3}, 2 * time.Hour},
+	}
+
+	for _, tc := range []struct {
+		policy MempoolPolicy
+		want   []int
+	}{
+		{MempoolFIFO, []int{0, 1, 2, 3}},
+		{MempoolHighestFee, []int{1, 3, 2, 0}},
+		{MempoolOldestFirst, []int{3, 1, 0, 2}},
+	} {
+		bc := newTestBlockchain(t, WithMempoolPolicy(tc.policy), WithMaxTxPerBlock(3))
+		mineBlocks(t, bc, 25, miner)
+		now := time.Now()
+		for _, tx := range txs {
+			if _, err := bc.NewTransaction(tx.tx); err != nil {
+				t.Fatal(err)
+			}
+			bc.mu.Lock()
+			bc.received[tx.tx.ID()] = now.Add(-tx.age)
+			bc.mu.Unlock()
+		}
+
+		var want []Transaction
+		for _, i := range tc.want {
+			want = append(want, txs[i].tx)
+		}
+		if got := bc.SelectTransactions(); !reflect.DeepEqual(got, want[:3]) {
+			t.Errorf("policy %d selected %v, want %v", tc.policy, got, want[:3])
+		}
+		// The transaction left out is mined next.
+		mineBlocks(t, bc, 1, miner)
+		if got := bc.PendingTransactions(); !reflect.DeepEqual(got, want[3:]) {
+			t.Errorf("policy %d left %v pending, want %v", tc.policy, got, want[3:])
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package gochain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// The Merkle root of a block is computed over the ids of its transactions:
+// each level hashes the concatenation of pairs of hashes of the level below,
+// pairing the last hash with itself when a level has an odd number of them.
+// A Merkle proof lists the hashes paired with the transaction's on the way
+// up, which is enough to recompute the root without the other transactions.
+
+// MerkleStep is a hash paired with the one being verified, and on which side
+// it goes.
+type MerkleStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// MerkleProof shows that a transaction is part of a block. Header is the
+// header of the block, which commits to the Merkle root, so that the proof
+// can be checked against a block hash known from elsewhere, e.g. the chain
+// of headers of a light client. Blocks older than version 2 have no header
+// committing to their Merkle root, and their proofs have no Header.
+type MerkleProof struct {
+	TxID       string       `json:"tx_id"`
+	BlockIndex int64        `json:"block_index"`
+	BlockHash  string       `json:"block_hash"`
+	MerkleRoot string       `json:"merkle_root"`
+	Siblings   []MerkleStep `json:"siblings"`
+	Header     *BlockHeader `json:"header,omitempty"`
+}
+
+// BlockVersion is the version of the blocks mined by this node. Blocks of
+// version 1, which have no version field, hash their transactions directly.
+// From version 2 on, they hash their header, see BlockHeader, which holds
+// the Merkle root of the transactions instead. A chain can't go back to an
+// older version once a block of a newer one is in it.
+const BlockVersion = 2
+
+// BlockHeader is what the hash of a block of version 2 or later covers: the
+// fields of the block, with the transactions replaced by their number and
+// their Merkle root. The number is there because duplicating the last
+// transaction of a block wouldn't change the root.
+type BlockHeader struct {
+	Index          int64  `json:"index"`
+	Timestamp      int64  `json:"timestamp"`
+	TxCount        int64  `json:"tx_count"`
+	MerkleRoot     string `json:"merkle_root"`
+	Proof          int64  `json:"proof"`
+	PreviousHash   string `json:"previous_hash"`
+	Difficulty     int    `json:"difficulty"`
+	Version        int    `json:"version"`
+	MinerPubKey    []byte `json:"miner_pub_key,omitempty"`
+	MinerSignature []byte `json:"miner_signature,omitempty"`
+}
+
+// Header returns the header of block. It is only what the hash covers for
+// blocks of version 2 or later.
+func (block Block) Header() BlockHeader {
+	return BlockHeader{
+		Index:          block.Index,
+		Timestamp:      block.Timestamp,
+		TxCount:        int64(len(block.Transactions)),
+		MerkleRoot:     block.MerkleRoot,
+		Proof:          block.Proof,
+		PreviousHash:   block.PreviousHash,
+		Difficulty:     block.Difficulty,
+		Version:        block.Version,
+		MinerPubKey:    block.MinerPubKey,
+		MinerSignature: block.MinerSignature,
+	}
+}
+
+// Hash returns the hash of the block with this header, computed with hasher,
+// or with SHA-256, the default of the nodes, if hasher is nil.
+func (header BlockHeader) Hash(hasher Hasher) string {
+	if hasher == nil {
+		hasher = ComputeHashSha256
+	}
+	return hashHeader(header.bytes(), header.MinerSignature, hasher)
+}
+
+// bytes returns the header as it is signed and hashed, with the encoding of
+// blockHeader:
+//
+//	index
+//	timestamp
+//	number of transactions
+//	Merkle root
+//	proof
+//	previous hash
+//	difficulty
+//	version
+//	miner public key, if the block is signed
+func (header BlockHeader) bytes() []byte {
+	var buf bytes.Buffer
+	writeInt64(&buf, header.Index)
+	writeInt64(&buf, header.Timestamp)
+	writeInt64(&buf, header.TxCount)
+	writeString(&buf, header.MerkleRoot)
+	writeInt64(&buf, header.Proof)
+	writeString(&buf, header.PreviousHash)
+	writeInt64(&buf, int64(header.Difficulty))
+	writeInt64(&buf, int64(header.Version))
+	if len(header.MinerPubKey) > 0 || len(header.MinerSignature) > 0 {
+		writeString(&buf, string(header.MinerPubKey))
+	}
+	return buf.Bytes()
+}
+
+// checkBlockVersion checks the version of block, which follows parent, and
+// for blocks of version 2 or later that their Merkle root is the root of
+// their transactions.
+func checkBlockVersion(block Block, parent *Block) error {
+	if block.Version < 0 || block.Version > BlockVersion {
+		return fmt.Errorf("block version %d is unknown, this node knows versions up to %d", block.Version, BlockVersion)
+	}
+	if parent != nil && block.Version < parent.Version {
+		return fmt.Errorf("block version %d is older than the version %d of its parent", block.Version, parent.Version)
+	}
+	if block.Version < 2 {
+		if block.MerkleRoot != "" {
+			return fmt.Errorf("block of version %d has a Merkle root", block.Version)
+		}
+		return nil
+	}
+	if root := MerkleRoot(block.Transactions); block.MerkleRoot != root {
+		return fmt.Errorf("the Merkle root %s isn't the root %s of the transactions", block.MerkleRoot, root)
+	}
+	return nil
+}
+
+// MerkleRoot returns the Merkle root of transactions, or "" if there are
+// none.
+func MerkleRoot(transactions []Transaction) string {
+	if len(transactions) == 0 {
+		return ""
+	}
+	level := merkleLeaves(transactions)
+	for len(level) > 1 {
+		level = merkleParents(level)
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// merkleSiblings returns the steps from the transaction at index to the root.
+func merkleSiblings(transactions []Transaction, index int) []MerkleStep {
+	var steps []MerkleStep
+	level := merkleLeaves(transactions)
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		steps = append(steps, MerkleStep{Hash: hex.EncodeToString(level[sibling]), Left: sibling < index})
+		level = merkleParents(level)
+		index /= 2
+	}
+	return steps
+}
+
+func merkleLeaves(transactions []Transaction) [][]byte {
+	leaves := make([][]byte, len(transactions))
+	for i, tx := range transactions {
+		sum := sha256.Sum256(tx.CanonicalBytes())
+		leaves[i] = sum[:]
+	}
+	return leaves
+}
+
+func merkleParents(level [][]byte) [][]byte {
+	parents := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		parents = append(parents, merkleHash(level[i], right))
+	}
+	return parents
+}
+
+func merkleHash(left, right []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte(nil), left...), right...))
+	return sum[:]
+}
+
+// VerifyMerkleProof reports whether the siblings of proof lead from its
+// transaction id to its Merkle root and, if the proof has a header, whether
+// the header commits to that root and hashes to the block hash of the proof
+// with hasher, or SHA-256 if hasher is nil. The proof only shows that the
+// transaction is in the chain if the block hash is known to be in it, which
+// the client has to check on its own, e.g. against the chain of a few nodes.
+func VerifyMerkleProof(proof MerkleProof, hasher Hasher) bool {
+	if proof.Header != nil {
+		header := *proof.Header
+		if header.Version < 2 || header.MerkleRoot != proof.MerkleRoot ||
+			header.Index != proof.BlockIndex || header.Hash(hasher) != proof.BlockHash {
+			return false
+		}
+	}
+	hash, err := hex.DecodeString(proof.TxID)
+	if err != nil {
+		return false
+	}
+	for _, step := range proof.Siblings {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		if step.Left {
+			hash = merkleHash(sibling, hash)
+		} else {
+			hash = merkleHash(hash, sibling)
+		}
+	}
+	return hex.EncodeToString(hash) == proof.MerkleRoot
+}
+
+// TransactionProof returns the Merkle proof that the transaction with the
+// given id is part of the chain.
+func (bc *Blockchain) TransactionProof(id string) (MerkleProof, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	for position, block := range bc.chain {
+		for i, tx := range block.Transactions {
+			if tx.ID() != id {
+				continue
+			}
+			proof := MerkleProof{
+				TxID:       id,
+				BlockIndex: block.Index,
+				BlockHash:  bc.hashes[position],
+				MerkleRoot: MerkleRoot(block.Transactions),
+				Siblings:   merkleSiblings(block.Transactions, i),
+			}
+			if block.Version >= 2 {
+				header := block.Header()
+				proof.Header = &header
+			}
+			return proof, nil
+		}
+	}
+	return MerkleProof{}, fmt.Errorf("%w: transaction %s", ErrNotFound, id)
+}
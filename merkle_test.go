@@ -0,0 +1,158 @@
+package gochain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// chainWithTransactions returns a blockchain whose last block holds several
+// transfers besides its reward.
+func chainWithTransactions(t *testing.T, transfers int) *Blockchain {
+	t.Helper()
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, transfers, miner)
+	for i := 0; i < transfers; i++ {
+		tx := Transaction{Sender: miner, Recipient: testAddress(fmt.Sprint("recipient", i)), Amount: 1}
+		if _, err := bc.NewTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mineBlocks(t, bc, 1, miner)
+	return bc
+}
+
+func TestTransactionProof(t *testing.T) {
+	bc := chainWithTransactions(t, 4)
+	block := bc.LastBlock()
+	if block.Version != BlockVersion || block.MerkleRoot != MerkleRoot(block.Transactions) {
+		t.Fatalf("mined block has version %d and root %s", block.Version, block.MerkleRoot)
+	}
+
+	for _, tx := range block.Transactions {
+		// The rewards of the earlier blocks have the same id.
+		if tx.Sender == DefaultCoinbaseSender {
+			continue
+		}
+		proof, err := bc.TransactionProof(tx.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof.BlockIndex != block.Index || proof.BlockHash != bc.BlockHash(block) || proof.Header == nil {
+			t.Fatalf("proof of %s points at block %d %s with header %v", tx.ID(), proof.BlockIndex, proof.BlockHash, proof.Header)
+		}
+		if !VerifyMerkleProof(proof, nil) {
+			t.Errorf("valid proof of %s rejected", tx.ID())
+		}
+	}
+
+	if _, err := bc.TransactionProof("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("proof of an unknown transaction returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestTamperedTransactionProof(t *testing.T) {
+	bc := chainWithTransactions(t, 4)
+	valid, err := bc.TransactionProof(bc.LastBlock().Transactions[1].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := map[string]func(*MerkleProof){
+		"sibling": func(p *MerkleProof) {
+			p.Siblings = append([]MerkleStep(nil), p.Siblings...)
+			p.Siblings[0].Hash = ComputeHashSha256([]byte("forged"))
+		},
+		"side": func(p *MerkleProof) {
+			p.Siblings = append([]MerkleStep(nil), p.Siblings...)
+			p.Siblings[0].Left = !p.Siblings[0].Left
+		},
+		"transaction": func(p *MerkleProof) { p.TxID = ComputeHashSha256([]byte("forged")) },
+		// A root made up to match forged siblings isn't in the header.
+		"root": func(p *MerkleProof) { p.MerkleRoot = ComputeHashSha256([]byte("forged")) },
+		"header": func(p *MerkleProof) {
+			header := *p.Header
+			header.Timestamp++
+			p.Header = &header
+		},
+		"block hash": func(p *MerkleProof) { p.BlockHash = ComputeHashSha256([]byte("forged")) },
+	}
+	for name, change := range tamper {
+		proof := valid
+		change(&proof)
+		if VerifyMerkleProof(proof, nil) {
+			t.Errorf("proof with a tampered %s accepted", name)
+		}
+	}
+}
+
+func TestValidChainChecksMerkleRoot(t *testing.T) {
+	bc := chainWithTransactions(t, 3)
+	chain := bc.Chain()
+	last := len(chain) - 1
+
+	wrongRoot := append([]Block(nil), chain...)
+	wrongRoot[last].MerkleRoot = MerkleRoot(chain[last].Transactions[1:])
+	if err := bc.ValidateChain(wrongRoot); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("chain with a wrong Merkle root: %v, want ErrInvalidChain", err)
+	}
+
+	downgraded := append([]Block(nil), chain...)
+	downgraded[last].Version = 1
+	downgraded[last].MerkleRoot = ""
+	if err := bc.ValidateChain(downgraded); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("chain going back to version 1: %v, want ErrInvalidChain", err)
+	}
+
+	future := append([]Block(nil), chain...)
+	future[last].Version = BlockVersion + 1
+	if err := bc.ValidateChain(future); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("chain with an unknown version: %v, want ErrInvalidChain", err)
+	}
+}
+
+// Duplicating the last transaction of a block with an odd number of them
+// doesn't change its Merkle root, but it must change its hash.
+func TestDuplicatedTransactionChangesHash(t *testing.T) {
+	bc := chainWithTransactions(t, 2)
+	block := bc.LastBlock()
+	if len(block.Transactions)%2 == 0 {
+		t.Fatalf("block has %d transactions, want an odd number", len(block.Transactions))
+	}
+	mutated := block.copy()
+	mutated.Transactions = append(mutated.Transactions, mutated.Transactions[len(mutated.Transactions)-1])
+	if MerkleRoot(mutated.Transactions) != block.MerkleRoot {
+		t.Fatal("the mutation is expected to keep the Merkle root")
+	}
+	if bc.BlockHash(mutated) == bc.BlockHash(block) {
+		t.Error("blocks with different transactions have the same hash")
+	}
+}
+
+// Blocks mined before version 2 still validate, and their proofs, which
+// have no header, only show the transaction leads to the root.
+func TestLegacyBlockProof(t *testing.T) {
+	bc := newTestBlockchain(t)
+	legacy := newTestBlockchain(t)
+	mineBlocks(t, legacy, 2, testAddress("miner"))
+	chain := legacy.Chain()
+	// Rebuild the chain as version 1 blocks, which hash their transactions.
+	for i := range chain {
+		chain[i].Version, chain[i].MerkleRoot = 0, ""
+		if i > 0 {
+			chain[i].PreviousHash = bc.BlockHash(chain[i-1])
+			chain[i].Proof = bc.ProofOfWork(chain[i-1].Proof)
+		}
+	}
+	if err := bc.Import(Snapshot{Chain: chain}); err != nil {
+		t.Fatal(err)
+	}
+	proof, err := bc.TransactionProof(chain[2].Transactions[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proof.Header != nil || !VerifyMerkleProof(proof, nil) {
+		t.Errorf("proof of a legacy block has header %v and verifies %v", proof.Header, VerifyMerkleProof(proof, nil))
+	}
+}
@@ -0,0 +1,389 @@
+package gochain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a per-client token bucket: every client may burst up to
+// burst requests, after which tokens are refilled at rate per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the client's bucket. When the bucket is empty it
+// reports how long the client has to wait for the next token. The buckets
+// that refilled since are forgotten, as a new bucket is full too, so that
+// clients seen once don't stay in memory.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.rate > 0 {
+		for c, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, c)
+			}
+		}
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, time.Hour
+	}
+	wait := (1 - b.tokens) / l.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitRate rejects requests from clients that exceed the limiter with
+// 429 Too Many Requests. A nil limiter lets everything through.
+func limitRate(l *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := l.allow(clientIP(r))
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeJSON(w, http.StatusTooManyRequests, fmt.Sprintf("rate limit exceeded, retry in %d seconds", seconds))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireAPIKey only lets requests carrying "Authorization: Bearer <key>"
+// through and answers everything else with 401 Unauthorized. An empty key
+// disables the check.
+func requireAPIKey(key string, next http.HandlerFunc) http.HandlerFunc {
+	if key == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if token == authorization || subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, "missing or invalid API key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// signatureHeader carries the hex encoded HMAC-SHA256 of the body of a
+// request between nodes, keyed with the network secret.
+const signatureHeader = "X-Gochain-Signature"
+
+// signBody returns the signature of body for signatureHeader.
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requireSignature only lets requests whose body is signed with secret
+// through and answers everything else with 401 Unauthorized. With
+// relayedOnly, only the requests relayed by other nodes are checked, so that
+// clients can still submit theirs. An empty secret disables the check.
+func requireSignature(secret string, relayedOnly bool, next http.HandlerFunc) http.HandlerFunc {
+	if secret == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if relayedOnly && r.Header.Get(relayedHeader) == "" {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSON(w, statusFor(err, http.StatusBadRequest), err.Error())
+			return
+		}
+		signature, err := hex.DecodeString(r.Header.Get(signatureHeader))
+		expected, _ := hex.DecodeString(signBody(secret, body))
+		if err != nil || !hmac.Equal(signature, expected) {
+			writeJSON(w, http.StatusUnauthorized, "missing or invalid signature")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// idempotencyCache remembers the responses to the requests carrying an
+// Idempotency-Key header, so that a client retrying such a request gets the
+// same response instead of having it run twice.
+type idempotencyCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	responses map[string]*recordedResponse
+}
+
+// recordedResponse is a response as written by a handler to the request
+// whose body hashes to bodyHash. done is closed once it is complete.
+type recordedResponse struct {
+	done     chan struct{}
+	expires  time.Time
+	bodyHash [sha256.Size]byte
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, responses: make(map[string]*recordedResponse)}
+}
+
+// idempotent replays the recorded response to requests whose Idempotency-Key
+// was sent by the same client on the same path within the TTL of the cache.
+// Clients are told apart by IP, like for the rate limit, so that they can't
+// get the responses to each other's requests. Reusing a key for another body
+// is answered with 422 Unprocessable Entity. Responses to requests that may
+// succeed when retried, 429 and 5xx, aren't kept, and neither are those of
+// handlers that panicked.
+func idempotent(c *idempotencyCache, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		key = clientIP(r) + " " + r.URL.Path + " " + key
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSON(w, statusFor(err, http.StatusBadRequest), err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := sha256.Sum256(body)
+
+		now := time.Now()
+		c.mu.Lock()
+		for k, resp := range c.responses {
+			if now.After(resp.expires) {
+				delete(c.responses, k)
+			}
+		}
+		recorded, ok := c.responses[key]
+		if !ok {
+			recorded = &recordedResponse{done: make(chan struct{}), expires: now.Add(c.ttl), bodyHash: bodyHash}
+			c.responses[key] = recorded
+		}
+		c.mu.Unlock()
+
+		if ok && recorded.bodyHash != bodyHash {
+			writeJSON(w, http.StatusUnprocessableEntity, "Idempotency-Key already used for another request")
+			return
+		}
+		if ok {
+			// A request with the same key may still be running.
+			<-recorded.done
+			for k, v := range recorded.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(recorded.status)
+			w.Write(recorded.body.Bytes())
+			return
+		}
+
+		// The response is settled even if next panics, so that the requests
+		// waiting for it don't wait forever. A panic fails like a 5xx: the
+		// waiting requests get a 500 and the key may be retried.
+		panicked := true
+		defer func() {
+			if panicked {
+				recorded.status = http.StatusInternalServerError
+				recorded.header = nil
+				recorded.body.Reset()
+			}
+			if recorded.status == http.StatusTooManyRequests || recorded.status >= 500 {
+				c.mu.Lock()
+				delete(c.responses, key)
+				c.mu.Unlock()
+			}
+			close(recorded.done)
+		}()
+		rw := &recordingResponseWriter{ResponseWriter: w, recorded: recorded}
+		next(rw, r)
+		if !rw.wroteHeader {
+			rw.WriteHeader(http.StatusOK)
+		}
+		panicked = false
+	}
+}
+
+// recordingResponseWriter writes the response while recording it.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	recorded    *recordedResponse
+	wroteHeader bool
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.recorded.status = status
+	w.recorded.header = w.Header().Clone()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.recorded.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// gzipThreshold is the size from which responses are compressed. Smaller
+// ones aren't worth it.
+const gzipThreshold = 1024
+
+// compress gzips the responses larger than gzipThreshold for the clients
+// that accept it.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the response until it knows whether it is
+// large enough to be compressed.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	w.buf.Write(p)
+	if w.buf.Len() < gzipThreshold {
+		return len(p), nil
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	if _, err := w.gz.Write(w.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	w.buf.Reset()
+	return len(p), nil
+}
+
+// Close sends what is left of the response.
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	return err
+}
+
+// By default request bodies are limited to 1MB. Snapshots for /import hold
+// the whole chain and get more room.
+const defaultBodyLimit = 1 << 20
+
+var defaultBodyLimits = map[string]int64{
+	"/import": 64 << 20,
+}
+
+// limitBody makes reading the request body fail once it exceeds the limit
+// for the path of the request, limits[path] or defaultBodyLimit.
+func limitBody(limits map[string]int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := limits[r.URL.Path]
+		if !ok {
+			limit = defaultBodyLimit
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,292 @@
+package gochain
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, miner)
+	h := NewHandler(bc, testAddress("node"))
+	submit := func(client, recipient string) *httptest.ResponseRecorder {
+		body := `{"sender": "` + miner + `", "recipient": "` + testAddress(recipient) + `", "amount": 1}`
+		req := httptest.NewRequest(http.MethodPost, "/transactions/new", strings.NewReader(body))
+		req.RemoteAddr = client + ":1234"
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "retry-me")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := submit("10.0.0.1", "alice")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", first.Code, first.Body)
+	}
+	retry := submit("10.0.0.1", "alice")
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry answered %d %q, want the replay of %d %q", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if n := len(bc.Export().Transactions); n != 1 {
+		t.Fatalf("%d transactions pending after a retry, want 1", n)
+	}
+
+	if rec := submit("10.0.0.1", "bob"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for another body: status %d, want 422", rec.Code)
+	}
+	// Another client's key is its own.
+	if rec := submit("10.0.0.2", "bob"); rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("same key from another client: status %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if n := len(bc.Export().Transactions); n != 2 {
+		t.Errorf("%d transactions pending, want 2", n)
+	}
+}
+
+func TestIdempotencyKeyPanic(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	calls := 0
+	h := idempotent(newIdempotencyCache(time.Minute), func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			close(started)
+			<-release
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	submit := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/transactions/new", strings.NewReader("{}"))
+		req.Header.Set("Idempotency-Key", "retry-me")
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		submit()
+	}()
+	<-started
+	// A request with the same key arriving meanwhile waits for the first.
+	waiting := make(chan *httptest.ResponseRecorder)
+	go func() { waiting <- submit() }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if p := <-panicked; p == nil {
+		t.Fatal("panic of the handler swallowed")
+	}
+	select {
+	case rec := <-waiting:
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("request waiting for a panicked one: status %d, want 500", rec.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request waiting for a panicked one never answered")
+	}
+
+	// The key wasn't kept, so the retry runs the handler again.
+	if rec := submit(); rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after a panic: status %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := NewHandler(newTestBlockchain(t), testAddress("node"), WithRateLimit(0.01, 2))
+	submit := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/transactions/new", strings.NewReader("{}"))
+		req.RemoteAddr = client + ":1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := submit("10.0.0.1"); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("request %d within the burst limited", i+1)
+		}
+	}
+	rec := submit("10.0.0.1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the burst: status %d, want 429", rec.Code)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "100" {
+		t.Errorf("Retry-After is %q, want 100 seconds for a token at 0.01 per second", retry)
+	}
+	if rec := submit("10.0.0.2"); rec.Code == http.StatusTooManyRequests {
+		t.Error("another client limited")
+	}
+}
+
+func TestRateLimitForgetsFullBuckets(t *testing.T) {
+	l := newRateLimiter(1000, 2)
+	l.allow("10.0.0.1")
+	time.Sleep(10 * time.Millisecond)
+	// The first client's bucket refilled meanwhile.
+	l.allow("10.0.0.2")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.buckets["10.0.0.1"]; ok {
+		t.Error("bucket full again still kept")
+	}
+	if _, ok := l.buckets["10.0.0.2"]; !ok {
+		t.Error("bucket in use forgotten")
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := newRateLimiter(10, 1)
+	if ok, _ := l.allow("client"); !ok {
+		t.Fatal("first request limited")
+	}
+	ok, wait := l.allow("client")
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("second request allowed %v, wait %v", ok, wait)
+	}
+	l.buckets["client"].last = l.buckets["client"].last.Add(-wait)
+	if ok, _ := l.allow("client"); !ok {
+		t.Error("request limited once the token was refilled")
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	h := NewHandler(newTestBlockchain(t), testAddress("node"), WithAPIKey("secret"))
+	register := `{"nodes": ["http://10.0.0.1:5000"]}`
+
+	for _, header := range []http.Header{nil, {"Authorization": {"Bearer wrong"}}, {"Authorization": {"secret"}}} {
+		rec := serve(h, http.MethodPost, "/nodes/register", register, header)
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Authorization %q: status %d, want 401 with a challenge", header.Get("Authorization"), rec.Code)
+		}
+	}
+	if rec := serve(h, http.MethodPost, "/nodes/register", register, http.Header{"Authorization": {"Bearer secret"}}); rec.Code != http.StatusCreated {
+		t.Errorf("with the key: status %d, want 201", rec.Code)
+	}
+	// Reading stays public.
+	if rec := serve(h, http.MethodGet, "/chain", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /chain without the key: status %d, want 200", rec.Code)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 20, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+	acceptGzip := http.Header{"Accept-Encoding": {"deflate, gzip;q=0.8"}}
+
+	plain := serve(h, http.MethodGet, "/chain", "", nil)
+	if enc := plain.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("chain sent to a client without gzip encoded with %q", enc)
+	}
+	if plain.Body.Len() < gzipThreshold {
+		t.Fatalf("chain of %d bytes is too short for the test", plain.Body.Len())
+	}
+
+	rec := serve(h, http.MethodGet, "/chain", "", acceptGzip)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("chain encoded with %q, want gzip", enc)
+	}
+	if vary := rec.Header().Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Accept-Encoding") {
+		t.Errorf("Vary is %q, want Accept-Encoding in it", vary)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != plain.Body.String() {
+		t.Error("decompressed chain differs from the plain one")
+	}
+
+	// Small responses aren't worth it.
+	if rec := serve(h, http.MethodGet, "/chain/head", "", acceptGzip); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("head of %d bytes compressed", rec.Body.Len())
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	h := NewHandler(bc, testAddress("node"), WithBodyLimit("/nodes/register", 64))
+
+	padding := strings.Repeat(" ", defaultBodyLimit)
+	tx := `{"sender": "` + miner + `", "recipient": "` + testAddress("alice") + `", "amount": 1}`
+	if rec := serve(h, http.MethodPost, "/transactions/new", padding+tx, nil); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("transaction past the default limit: status %d, want 413", rec.Code)
+	}
+	if rec := serve(h, http.MethodPost, "/transactions/new", tx, nil); rec.Code != http.StatusCreated {
+		t.Errorf("transaction: status %d: %s", rec.Code, rec.Body)
+	}
+
+	nodes := `{"nodes": ["http://127.0.0.1:5001", "http://127.0.0.1:5002", "http://127.0.0.1:5003"]}`
+	if rec := serve(h, http.MethodPost, "/nodes/register", nodes, nil); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("%d bytes with a limit of 64: status %d, want 413", len(nodes), rec.Code)
+	}
+	if rec := serve(h, http.MethodPost, "/nodes/register", `{"nodes": ["127.0.0.1:5001"]}`, nil); rec.Code != http.StatusCreated {
+		t.Errorf("nodes within the limit: status %d: %s", rec.Code, rec.Body)
+	}
+	// /import gets more room than the default.
+	if rec := serve(h, http.MethodPost, "/import", padding+`{}`, nil); rec.Code == http.StatusRequestEntityTooLarge {
+		t.Errorf("snapshot just past the default limit refused as too large")
+	}
+}
+
+func TestNetworkSecret(t *testing.T) {
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 2, testAddress("peer"))
+	bc := newTestBlockchain(t, WithNetworkSecret("secret"))
+	if err := bc.Import(peer.Export()); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(bc, testAddress("node"))
+	mineBlocks(t, peer, 1, testAddress("peer"))
+	block, err := json.Marshal(peer.LastBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := `{"nodes": ["127.0.0.1:5001"]}`
+
+	for _, tc := range []struct {
+		name, target, body, signature string
+		want                          int
+	}{
+		{"unsigned block", "/blocks/announce", string(block), "", http.StatusUnauthorized},
+		{"block signed with another secret", "/blocks/announce", string(block), signBody("other", block), http.StatusUnauthorized},
+		{"signature of another body", "/blocks/announce", string(block), signBody("secret", []byte(nodes)), http.StatusUnauthorized},
+		{"signature not in hex", "/blocks/announce", string(block), "secret", http.StatusUnauthorized},
+		{"signed block", "/blocks/announce", string(block), signBody("secret", block), http.StatusCreated},
+		{"unsigned nodes", "/nodes/register", nodes, "", http.StatusUnauthorized},
+		{"signed nodes", "/nodes/register", nodes, signBody("secret", []byte(nodes)), http.StatusCreated},
+	} {
+		header := http.Header{}
+		if tc.signature != "" {
+			header.Set(signatureHeader, tc.signature)
+		}
+		if rec := serve(h, http.MethodPost, tc.target, tc.body, header); rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.want, rec.Body)
+		}
+	}
+	if n := bc.Len(); n != 4 {
+		t.Errorf("chain has %d blocks, want only the signed block added", n)
+	}
+
+	// The RPC call can't be signed on its own.
+	var got rpcReply
+	decodeBody(t, serve(h, http.MethodPost, "/rpc", `{"jsonrpc": "2.0", "id": 1, "method": "node_register", "params": ["127.0.0.1:5002"]}`, nil), &got)
+	if got.Error == nil || len(bc.Nodes()) != 1 {
+		t.Errorf("node registered over RPC despite the network secret: %+v", got)
+	}
+}
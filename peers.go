@@ -0,0 +1,282 @@
+package gochain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultPeerFailureThreshold is the number of consecutive failed health
+// checks after which a peer is considered dead.
+const defaultPeerFailureThreshold = 3
+
+// By default fetching a peer's chain is tried three times, waiting 200ms and
+// then 400ms between the attempts.
+const (
+	defaultPeerRetryAttempts = 3
+	defaultPeerRetryDelay    = 200 * time.Millisecond
+)
+
+// DefaultPeerTimeout is how long a request to a peer may take, so that a
+// peer that never answers can't hold up consensus.
+const DefaultPeerTimeout = 30 * time.Second
+
+// DefaultPeerResponseLimit is the largest answer read from a peer, see
+// WithPeerResponseLimit.
+const DefaultPeerResponseLimit = 256 << 20
+
+// WithPeerResponseLimit sets the largest answer, in bytes, read from a peer.
+// Larger answers, e.g. from a peer trying to exhaust our memory, are
+// refused. It must be above the size of the whole chain in JSON.
+func WithPeerResponseLimit(limit int64) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.peerResponseLimit = limit
+	}
+}
+
+// WithoutBinarySync makes the node download the chains of its peers in JSON
+// only, see BinaryChainType.
+func WithoutBinarySync() BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.noBinarySync = true
+	}
+}
+
+// WithPeerRetry sets how many times a peer's chain is requested when the peer
+// can't be reached, and how long to wait before the first retry. The wait
+// doubles after every attempt.
+func WithPeerRetry(attempts int, baseDelay time.Duration) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.peerRetryAttempts = attempts
+		bc.peerRetryDelay = baseDelay
+	}
+}
+
+// WithPeerFailureThreshold sets how many consecutive failed health checks
+// PruneUnreachable tolerates before it removes a peer.
+func WithPeerFailureThreshold(failures int) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.peerFailureThreshold = failures
+	}
+}
+
+// WithPeerSample makes ResolveConflicts ask only size of the registered nodes
+// per round, picked at random, instead of all of them, which is cheaper on
+// large networks. Over the rounds every node gets asked, so nodes still end
+// up on the chain with the most work. A quorum is then counted among the
+// sampled nodes. A size of 0 asks all the nodes.
+func WithPeerSample(size int) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.peerSample = size
+	}
+}
+
+// samplePeers returns peerSample of nodes picked at random, or all of them
+// without sampling. The nodes that failed recent health checks are less
+// likely to be picked: a node that failed f checks in a row weighs
+// 1/(1+f).
+func (bc *Blockchain) samplePeers(nodes []string) []string {
+	if bc.peerSample <= 0 || len(nodes) <= bc.peerSample {
+		return nodes
+	}
+	// Weighted sampling without replacement: every node draws the key
+	// u^(1/weight) for a uniform u, and the largest keys win.
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys := make(map[string]float64, len(nodes))
+	for _, node := range nodes {
+		weight := 1 / float64(1+bc.peerFailures[node])
+		keys[node] = math.Pow(random.Float64(), 1/weight)
+	}
+	sampled := append([]string(nil), nodes...)
+	sort.Slice(sampled, func(i, j int) bool {
+		return keys[sampled[i]] > keys[sampled[j]]
+	})
+	return sampled[:bc.peerSample]
+}
+
+// PruneUnreachable pings every registered node and removes the ones that
+// failed the last peerFailureThreshold checks in a row. A single failure
+// never evicts a peer, it only counts against it until it answers again.
+// It returns the nodes that were removed.
+func (bc *Blockchain) PruneUnreachable(ctx context.Context) []string {
+	var pruned []string
+	for _, node := range bc.Nodes() {
+		err := bc.pingNode(ctx, node)
+
+		bc.mu.Lock()
+		if err == nil {
+			delete(bc.peerFailures, node)
+		} else {
+			bc.peerFailures[node]++
+			log.Printf("node %s failed health check (%d in a row): %v", node, bc.peerFailures[node], err)
+			if bc.peerFailures[node] >= bc.peerFailureThreshold {
+				bc.nodes.Remove(node)
+				delete(bc.peerFailures, node)
+				pruned = append(pruned, node)
+			}
+		}
+		bc.mu.Unlock()
+	}
+	return pruned
+}
+
+// pruneUnreachableEvery runs PruneUnreachable in the background until the
+// blockchain is closed.
+func (bc *Blockchain) pruneUnreachableEvery(interval time.Duration) {
+	bc.goBackground(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bc.closing:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(bc.closingCtx, interval)
+			for _, node := range bc.PruneUnreachable(ctx) {
+				log.Printf("removed unreachable node %s", node)
+			}
+			cancel()
+		}
+	})
+}
+
+// WithHTTPClient sets the client used to talk to the other nodes, e.g. to
+// trust the certificates of nodes served over HTTPS. It should have a
+// timeout, like the default client which gives up after DefaultPeerTimeout.
+func WithHTTPClient(client *http.Client) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.httpClient = client
+	}
+}
+
+// WithPeerCache makes the node reuse what its peers answered for ttl, so
+// that consensus rounds in quick succession, e.g. for a burst of mining
+// requests, don't ask the peers again. Explicit /nodes/resolve requests
+// always ask them. By default nothing is cached.
+func WithPeerCache(ttl time.Duration) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.peerCacheTTL = ttl
+	}
+}
+
+// peerResponse is the body of a successful answer of a peer.
+type peerResponse struct {
+	body        []byte
+	contentType string
+	fetched     time.Time
+}
+
+func (bc *Blockchain) cachedPeerResponse(node, path string) (peerResponse, bool) {
+	bc.peerCacheMu.Lock()
+	defer bc.peerCacheMu.Unlock()
+	resp, ok := bc.peerCache[node+path]
+	if !ok || time.Since(resp.fetched) > bc.peerCacheTTL {
+		return peerResponse{}, false
+	}
+	return resp, true
+}
+
+func (bc *Blockchain) cachePeerResponse(node, path string, body []byte, contentType string) {
+	bc.peerCacheMu.Lock()
+	defer bc.peerCacheMu.Unlock()
+	now := time.Now()
+	for key, resp := range bc.peerCache {
+		if now.Sub(resp.fetched) > bc.peerCacheTTL {
+			delete(bc.peerCache, key)
+		}
+	}
+	bc.peerCache[node+path] = peerResponse{body, contentType, now}
+}
+
+// forgetPeerResponses empties the cache of WithPeerCache.
+func (bc *Blockchain) forgetPeerResponses() {
+	bc.peerCacheMu.Lock()
+	defer bc.peerCacheMu.Unlock()
+	bc.peerCache = make(map[string]peerResponse)
+}
+
+// nodeURL returns the URL of path on node. Nodes served over HTTP are stored
+// as their host only, while the others keep their scheme.
+func nodeURL(node, path string) string {
+	if strings.Contains(node, "://") {
+		return node + path
+	}
+	return "http://" + node + path
+}
+
+// pingNode checks that a node answers on its health endpoint. Any response
+// below 500 counts as alive, so nodes that predate /healthz aren't evicted.
+func (bc *Blockchain) pingNode(ctx context.Context, node string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nodeURL(node, "/healthz"), nil)
+	if err != nil {
+		return err
+	}
+	response, err := bc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// SetSelfAddress tells the blockchain the address its node is reachable at,
+// as given to RegisterNode, so that the node never registers itself as a
+// peer and fetches its own chain. It is dropped from the registered nodes if
+// it was already there.
+func (bc *Blockchain) SetSelfAddress(address string) {
+	node, ok := nodeAddress(address)
+	if !ok {
+		return
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.self = node
+	bc.nodes.Remove(node)
+}
+
+// RegisterNodesFromFile registers the nodes listed in a seed file, either as
+// a JSON array of addresses or one address per line. Empty lines and lines
+// starting with # are ignored. Addresses are read like RegisterNode does, so
+// those without a scheme are taken as HTTP. It returns the number of nodes
+// that were new.
+func (bc *Blockchain) RegisterNodesFromFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var addresses []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &addresses); err != nil {
+			return 0, fmt.Errorf("invalid seed file %s: %v", path, err)
+		}
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				addresses = append(addresses, line)
+			}
+		}
+	}
+
+	added := 0
+	for _, address := range addresses {
+		if bc.RegisterNode(address) {
+			added++
+		}
+	}
+	return added, nil
+}
@@ -0,0 +1,356 @@
+package gochain
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPruneUnreachable(t *testing.T) {
+	alive := httptest.NewServer(NewHandler(newTestBlockchain(t), testAddress("alive")))
+	defer alive.Close()
+	failing := int32(1)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer flaky.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	bc := newTestBlockchain(t, WithPeerFailureThreshold(2))
+	for _, srv := range []*httptest.Server{alive, flaky, dead} {
+		bc.RegisterNode(srv.URL)
+	}
+	nodes := bc.Nodes()
+	sort.Strings(nodes)
+
+	if pruned := bc.PruneUnreachable(context.Background()); len(pruned) != 0 {
+		t.Fatalf("pruned %q after a single failure", pruned)
+	}
+	// The flaky node answers again, which clears its failure.
+	atomic.StoreInt32(&failing, 0)
+	if pruned := bc.PruneUnreachable(context.Background()); !reflect.DeepEqual(pruned, []string{dead.Listener.Addr().String()}) {
+		t.Fatalf("pruned %q, want only the dead node", pruned)
+	}
+	atomic.StoreInt32(&failing, 1)
+	if pruned := bc.PruneUnreachable(context.Background()); len(pruned) != 0 {
+		t.Errorf("pruned %q after the first failure of a recovered node", pruned)
+	}
+	if got := len(bc.Nodes()); got != 2 {
+		t.Errorf("%d nodes left of %q, want 2", got, nodes)
+	}
+}
+
+// roundTripFunc lets a function serve as the transport of an http.Client.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestPeerRetry(t *testing.T) {
+	peer := newTestBlockchain(t)
+	srv := httptest.NewServer(NewHandler(peer, testAddress("peer")))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name     string
+		failures int  // requests failing before the peer is reachable
+		status   int  // status answered once reachable
+		ok       bool // whether the chain is fetched
+		requests int
+	}{
+		{"reachable", 0, http.StatusOK, true, 1},
+		{"restarting", 2, http.StatusOK, true, 3},
+		{"down", 5, http.StatusOK, false, 3},
+		{"erroring", 0, http.StatusInternalServerError, false, 1},
+	} {
+		requests := 0
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			requests++
+			if requests <= tc.failures {
+				return nil, errors.New("connection refused")
+			}
+			if tc.status != http.StatusOK {
+				return &http.Response{StatusCode: tc.status, Status: http.StatusText(tc.status), Body: http.NoBody, Request: r}, nil
+			}
+			return http.DefaultTransport.RoundTrip(r)
+		})}
+		bc := newTestBlockchain(t, WithHTTPClient(client), WithPeerRetry(3, time.Millisecond))
+		_, err := bc.findExternalChain(srv.URL)
+		if (err == nil) != tc.ok || requests != tc.requests {
+			t.Errorf("%s: error %v after %d requests, want success %v after %d", tc.name, err, requests, tc.ok, tc.requests)
+		}
+	}
+}
+
+func TestRegisterNodesFromFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		content string
+		added   int
+		nodes   []string
+	}{
+		{"lines", "# seeds\nhttp://10.0.0.1:5000\n\n  https://10.0.0.2:5000  \nhttp://10.0.0.1:5000\n10.0.0.3:5000\n", 3, []string{"10.0.0.1:5000", "10.0.0.3:5000", "https://10.0.0.2:5000"}},
+		{"json", `["http://10.0.0.1:5000", "http://10.0.0.1:5000", "ftp://10.0.0.4"]`, 1, []string{"10.0.0.1:5000"}},
+	} {
+		path := filepath.Join(dir, tc.name)
+		if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		bc := newTestBlockchain(t)
+		added, err := bc.RegisterNodesFromFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		nodes := bc.Nodes()
+		sort.Strings(nodes)
+		if added != tc.added || !reflect.DeepEqual(nodes, tc.nodes) {
+			t.Errorf("%s: added %d nodes %q, want %d nodes %q", tc.name, added, nodes, tc.added, tc.nodes)
+		}
+	}
+
+	bc := newTestBlockchain(t)
+	if _, err := bc.RegisterNodesFromFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file read")
+	}
+	malformed := filepath.Join(dir, "malformed")
+	if err := os.WriteFile(malformed, []byte(`["http://10.0.0.1:5000"`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.RegisterNodesFromFile(malformed); err == nil {
+		t.Error("malformed JSON read")
+	}
+}
+
+func TestResolveConflictsQuorum(t *testing.T) {
+	honest := newTestBlockchain(t)
+	mineBlocks(t, honest, 3, testAddress("honest"))
+	other := newTestBlockchain(t)
+	if err := other.Import(honest.Export()); err != nil {
+		t.Fatal(err)
+	}
+	// The liar has the longest chain, but nobody vouches for it.
+	liar := newTestBlockchain(t)
+	mineBlocks(t, liar, 6, testAddress("liar"))
+
+	bc := newTestBlockchain(t)
+	for _, peer := range []*Blockchain{honest, liar} {
+		srv, _ := recordingPeer(t, peer)
+		bc.RegisterNode(srv.URL)
+	}
+	h := NewHandler(bc, testAddress("node"))
+	if rec := serve(h, http.MethodGet, "/nodes/resolve?quorum=2", "", nil); rec.Code != http.StatusOK || bc.Len() != 1 {
+		t.Fatalf("quorum of 2 without 2 nodes agreeing: status %d, chain of %d blocks", rec.Code, bc.Len())
+	}
+
+	srv, _ := recordingPeer(t, other)
+	bc.RegisterNode(srv.URL)
+	if !bc.ResolveConflictsQuorum(2) {
+		t.Fatal("chain reported by 2 nodes not adopted")
+	}
+	if !reflect.DeepEqual(bc.Chain(), honest.Chain()) {
+		t.Error("adopted chain isn't the one the quorum reported")
+	}
+
+	if rec := serve(h, http.MethodGet, "/nodes/resolve?quorum=0", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("quorum=0: status %d, want 400", rec.Code)
+	}
+}
+
+func TestResolveConflictsTiebreak(t *testing.T) {
+	a, b := newTestBlockchain(t), newTestBlockchain(t)
+	mineBlocks(t, a, 3, testAddress("a"))
+	mineBlocks(t, b, 3, testAddress("b"))
+	want := a
+	if b.BlockHash(b.LastBlock()) < a.BlockHash(a.LastBlock()) {
+		want = b
+	}
+	srvA, _ := recordingPeer(t, a)
+	srvB, _ := recordingPeer(t, b)
+
+	// Whatever the order of the peers, the chain with the smallest last hash
+	// wins among chains with the same work.
+	for _, order := range [][]string{{srvA.URL, srvB.URL}, {srvB.URL, srvA.URL}} {
+		bc := newTestBlockchain(t)
+		for _, node := range order {
+			bc.RegisterNode(node)
+		}
+		if !bc.ResolveConflicts() {
+			t.Fatal("no chain adopted")
+		}
+		if !reflect.DeepEqual(bc.Chain(), want.Chain()) {
+			t.Errorf("peers in the order %v: adopted the chain with the larger last hash", order)
+		}
+	}
+
+	// A peer chain with as much work doesn't replace ours, even with a
+	// smaller last hash.
+	other := a
+	if want == a {
+		other = b
+	}
+	srv, _ := recordingPeer(t, want)
+	other.RegisterNode(srv.URL)
+	if other.ResolveConflicts() {
+		t.Error("chain replaced by one with the same work")
+	}
+}
+
+func TestAutoResolve(t *testing.T) {
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 2, testAddress("peer"))
+	srv, _ := recordingPeer(t, peer)
+
+	bc := newTestBlockchain(t)
+	bc.RegisterNode(srv.URL)
+	NewHandler(bc, testAddress("node"), WithoutMining(), WithAutoResolve(10*time.Millisecond))
+	waitForLength := func(n int64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); bc.Len() != n; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("chain of %d blocks, want %d", bc.Len(), n)
+			}
+		}
+	}
+
+	waitForLength(3)
+	mineBlocks(t, peer, 1, testAddress("peer"))
+	waitForLength(4)
+
+	// Closing the blockchain stops the loop.
+	bc.Close()
+	mineBlocks(t, peer, 1, testAddress("peer"))
+	time.Sleep(100 * time.Millisecond)
+	if n := bc.Len(); n != 4 {
+		t.Errorf("chain synced to %d blocks once closed", n)
+	}
+}
+
+func TestSamplePeers(t *testing.T) {
+	nodes := []string{"a:1", "b:1", "c:1", "d:1", "e:1"}
+	if got := newTestBlockchain(t).samplePeers(nodes); !reflect.DeepEqual(got, nodes) {
+		t.Errorf("without sampling got %v, want all nodes", got)
+	}
+
+	bc := newTestBlockchain(t, WithPeerSample(2))
+	sampled := bc.samplePeers(nodes)
+	if len(sampled) != 2 || sampled[0] == sampled[1] {
+		t.Fatalf("sampled %v, want 2 different nodes", sampled)
+	}
+	known := make(map[string]bool)
+	for _, node := range nodes {
+		known[node] = true
+	}
+	for _, node := range sampled {
+		if !known[node] {
+			t.Errorf("sampled unknown node %s", node)
+		}
+	}
+
+	// A node that failed 9 health checks weighs a tenth of a healthy one,
+	// so it is picked about once in 11 draws.
+	bc = newTestBlockchain(t, WithPeerSample(1))
+	bc.peerFailures["b:1"] = 9
+	failing := 0
+	const draws = 2000
+	for i := 0; i < draws; i++ {
+		if bc.samplePeers(nodes[:2])[0] == "b:1" {
+			failing++
+		}
+	}
+	if failing == 0 || failing > draws/4 {
+		t.Errorf("failing node picked %d times in %d draws, want about %d", failing, draws, draws/11)
+	}
+}
+
+func TestResolveConflictsSamplesPeers(t *testing.T) {
+	var asked int32
+	bc := newTestBlockchain(t, WithPeerSample(2))
+	for i := 0; i < 5; i++ {
+		h := NewHandler(newTestBlockchain(t), testAddress("peer"))
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/chain/head" {
+				atomic.AddInt32(&asked, 1)
+			}
+			h.ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		bc.RegisterNode(srv.URL)
+	}
+	bc.ResolveConflicts()
+	if n := atomic.LoadInt32(&asked); n != 2 {
+		t.Errorf("%d of the 5 peers asked, want 2", n)
+	}
+}
+
+func TestPeerCache(t *testing.T) {
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 2, testAddress("peer"))
+	peerHandler := NewHandler(peer, testAddress("peer"))
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		peerHandler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	bc := newTestBlockchain(t, WithPeerCache(time.Minute))
+	bc.RegisterNode(srv.URL)
+	h := NewHandler(bc, testAddress("node"))
+
+	if !bc.ResolveConflicts() {
+		t.Fatal("longer chain of the peer not adopted")
+	}
+	asked := atomic.LoadInt32(&requests)
+	if asked == 0 {
+		t.Fatal("peer never asked")
+	}
+	bc.ResolveConflicts()
+	if n := atomic.LoadInt32(&requests); n != asked {
+		t.Errorf("second resolve within the TTL made %d requests to the peer", n-asked)
+	}
+
+	// An explicit resolve asks the peer again.
+	if rec := serve(h, http.MethodGet, "/nodes/resolve", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if n := atomic.LoadInt32(&requests); n == asked {
+		t.Error("/nodes/resolve answered from the cache")
+	}
+}
+
+func TestSetSelfAddress(t *testing.T) {
+	bc := newTestBlockchain(t)
+	bc.RegisterNode("http://10.0.0.1:5000")
+	bc.RegisterNode("localhost:8000")
+
+	// The node stops being its own peer.
+	bc.SetSelfAddress("http://localhost:8000")
+	if got := bc.Nodes(); !reflect.DeepEqual(got, []string{"10.0.0.1:5000"}) {
+		t.Errorf("registered nodes are %q, want only the other node", got)
+	}
+	for _, address := range []string{"localhost:8000", "http://localhost:8000/", "http://localhost:8000/chain"} {
+		if added, err := bc.AddNode(address); added || !errors.Is(err, ErrSelfNode) {
+			t.Errorf("%s: added %t with %v, want ErrSelfNode", address, added, err)
+		}
+		if bc.RegisterNode(address) {
+			t.Errorf("%s registered", address)
+		}
+	}
+	// Only the same host and port is the node itself.
+	for _, address := range []string{"localhost:8001", "https://localhost:8000"} {
+		if added, err := bc.AddNode(address); !added || err != nil {
+			t.Errorf("%s: added %t with %v, want it registered", address, added, err)
+		}
+	}
+}
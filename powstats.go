@@ -0,0 +1,58 @@
+package gochain
+
+import "time"
+
+// PowStats summarizes the proof of work of a chain: the leading zeros of the
+// hashes of its blocks and the time between consecutive blocks. The genesis
+// block isn't mined, so it is left out.
+type PowStats struct {
+	Blocks          int     `json:"blocks"`
+	MinLeadingZeros int     `json:"min_leading_zeros"`
+	MaxLeadingZeros int     `json:"max_leading_zeros"`
+	AvgLeadingZeros float64 `json:"avg_leading_zeros"`
+	// The intervals are in seconds, and zero with fewer than two blocks.
+	MinInterval float64 `json:"min_block_interval_seconds"`
+	MaxInterval float64 `json:"max_block_interval_seconds"`
+	AvgInterval float64 `json:"avg_block_interval_seconds"`
+}
+
+// ComputePowStats computes the PowStats of chain.
+func ComputePowStats(chain []HashedBlock) PowStats {
+	var stats PowStats
+	var zeros int
+	var intervals []float64
+	for i, block := range chain {
+		if block.Index <= 1 {
+			continue
+		}
+		if stats.Blocks == 0 || block.LeadingZeros < stats.MinLeadingZeros {
+			stats.MinLeadingZeros = block.LeadingZeros
+		}
+		if block.LeadingZeros > stats.MaxLeadingZeros {
+			stats.MaxLeadingZeros = block.LeadingZeros
+		}
+		zeros += block.LeadingZeros
+		stats.Blocks++
+		if i > 0 && chain[i-1].Index > 1 {
+			intervals = append(intervals, time.Duration(block.Timestamp-chain[i-1].Timestamp).Seconds())
+		}
+	}
+	if stats.Blocks > 0 {
+		stats.AvgLeadingZeros = float64(zeros) / float64(stats.Blocks)
+	}
+
+	var total float64
+	for i, interval := range intervals {
+		if i == 0 || interval < stats.MinInterval {
+			stats.MinInterval = interval
+		}
+		if i == 0 || interval > stats.MaxInterval {
+			stats.MaxInterval = interval
+		}
+		total += interval
+	}
+	if len(intervals) > 0 {
+		stats.AvgInterval = total / float64(len(intervals))
+	}
+	return stats
+}
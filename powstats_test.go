@@ -0,0 +1,72 @@
+package gochain
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestComputePowStats(t *testing.T) {
+	block := func(index int64, seconds int64, hash string) HashedBlock {
+		return hashedBlock(Block{Index: index, Timestamp: seconds * int64(time.Second)}, hash)
+	}
+	chain := []HashedBlock{
+		block(1, 0, "ab"),
+		block(2, 100, "0ab"),
+		block(3, 102, "000a"),
+		block(4, 108, "00ab"),
+		block(5, 109, "0000"),
+	}
+	want := PowStats{
+		Blocks:          4,
+		MinLeadingZeros: 1,
+		MaxLeadingZeros: 4,
+		AvgLeadingZeros: 2.5,
+		MinInterval:     1,
+		MaxInterval:     6,
+		AvgInterval:     3,
+	}
+	if got := ComputePowStats(chain); got != want {
+		t.Errorf("stats are %+v, want %+v", got, want)
+	}
+
+	// The genesis block alone isn't mined, and one block has no interval.
+	if got := ComputePowStats(chain[:1]); got != (PowStats{}) {
+		t.Errorf("stats of the genesis block are %+v", got)
+	}
+	if got := ComputePowStats(chain[:2]); got != (PowStats{Blocks: 1, MinLeadingZeros: 1, MaxLeadingZeros: 1, AvgLeadingZeros: 1}) {
+		t.Errorf("stats of one mined block are %+v", got)
+	}
+}
+
+func TestPowStatsEndpoint(t *testing.T) {
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, testAddress("miner"))
+	h := NewHandler(bc, testAddress("node"))
+
+	var chain struct {
+		Chain []HashedBlock `json:"chain"`
+	}
+	decodeBody(t, serve(h, http.MethodGet, "/chain", "", nil), &chain)
+	for _, block := range chain.Chain {
+		if block.Hash == "" || block.LeadingZeros != leadingZeros(block.Hash) {
+			t.Errorf("block %d has hash %s with %d leading zeros", block.Index, block.Hash, block.LeadingZeros)
+		}
+	}
+
+	rec := serve(h, http.MethodGet, "/chain/pow-stats", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var got PowStats
+	decodeBody(t, rec, &got)
+	if want := ComputePowStats(bc.HashedChain()); got != want {
+		t.Errorf("stats are %+v, want %+v", got, want)
+	}
+	if got.Blocks != 3 {
+		t.Errorf("stats cover %d blocks, want 3", got.Blocks)
+	}
+	if rec := serve(h, http.MethodPost, "/chain/pow-stats", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
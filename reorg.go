@@ -0,0 +1,105 @@
+package gochain
+
+import "log"
+
+// ReorgEvent describes the replacement of the local chain by a peer's chain.
+type ReorgEvent struct {
+	// ForkIndex is the index of the first block that differs between the
+	// two chains.
+	ForkIndex int64
+	// Depth is the number of local blocks that were discarded.
+	Depth int
+	// Requeued are the transactions of the discarded blocks that the new
+	// chain doesn't contain and that went back to the mempool.
+	Requeued []Transaction
+}
+
+// WithReorgHandler registers a function called every time ResolveConflicts
+// replaces the local chain.
+func WithReorgHandler(fn func(ReorgEvent)) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.onReorg = fn
+	}
+}
+
+// replaceChain switches to newChain, whose block hashes are hashes.
+// Transactions of the discarded blocks
+// that newChain doesn't contain are put back into the mempool if they are
+// still valid, and pending transactions that newChain already contains or
+// made invalid are dropped. bc.mu must be held.
+func (bc *Blockchain) replaceChain(newChain []Block, hashes []string) ReorgEvent {
+	oldChain := bc.chain
+
+	fork := 0
+	for fork < len(oldChain) && fork < len(newChain) && bc.hashes[fork] == hashes[fork] {
+		fork++
+	}
+
+	included := make(map[string]bool)
+	for _, block := range newChain[fork:] {
+		for _, tx := range block.Transactions {
+			included[tx.ID()] = true
+		}
+	}
+
+	bc.chain = newChain
+	bc.hashes = hashes
+	bc.rebuildState()
+	bc.fireWebhooks()
+	bc.keepVerifiedSignatures(hashes)
+	for _, block := range newChain[fork:] {
+		bc.forgetOrphans(block)
+	}
+
+	var pending []Transaction
+	for _, tx := range bc.transactions {
+		if !included[tx.ID()] {
+			pending = append(pending, tx)
+		}
+	}
+	bc.revalidatePending(pending)
+
+	event := ReorgEvent{ForkIndex: int64(fork + 1), Depth: len(oldChain) - fork}
+	for _, block := range oldChain[fork:] {
+		for _, tx := range block.Transactions {
+			if tx.Sender == bc.coinbaseSender || included[tx.ID()] {
+				continue
+			}
+			bc.orphaned = append(bc.orphaned, tx)
+			if err := bc.validateTransaction(tx); err != nil {
+				log.Printf("dropping transaction orphaned by reorg: %v", err)
+				continue
+			}
+			bc.transactions = append(bc.transactions, tx)
+			event.Requeued = append(event.Requeued, tx)
+		}
+	}
+	return event
+}
+
+// Orphans returns the transactions of blocks discarded by a reorg that
+// haven't been mined again since.
+func (bc *Blockchain) Orphans() []Transaction {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return append([]Transaction(nil), bc.orphaned...)
+}
+
+// forgetOrphans removes the orphaned transactions that block contains.
+// bc.mu must be held.
+func (bc *Blockchain) forgetOrphans(block Block) {
+	if len(bc.orphaned) == 0 {
+		return
+	}
+	mined := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		mined[tx.ID()] = true
+	}
+	var orphaned []Transaction
+	for _, tx := range bc.orphaned {
+		if !mined[tx.ID()] {
+			orphaned = append(orphaned, tx)
+		}
+	}
+	bc.orphaned = orphaned
+}
@@ -0,0 +1,123 @@
+package gochain
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// forkedChains returns a node and a peer sharing 3 blocks, after which the
+// node mined a block holding tx and the peer mined 3 blocks, so that the
+// node adopts the chain of the peer when resolving conflicts.
+func forkedChains(t *testing.T, tx Transaction, opts ...BlockchainOption) (bc, peer *Blockchain) {
+	t.Helper()
+	peer = newTestBlockchain(t)
+	mineBlocks(t, peer, 2, tx.Sender)
+	bc = newTestBlockchain(t, opts...)
+	if err := bc.Import(peer.Export()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.NewTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, testAddress("local"))
+	mineBlocks(t, peer, 3, testAddress("peer"))
+	srv, _ := recordingPeer(t, peer)
+	bc.RegisterNode(srv.URL)
+	return bc, peer
+}
+
+func TestReorgEvent(t *testing.T) {
+	tx := Transaction{Sender: testAddress("miner"), Recipient: testAddress("alice"), Amount: 1}
+	var events []ReorgEvent
+	bc, peer := forkedChains(t, tx, WithReorgHandler(func(e ReorgEvent) { events = append(events, e) }))
+
+	if !bc.ResolveConflicts() {
+		t.Fatal("chain of the peer not adopted")
+	}
+	if !reflect.DeepEqual(bc.Chain(), peer.Chain()) {
+		t.Error("chain differs from the peer's")
+	}
+	want := []ReorgEvent{{ForkIndex: 4, Depth: 1, Requeued: []Transaction{tx}}}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events are %+v, want %+v", events, want)
+	}
+	if pending := bc.PendingTransactions(); !reflect.DeepEqual(pending, []Transaction{tx}) {
+		t.Errorf("pending transactions are %v, want the requeued %v", pending, tx)
+	}
+
+	// Nothing to replace, nothing to report.
+	if bc.ResolveConflicts() || len(events) != 1 {
+		t.Errorf("%d events after resolving an adopted chain", len(events))
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	tx := Transaction{Sender: testAddress("miner"), Recipient: testAddress("alice"), Amount: 1}
+	bc, _ := forkedChains(t, tx)
+	h := NewHandler(bc, testAddress("node"))
+	orphans := func() []Transaction {
+		var body struct {
+			Count        int           `json:"count"`
+			Transactions []Transaction `json:"transactions"`
+		}
+		decodeBody(t, serve(h, http.MethodGet, "/orphans", "", nil), &body)
+		if body.Count != len(body.Transactions) {
+			t.Fatalf("count %d for %d orphans", body.Count, len(body.Transactions))
+		}
+		return body.Transactions
+	}
+
+	if got := orphans(); len(got) != 0 {
+		t.Fatalf("orphans before the reorg: %v", got)
+	}
+	if !bc.ResolveConflicts() {
+		t.Fatal("chain of the peer not adopted")
+	}
+	if got := orphans(); !reflect.DeepEqual(got, []Transaction{tx}) {
+		t.Fatalf("orphans are %v, want %v", got, tx)
+	}
+	// Mining the requeued transaction again clears it.
+	mineBlocks(t, bc, 1, testAddress("local"))
+	if got := orphans(); len(got) != 0 {
+		t.Errorf("orphans once mined again: %v", got)
+	}
+}
+
+func TestReorgDropsDoubleSpends(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 2, miner)
+	if _, err := peer.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, peer, 1, miner)
+	bc := newTestBlockchain(t)
+	if err := bc.Import(peer.Export()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice spends her only coin on both chains, to different recipients,
+	// and the peer's chain wins.
+	mineBlocks(t, bc, 1, testAddress("local"))
+	if _, err := bc.NewTransaction(Transaction{Sender: alice, Recipient: testAddress("bob"), Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.NewTransaction(Transaction{Sender: alice, Recipient: testAddress("carol"), Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, peer, 3, testAddress("peer"))
+	srv, _ := recordingPeer(t, peer)
+	bc.RegisterNode(srv.URL)
+
+	if !bc.ResolveConflicts() {
+		t.Fatal("chain of the peer not adopted")
+	}
+	if n := len(bc.PendingTransactions()); n != 0 {
+		t.Errorf("%d transactions pending after the double spend was mined, want 0", n)
+	}
+	mineBlocks(t, bc, 1, testAddress("local"))
+	if err := bc.ValidateLocalChain(); err != nil {
+		t.Errorf("chain mined after the reorg is invalid: %v", err)
+	}
+}
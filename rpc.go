@@ -0,0 +1,198 @@
+package gochain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	// rpcServerError is used for the errors returned by the blockchain, like
+	// a rejected transaction.
+	rpcServerError = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcMethod runs a call with its positional params.
+type rpcMethod func(h *handler, params []json.RawMessage) (interface{}, error)
+
+var rpcMethods = map[string]rpcMethod{
+	"chain_getHead":         rpcGetHead,
+	"chain_getBlockByIndex": rpcGetBlockByIndex,
+	"tx_submit":             rpcSubmitTransaction,
+	"node_register":         rpcRegisterNode,
+}
+
+// RPC serves JSON-RPC 2.0 requests, single or batched, on top of the same
+// blockchain methods as the REST endpoints.
+func (h *handler) RPC(w http.ResponseWriter, r *http.Request) response {
+	if r.Method != http.MethodPost {
+		return response{
+			nil,
+			http.StatusMethodNotAllowed,
+			fmt.Errorf("%w: %s", ErrMethodNotAllowed, r.Method),
+		}
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		if isBodyTooLarge(err) {
+			return response{nil, http.StatusRequestEntityTooLarge, err}
+		}
+		return response{rpcFailure(nil, rpcParseError, err.Error()), http.StatusOK, nil}
+	}
+
+	if body = bytes.TrimSpace(body); len(body) == 0 || body[0] != '[' {
+		resp, ok := h.rpcCall(body)
+		if !ok {
+			return response{nil, http.StatusNoContent, nil}
+		}
+		return response{resp, http.StatusOK, nil}
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return response{rpcFailure(nil, rpcParseError, err.Error()), http.StatusOK, nil}
+	}
+	if len(batch) == 0 {
+		return response{rpcFailure(nil, rpcInvalidRequest, "empty batch"), http.StatusOK, nil}
+	}
+	responses := make([]rpcResponse, 0, len(batch))
+	for _, raw := range batch {
+		if resp, ok := h.rpcCall(raw); ok {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		return response{nil, http.StatusNoContent, nil}
+	}
+	return response{responses, http.StatusOK, nil}
+}
+
+// rpcCall runs a single call. Notifications, calls without an id, get no
+// response, in which case it returns false.
+func (h *handler) rpcCall(raw json.RawMessage) (rpcResponse, bool) {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return rpcFailure(nil, rpcInvalidRequest, "invalid request"), true
+	}
+
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		return rpcFailure(req.ID, rpcMethodNotFound, fmt.Sprintf("method %q not found", req.Method)), req.ID != nil
+	}
+	var params []json.RawMessage
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return rpcFailure(req.ID, rpcInvalidParams, "params must be an array"), req.ID != nil
+		}
+	}
+
+	result, err := method(h, params)
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{rpcServerError, err.Error()}
+		}
+		return rpcFailure(req.ID, rpcErr.Code, rpcErr.Message), req.ID != nil
+	}
+	return rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result}, req.ID != nil
+}
+
+func rpcFailure(id json.RawMessage, code int, message string) rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{code, message}}
+}
+
+// rpcParams decodes the positional params into v, which must have exactly
+// one destination per param.
+func rpcParams(params []json.RawMessage, v ...interface{}) error {
+	if len(params) != len(v) {
+		return &rpcError{rpcInvalidParams, fmt.Sprintf("expected %d params, got %d", len(v), len(params))}
+	}
+	for i, param := range params {
+		if err := json.Unmarshal(param, v[i]); err != nil {
+			return &rpcError{rpcInvalidParams, fmt.Sprintf("param %d: %v", i, err)}
+		}
+	}
+	return nil
+}
+
+func rpcGetHead(h *handler, params []json.RawMessage) (interface{}, error) {
+	if err := rpcParams(params); err != nil {
+		return nil, err
+	}
+	return h.blockchain.chainHead(), nil
+}
+
+func rpcGetBlockByIndex(h *handler, params []json.RawMessage) (interface{}, error) {
+	var index int64
+	if err := rpcParams(params, &index); err != nil {
+		return nil, err
+	}
+	return h.blockchain.GetBlockByIndex(index)
+}
+
+func rpcSubmitTransaction(h *handler, params []json.RawMessage) (interface{}, error) {
+	if len(params) != 1 {
+		return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("expected 1 param, got %d", len(params))}
+	}
+	tx, err := DecodeTransaction(bytes.NewReader(params[0]))
+	if err != nil {
+		return nil, &rpcError{rpcInvalidParams, err.Error()}
+	}
+	tx = h.blockchain.withFee(tx)
+	index, err := h.blockchain.NewTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"id": tx.ID(), "block_index": index}, nil
+}
+
+func rpcRegisterNode(h *handler, params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := rpcParams(params, &address); err != nil {
+		return nil, err
+	}
+	// The call can't be signed on its own, nodes must then be registered
+	// with /nodes/register.
+	if h.blockchain.networkSecret != "" {
+		return nil, fmt.Errorf("nodes must be registered with a signed request to /nodes/register")
+	}
+	added, err := h.blockchain.AddNode(address)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]bool{"added": added}, nil
+}
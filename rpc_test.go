@@ -0,0 +1,101 @@
+package gochain
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// rpcReply is rpcResponse with a result that can be decoded.
+type rpcReply struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result"`
+	Error   *rpcError       `json:"error"`
+}
+
+func TestRPC(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	h := NewHandler(bc, testAddress("node"))
+
+	for _, tc := range []struct {
+		body   string
+		id     string
+		result string
+		code   int
+	}{
+		{`{"jsonrpc": "2.0", "id": 1, "method": "chain_getHead"}`, "1", `"length":3`, 0},
+		{`{"jsonrpc": "2.0", "id": "a", "method": "chain_getBlockByIndex", "params": [2]}`, `"a"`, `"index":2`, 0},
+		{`{"jsonrpc": "2.0", "id": 2, "method": "chain_getBlockByIndex", "params": [9]}`, "2", "", rpcServerError},
+		{`{"jsonrpc": "2.0", "id": 3, "method": "chain_getBlockByIndex", "params": ["2"]}`, "3", "", rpcInvalidParams},
+		{`{"jsonrpc": "2.0", "id": 4, "method": "chain_getHead", "params": {"a": 1}}`, "4", "", rpcInvalidParams},
+		{`{"jsonrpc": "2.0", "id": 5, "method": "chain_nope"}`, "5", "", rpcMethodNotFound},
+		{`{"jsonrpc": "1.0", "id": 6, "method": "chain_getHead"}`, "null", "", rpcInvalidRequest},
+		{`{"jsonrpc": "2.0", "id": 7, "method": "tx_submit", "params": [{"sender": "` + miner + `", "ammount": 1}]}`, "7", "", rpcInvalidParams},
+		{`{bad`, "null", "", rpcParseError},
+		{`[]`, "null", "", rpcInvalidRequest},
+	} {
+		rec := serve(h, http.MethodPost, "/rpc", tc.body, nil)
+		var got rpcReply
+		decodeBody(t, rec, &got)
+		if got.JSONRPC != "2.0" || string(got.ID) != tc.id {
+			t.Errorf("%s: answered version %q with id %s, want 2.0 and %s", tc.body, got.JSONRPC, got.ID, tc.id)
+		}
+		switch {
+		case tc.code != 0 && (got.Error == nil || got.Error.Code != tc.code):
+			t.Errorf("%s: error %+v, want code %d", tc.body, got.Error, tc.code)
+		case tc.code == 0 && (got.Error != nil || !containsJSON(got.Result, tc.result)):
+			t.Errorf("%s: result %s, error %+v, want %s in the result", tc.body, got.Result, got.Error, tc.result)
+		}
+	}
+	if n := len(bc.PendingTransactions()); n != 0 {
+		t.Fatalf("%d transactions pending after failed calls", n)
+	}
+}
+
+func TestRPCBatch(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	h := NewHandler(bc, testAddress("node"))
+
+	// The notification, the call without an id, gets no response.
+	rec := serve(h, http.MethodPost, "/rpc", `[
+		{"jsonrpc": "2.0", "id": 1, "method": "tx_submit", "params": [{"sender": "`+miner+`", "recipient": "`+testAddress("alice")+`", "amount": 1}]},
+		{"jsonrpc": "2.0", "method": "chain_getHead"},
+		{"jsonrpc": "2.0", "id": 2, "method": "chain_nope"}
+	]`, nil)
+	var got []rpcReply
+	decodeBody(t, rec, &got)
+	if len(got) != 2 || string(got[0].ID) != "1" || string(got[1].ID) != "2" {
+		t.Fatalf("answered %+v, want the calls 1 and 2", got)
+	}
+	if got[0].Error != nil || got[1].Error == nil || got[1].Error.Code != rpcMethodNotFound {
+		t.Errorf("errors are %+v and %+v, want only the second call to fail", got[0].Error, got[1].Error)
+	}
+	if n := len(bc.PendingTransactions()); n != 1 {
+		t.Errorf("%d transactions pending, want the one submitted", n)
+	}
+
+	for _, body := range []string{
+		`{"jsonrpc": "2.0", "method": "chain_getHead"}`,
+		`[{"jsonrpc": "2.0", "method": "chain_getHead"}]`,
+	} {
+		if rec := serve(h, http.MethodPost, "/rpc", body, nil); rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+			t.Errorf("%s: status %d with %q, want 204 and no body", body, rec.Code, rec.Body)
+		}
+	}
+}
+
+// containsJSON reports whether the compact form of data holds part.
+func containsJSON(data json.RawMessage, part string) bool {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return false
+	}
+	compact, _ := json.Marshal(v)
+	return bytes.Contains(compact, []byte(part))
+}
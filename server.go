@@ -0,0 +1,86 @@
+package gochain
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Server serves a node's handler over HTTP and can be shut down gracefully.
+type Server struct {
+	server *http.Server
+	cancel context.CancelFunc
+}
+
+// ServerOption configures the server created by NewServer.
+type ServerOption func(*Server)
+
+// WithReadTimeout limits how long reading a request, body included, may
+// take.
+func WithReadTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.server.ReadTimeout = timeout
+	}
+}
+
+// WithWriteTimeout limits how long handling a request and writing its
+// response may take. Synchronous mining requests that take longer lose their
+// connection, see WithMineTimeout to answer them in time instead.
+func WithWriteTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.server.WriteTimeout = timeout
+	}
+}
+
+// WithIdleTimeout limits how long an idle keep-alive connection stays open.
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.server.IdleTimeout = timeout
+	}
+}
+
+// NewServer returns a server for handler. Without options, it sets no
+// timeouts.
+func NewServer(handler http.Handler, opts ...ServerOption) *Server {
+	// Every request inherits ctx, so cancelling it on shutdown stops the
+	// mining requests instead of waiting for them to find a proof.
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		server: &http.Server{
+			Handler:     handler,
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		},
+		cancel: cancel,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Start listens on addr and serves requests until the server is shut down.
+func (s *Server) Start(addr string) error {
+	s.server.Addr = addr
+	if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// StartTLS is Start, except that it serves HTTPS with the certificate and
+// key in the given PEM files.
+func (s *Server) StartTLS(addr, certFile, keyFile string) error {
+	s.server.Addr = addr
+	if err := s.server.ListenAndServeTLS(certFile, keyFile); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections, cancels ongoing mining and waits
+// for the in-flight requests to finish, or for ctx to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+	return s.server.Shutdown(ctx)
+}
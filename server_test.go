@@ -0,0 +1,186 @@
+package gochain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// freeAddress returns a local address nothing listens on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startServer starts s on a free address and waits until it accepts
+// requests. The returned channel receives what Start returned.
+func startServer(t *testing.T, s *Server) (string, <-chan error) {
+	t.Helper()
+	return listen(t, s.Start)
+}
+
+// listen runs start on a free address and waits until it accepts
+// connections. The returned channel receives what start returned.
+func listen(t *testing.T, start func(addr string) error) (string, <-chan error) {
+	t.Helper()
+	addr := freeAddress(t)
+	started := make(chan error, 1)
+	go func() { started <- start(addr) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr, started
+		}
+		select {
+		case err := <-started:
+			t.Fatalf("server stopped before listening: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server not listening")
+		}
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	h := NewHandler(newTestBlockchain(t), testAddress("node"))
+	if s := NewServer(h).server; s.ReadTimeout != 0 || s.WriteTimeout != 0 || s.IdleTimeout != 0 {
+		t.Errorf("default timeouts are %v, %v and %v, want none", s.ReadTimeout, s.WriteTimeout, s.IdleTimeout)
+	}
+	s := NewServer(h, WithReadTimeout(time.Second), WithWriteTimeout(2*time.Second), WithIdleTimeout(3*time.Second)).server
+	if s.ReadTimeout != time.Second || s.WriteTimeout != 2*time.Second || s.IdleTimeout != 3*time.Second {
+		t.Errorf("timeouts are %v, %v and %v, want 1s, 2s and 3s", s.ReadTimeout, s.WriteTimeout, s.IdleTimeout)
+	}
+}
+
+func TestServerShutdownCancelsMining(t *testing.T) {
+	// Finding a proof at this difficulty takes far longer than the test.
+	bc := newTestBlockchain(t, WithDifficulty(12))
+	s := NewServer(NewHandler(bc, testAddress("node")))
+	addr, started := startServer(t, s)
+
+	mined := make(chan int, 1)
+	go func() {
+		response, err := http.Get("http://" + addr + "/mine")
+		if err != nil {
+			mined <- 0
+			return
+		}
+		response.Body.Close()
+		mined <- response.StatusCode
+	}()
+	// Let the request start mining.
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+	if status := <-mined; status != http.StatusServiceUnavailable {
+		t.Errorf("mining request answered %d, want 503", status)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Start returned %v", err)
+	}
+	if bc.LastBlock().Index != 1 {
+		t.Error("block mined after shutdown")
+	}
+}
+
+// selfSignedCertificate writes a certificate for 127.0.0.1 and its key to
+// PEM files in a temporary directory, and returns their paths and the
+// certificate.
+func selfSignedCertificate(t *testing.T) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestStartTLS(t *testing.T) {
+	certFile, keyFile, cert := selfSignedCertificate(t)
+	peer := newTestBlockchain(t)
+	mineBlocks(t, peer, 3, testAddress("peer"))
+	s := NewServer(NewHandler(peer, testAddress("peer")))
+	addr, started := listen(t, func(addr string) error { return s.StartTLS(addr, certFile, keyFile) })
+
+	// Peers trusting the certificate sync over HTTPS.
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	bc := newTestBlockchain(t, WithHTTPClient(client))
+	bc.RegisterNode("https://" + addr)
+	if !bc.ResolveConflicts() || bc.Len() != 4 {
+		t.Errorf("chain of %d blocks after syncing over HTTPS, want 4", bc.Len())
+	}
+	// The others don't.
+	if _, err := http.Get("https://" + addr + "/chain"); err == nil {
+		t.Error("request accepted a self-signed certificate")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("StartTLS returned %v", err)
+	}
+}
+
+func TestStartTLSWithoutCertificate(t *testing.T) {
+	s := NewServer(NewHandler(newTestBlockchain(t), testAddress("node")))
+	dir := t.TempDir()
+	if err := s.StartTLS(freeAddress(t), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Error("StartTLS without certificate files returned nil")
+	}
+}
@@ -0,0 +1,87 @@
+package gochain
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+)
+
+// maxVerifiedSignatures bounds the number of block hashes remembered by
+// checkMinerSignatureCached. The cache starts over once it is full.
+const maxVerifiedSignatures = 100000
+
+// WithMinerKey makes the node sign the header of every block it mines with
+// key, so that the blocks can be traced back to their miner. The public key
+// and the signature are stored in the block.
+func WithMinerKey(key ed25519.PrivateKey) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.minerKey = key
+	}
+}
+
+// signBlock signs the header of block with the miner key, if there is one.
+func (bc *Blockchain) signBlock(block *Block) {
+	if bc.minerKey == nil {
+		return
+	}
+	block.MinerPubKey = append([]byte(nil), bc.minerKey.Public().(ed25519.PublicKey)...)
+	block.MinerSignature = ed25519.Sign(bc.minerKey, blockHeader(*block))
+}
+
+// checkMinerSignature checks the signature of a signed block. Unsigned
+// blocks, which have neither a public key nor a signature, are valid.
+func checkMinerSignature(block Block) error {
+	if len(block.MinerPubKey) == 0 && len(block.MinerSignature) == 0 {
+		return nil
+	}
+	if len(block.MinerPubKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("miner public key has %d bytes instead of %d", len(block.MinerPubKey), ed25519.PublicKeySize)
+	}
+	if !ed25519.Verify(block.MinerPubKey, blockHeader(block), block.MinerSignature) {
+		return errors.New("miner signature doesn't match the block header")
+	}
+	return nil
+}
+
+// checkMinerSignatureCached is checkMinerSignature for the block whose hash
+// is hash, remembering the blocks whose signature was found valid, so that
+// the repeated validations of the same chain during consensus verify every
+// signature once. The hash covers the header, the public key and the
+// signature, so a block with a remembered hash is signed validly.
+func (bc *Blockchain) checkMinerSignatureCached(block Block, hash string) error {
+	if len(block.MinerPubKey) == 0 && len(block.MinerSignature) == 0 {
+		return nil
+	}
+	bc.signatureMu.Lock()
+	verified := bc.verifiedSignatures[hash]
+	bc.signatureMu.Unlock()
+	if verified {
+		return nil
+	}
+
+	if err := checkMinerSignature(block); err != nil {
+		return err
+	}
+	bc.signatureMu.Lock()
+	defer bc.signatureMu.Unlock()
+	if len(bc.verifiedSignatures) >= maxVerifiedSignatures {
+		bc.verifiedSignatures = make(map[string]bool)
+	}
+	bc.verifiedSignatures[hash] = true
+	return nil
+}
+
+// keepVerifiedSignatures drops from the cache of checkMinerSignatureCached
+// the blocks that aren't among hashes, the hashes of the new chain after a
+// reorg or an import, so that the cache doesn't keep the discarded chains.
+func (bc *Blockchain) keepVerifiedSignatures(hashes []string) {
+	bc.signatureMu.Lock()
+	defer bc.signatureMu.Unlock()
+	kept := make(map[string]bool)
+	for _, hash := range hashes {
+		if bc.verifiedSignatures[hash] {
+			kept[hash] = true
+		}
+	}
+	bc.verifiedSignatures = kept
+}
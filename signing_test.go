@@ -0,0 +1,136 @@
+package gochain
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+// testMinerKey returns a fixed miner key derived from seed.
+func testMinerKey(seed byte) ed25519.PrivateKey {
+	s := make([]byte, ed25519.SeedSize)
+	for i := range s {
+		s[i] = seed
+	}
+	return ed25519.NewKeyFromSeed(s)
+}
+
+func TestMinerSignature(t *testing.T) {
+	key := testMinerKey(1)
+	bc := newTestBlockchain(t, WithMinerKey(key))
+	mineBlocks(t, bc, 2, testAddress("miner"))
+	chain := bc.Chain()
+	if err := bc.ValidateChain(chain); err != nil {
+		t.Fatal(err)
+	}
+	last := chain[len(chain)-1]
+	if !bytes.Equal(last.MinerPubKey, key.Public().(ed25519.PublicKey)) {
+		t.Fatalf("block signed by %x, want the miner key", last.MinerPubKey)
+	}
+	// The signature covers the header but not itself.
+	unsigned := last
+	unsigned.MinerSignature = nil
+	if !bytes.Equal(blockHeader(unsigned), blockHeader(last)) {
+		t.Error("header depends on the signature")
+	}
+
+	otherKey := testMinerKey(2)
+	for name, tamper := range map[string]func(*Block){
+		"timestamp changed": func(b *Block) { b.Timestamp++ },
+		"transactions changed": func(b *Block) {
+			b.Transactions = []Transaction{{Sender: "0", Recipient: testAddress("thief"), Amount: 1}}
+			b.MerkleRoot = MerkleRoot(b.Transactions)
+		},
+		"other public key": func(b *Block) {
+			b.MinerPubKey = otherKey.Public().(ed25519.PublicKey)
+		},
+		"signed by another key": func(b *Block) {
+			b.MinerSignature = ed25519.Sign(otherKey, blockHeader(*b))
+		},
+		"short public key":  func(b *Block) { b.MinerPubKey = b.MinerPubKey[:8] },
+		"unsigned with key": func(b *Block) { b.MinerSignature = nil },
+	} {
+		tampered := append([]Block(nil), chain...)
+		block := tampered[len(tampered)-1]
+		block.MinerPubKey = append([]byte(nil), block.MinerPubKey...)
+		tamper(&block)
+		tampered[len(tampered)-1] = block
+		if err := checkMinerSignature(block); err == nil {
+			t.Errorf("%s: signature accepted", name)
+		}
+		if err := newTestBlockchain(t).ValidateChain(tampered); !errors.Is(err, ErrInvalidChain) {
+			t.Errorf("%s: chain validation returned %v, want ErrInvalidChain", name, err)
+		}
+	}
+
+	// Blocks of miners without a key stay valid.
+	unsignedChain := newTestBlockchain(t)
+	mineBlocks(t, unsignedChain, 2, testAddress("miner"))
+	if err := bc.ValidateChain(unsignedChain.Chain()); err != nil {
+		t.Errorf("unsigned chain: %v", err)
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	miner := newTestBlockchain(t, WithMinerKey(testMinerKey(1)))
+	mineBlocks(t, miner, 3, testAddress("miner"))
+	chain := miner.Chain()
+
+	bc := newTestBlockchain(t)
+	if err := bc.ValidateChain(chain); err != nil {
+		t.Fatal(err)
+	}
+	// The genesis block was signed too.
+	if len(bc.verifiedSignatures) != 4 {
+		t.Fatalf("%d signatures remembered, want 4", len(bc.verifiedSignatures))
+	}
+
+	// A remembered block with another signature has another hash, so it is
+	// verified again.
+	tampered := append([]Block(nil), chain...)
+	tampered[3].MinerSignature = append([]byte(nil), tampered[3].MinerSignature...)
+	tampered[3].MinerSignature[0] ^= 1
+	if err := bc.ValidateChain(tampered); err == nil {
+		t.Fatal("chain with a tampered signature accepted")
+	}
+
+	// Replacing the chain forgets the blocks that aren't in the new chain.
+	bc.verifiedSignatures["discarded"] = true
+	if err := bc.Import(miner.Export()); err != nil {
+		t.Fatal(err)
+	}
+	if bc.verifiedSignatures["discarded"] || len(bc.verifiedSignatures) != 4 {
+		t.Errorf("after the import the cache holds %v", bc.verifiedSignatures)
+	}
+}
+
+// BenchmarkValidateSignedChain compares validating a chain of signed blocks
+// with every signature verified against validating it again, as consensus
+// rounds do, with the signatures remembered.
+func BenchmarkValidateSignedChain(b *testing.B) {
+	miner := newTestBlockchain(b, WithMinerKey(testMinerKey(1)))
+	mineBlocks(b, miner, 500, testAddress("miner"))
+	chain := miner.Chain()
+	bc := newTestBlockchain(b)
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bc.keepVerifiedSignatures(nil)
+			if err := bc.ValidateChain(chain); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		if err := bc.ValidateChain(chain); err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := bc.ValidateChain(chain); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package gochain
+
+import (
+	"fmt"
+	"sort"
+)
+
+// State is what the chain adds up to: the balance of every address and the
+// number of coins in circulation. It is kept up to date as blocks are added,
+// so that queries don't have to replay the chain.
+type State struct {
+	Balances map[string]int64 `json:"balances"`
+	Supply   int64            `json:"supply"`
+
+	coinbase string // sender of the minting transactions
+}
+
+func newState(coinbase string) *State {
+	return &State{Balances: make(map[string]int64), coinbase: coinbase}
+}
+
+// apply updates the state with the transactions of block. Coins minted by
+// the coinbase sender add to the supply, while fees leave it, as they are
+// paid back to the miner as part of the minted reward. Coins sent to the
+// coinbase sender are burnt and leave it too.
+func (s *State) apply(block Block) {
+	for _, tx := range block.Transactions {
+		if tx.Sender != s.coinbase {
+			s.Supply -= tx.Fee
+		}
+		s.Balances[tx.Sender] -= tx.cost()
+		for _, out := range tx.payouts() {
+			s.Balances[out.Recipient] += out.Amount
+			if tx.Sender == s.coinbase {
+				s.Supply += out.Amount
+			}
+			if out.Recipient == s.coinbase {
+				s.Supply -= out.Amount
+			}
+		}
+	}
+}
+
+// RebuildState replays the whole chain to compute its state from scratch.
+func (bc *Blockchain) RebuildState() {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.rebuildState()
+}
+
+func (bc *Blockchain) rebuildState() {
+	state := newState(bc.coinbaseSender)
+	for _, block := range bc.chain {
+		state.apply(block)
+	}
+	bc.state = state
+}
+
+// AddressBalance is the balance of an address.
+type AddressBalance struct {
+	Address string `json:"address"`
+	Balance int64  `json:"balance"`
+}
+
+// RichList returns the n addresses owning the most coins, richest first.
+// Addresses with the same balance are sorted by address. It reads the
+// balances from the state, so only the addresses are sorted, the chain
+// isn't replayed.
+func (bc *Blockchain) RichList(n int) []AddressBalance {
+	bc.mu.RLock()
+	list := make([]AddressBalance, 0, len(bc.state.Balances))
+	for address, balance := range bc.state.Balances {
+		// The coinbase sender mints the coins, its balance is minus what
+		// it minted, plus what was burnt.
+		if address != bc.coinbaseSender && balance > 0 {
+			list = append(list, AddressBalance{address, balance})
+		}
+	}
+	bc.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Balance != list[j].Balance {
+			return list[i].Balance > list[j].Balance
+		}
+		return list[i].Address < list[j].Address
+	})
+	if n < len(list) {
+		list = list[:n]
+	}
+	return list
+}
+
+// Inconsistency is a problem found by Reindex in the block at Index.
+type Inconsistency struct {
+	Index   int64  `json:"index"`
+	Problem string `json:"problem"`
+}
+
+// ReindexReport is what Reindex found while replaying the chain.
+type ReindexReport struct {
+	Blocks          int             `json:"blocks"`
+	Supply          int64           `json:"supply"`
+	Inconsistencies []Inconsistency `json:"inconsistencies"`
+}
+
+// Reindex replays the whole chain to rebuild its state, like RebuildState,
+// and reports the blocks breaking the economic rules on the way: blocks
+// minting more or less than their reward, spending coins that aren't there
+// or leaving an address with a negative balance. Unlike ValidateChain it
+// doesn't stop at the first problem, and it doesn't check the hashes and
+// proofs linking the blocks. The supply is also checked against the
+// balances once the chain is replayed, and the rebuilt state against the
+// one kept up to date as blocks were added.
+func (bc *Blockchain) Reindex() ReindexReport {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	report := ReindexReport{Blocks: len(bc.chain), Inconsistencies: []Inconsistency{}}
+	inconsistent := func(index int64, format string, args ...interface{}) {
+		report.Inconsistencies = append(report.Inconsistencies, Inconsistency{index, fmt.Sprintf(format, args...)})
+	}
+
+	state := newState(bc.coinbaseSender)
+	for _, block := range bc.chain {
+		// Only the addresses the block touches are needed to check it, and
+		// working on a copy of them lets the replay go on if it's invalid.
+		touched := make(map[string]int64)
+		for _, tx := range block.Transactions {
+			touched[tx.Sender] = state.Balances[tx.Sender]
+			for _, out := range tx.payouts() {
+				touched[out.Recipient] = state.Balances[out.Recipient]
+			}
+		}
+		if err := bc.checkBlockTransactions(block, touched); err != nil {
+			inconsistent(block.Index, "%v", err)
+		}
+
+		state.apply(block)
+		for _, address := range sortedKeys(touched) {
+			if address != bc.coinbaseSender && state.Balances[address] < 0 {
+				inconsistent(block.Index, "balance of %s is %d", address, state.Balances[address])
+			}
+		}
+	}
+	report.Supply = state.Supply
+
+	// The coins in circulation are the balances of everyone but the
+	// coinbase sender.
+	var sum int64
+	for address, balance := range state.Balances {
+		if address != bc.coinbaseSender {
+			sum += balance
+		}
+	}
+	index := bc.lastBlock().Index
+	if sum != state.Supply {
+		inconsistent(index, "supply is %d but the balances add up to %d", state.Supply, sum)
+	}
+	if bc.state.Supply != state.Supply {
+		inconsistent(index, "stored supply was %d", bc.state.Supply)
+	}
+	for _, address := range sortedKeys(bc.state.Balances) {
+		if balance := bc.state.Balances[address]; state.Balances[address] != balance {
+			inconsistent(index, "stored balance of %s was %d instead of %d", address, balance, state.Balances[address])
+		}
+	}
+	for _, address := range sortedKeys(state.Balances) {
+		if _, ok := bc.state.Balances[address]; !ok {
+			inconsistent(index, "stored state has no balance for %s, which has %d", address, state.Balances[address])
+		}
+	}
+
+	bc.state = state
+	return report
+}
+
+// sortedKeys returns the addresses of balances in order, so that reports
+// list them the same way every time.
+func sortedKeys(balances map[string]int64) []string {
+	keys := make([]string, 0, len(balances))
+	for address := range balances {
+		keys = append(keys, address)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,164 @@
+package gochain
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestTotalSupply(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t)
+	if got := bc.TotalSupply(); got != 0 {
+		t.Fatalf("supply of the genesis block is %d, want 0", got)
+	}
+	mineBlocks(t, bc, 3, miner)
+	if got := bc.TotalSupply(); got != 3 {
+		t.Fatalf("supply after 3 blocks is %d, want 3", got)
+	}
+	// Fees move coins, only the reward mints new ones.
+	if _, err := bc.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1, Fee: 1}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, miner)
+	if got := bc.TotalSupply(); got != 4 {
+		t.Errorf("supply after a block with a fee is %d, want 4", got)
+	}
+	if got := bc.Balance(miner) + bc.Balance(alice); got != bc.TotalSupply() {
+		t.Errorf("balances add up to %d, want the supply of %d", got, bc.TotalSupply())
+	}
+
+	rec := serve(NewHandler(bc, testAddress("node")), http.MethodGet, "/supply", "", nil)
+	var got struct {
+		TotalSupply int64 `json:"total_supply"`
+	}
+	decodeBody(t, rec, &got)
+	if got.TotalSupply != 4 {
+		t.Errorf("/supply answered %d, want 4", got.TotalSupply)
+	}
+}
+
+func TestSupplyOfMultipleOutputMint(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	s := newState(DefaultCoinbaseSender)
+	s.apply(Block{Transactions: []Transaction{{
+		Sender:  DefaultCoinbaseSender,
+		Outputs: []Output{{Recipient: miner, Amount: 2}, {Recipient: alice, Amount: 3}},
+	}}})
+	if s.Supply != 5 {
+		t.Errorf("supply after minting 2 and 3 coins is %d, want 5", s.Supply)
+	}
+	if got := s.Balances[miner] + s.Balances[alice]; got != s.Supply {
+		t.Errorf("balances add up to %d, want the supply of %d", got, s.Supply)
+	}
+}
+
+func TestRebuildState(t *testing.T) {
+	tx := Transaction{Sender: testAddress("miner"), Recipient: testAddress("alice"), Amount: 1, Fee: 1}
+	bc, _ := forkedChains(t, tx)
+	if !bc.ResolveConflicts() {
+		t.Fatal("chain of the peer not adopted")
+	}
+	mineBlocks(t, bc, 1, testAddress("local"))
+
+	// The state kept up to date through the import, the reorg and the
+	// blocks mined is what replaying the chain gives.
+	kept := *bc.state
+	bc.RebuildState()
+	if !reflect.DeepEqual(*bc.state, kept) {
+		t.Errorf("kept state %+v, rebuilt %+v", kept, *bc.state)
+	}
+
+	bc.state.Balances[testAddress("alice")] = 100
+	bc.state.Supply = 100
+	bc.RebuildState()
+	if !reflect.DeepEqual(*bc.state, kept) {
+		t.Errorf("damaged state rebuilt to %+v, want %+v", *bc.state, kept)
+	}
+}
+
+func TestRichList(t *testing.T) {
+	a, b, c, d, e := testAddress("a"), testAddress("b"), testAddress("c"), testAddress("d"), testAddress("e")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, a)
+	mineBlocks(t, bc, 2, b)
+	mineBlocks(t, bc, 2, c)
+	// a gives everything away, and is no longer listed.
+	if _, err := bc.NewTransaction(Transaction{Sender: a, Recipient: d, Amount: 3}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, e)
+
+	first, second := b, c
+	if c < b {
+		first, second = c, b
+	}
+	want := []AddressBalance{{d, 3}, {first, 2}, {second, 2}, {e, 1}}
+	if got := bc.RichList(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("rich list is %v, want %v", got, want)
+	}
+
+	h := NewHandler(bc, testAddress("node"))
+	var got []AddressBalance
+	decodeBody(t, serve(h, http.MethodGet, "/richlist?limit=2", "", nil), &got)
+	if !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("/richlist?limit=2 answered %v, want %v", got, want[:2])
+	}
+	for _, limit := range []string{"0", "-1", "ten"} {
+		if rec := serve(h, http.MethodGet, "/richlist?limit="+limit, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("limit %s: status %d, want 400", limit, rec.Code)
+		}
+	}
+}
+
+func TestReindex(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 2, miner)
+	if _, err := bc.NewTransaction(Transaction{Sender: miner, Recipient: alice, Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, miner)
+	h := NewHandler(bc, testAddress("node"))
+	reindex := func() (got ReindexReport) {
+		t.Helper()
+		rec := serve(h, http.MethodPost, "/chain/reindex", "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		decodeBody(t, rec, &got)
+		return got
+	}
+
+	if got, want := reindex(), (ReindexReport{Blocks: 4, Supply: 3, Inconsistencies: []Inconsistency{}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("consistent chain: %+v, want %+v", got, want)
+	}
+
+	// Block 3 mints 100 coins, which the state never saw, and the miner
+	// spends more than that in block 4.
+	bc.mu.Lock()
+	bc.chain[2].Transactions[0].Amount = 100
+	bc.chain[3].Transactions[0].Amount = 150
+	bc.mu.Unlock()
+	want := []Inconsistency{
+		{3, "block mints 100 coins but its reward is 1"},
+		{4, "insufficient funds: " + miner + " has 101 but the transaction costs 150"},
+		{4, "balance of " + miner + " is -48"},
+		{4, "stored supply was 3"},
+		{4, "stored balance of " + DefaultCoinbaseSender + " was -3 instead of -102"},
+		{4, "stored balance of " + alice + " was 1 instead of 150"},
+		{4, "stored balance of " + miner + " was 2 instead of -48"},
+	}
+	got := reindex()
+	if got.Supply != 102 || !reflect.DeepEqual(got.Inconsistencies, want) {
+		t.Errorf("inconsistent chain: supply %d with %q, want 102 with %q", got.Supply, got.Inconsistencies, want)
+	}
+	// The state is rebuilt, so only the problems of the blocks are left.
+	if got := reindex(); !reflect.DeepEqual(got.Inconsistencies, want[:3]) {
+		t.Errorf("second reindex found %q, want %q", got.Inconsistencies, want[:3])
+	}
+
+	if rec := serve(h, http.MethodGet, "/chain/reindex", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", rec.Code)
+	}
+}
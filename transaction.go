@@ -0,0 +1,224 @@
+package gochain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+type Transaction struct {
+	Sender    string   `json:"sender"`
+	Recipient string   `json:"recipient,omitempty"`
+	Amount    int64    `json:"amount,omitempty"`
+	Outputs   []Output `json:"outputs,omitempty"`
+	Fee       int64    `json:"fee"`                  // Improvement (1): We introduce the transaction fee.
+	Data      []byte   `json:"data,omitempty"`       // Arbitrary bytes attached by the sender, base64 in JSON.
+	LockUntil int64    `json:"lock_until,omitempty"` // Index of the first block that may hold the transaction.
+}
+
+// Output is one of the payments of a transaction sending coins to several
+// recipients at once.
+type Output struct {
+	Recipient string `json:"recipient"`
+	Amount    int64  `json:"amount"`
+}
+
+// UnmarshalJSON accepts both the single recipient form
+// {"sender", "recipient", "amount", "fee"} and the batched form
+// {"sender", "outputs": [{"recipient", "amount"}, ...], "fee"}. A single
+// output is stored in the single recipient form, so that a payment has only
+// one representation.
+func (tx *Transaction) UnmarshalJSON(data []byte) error {
+	var t transaction
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+	return tx.setFrom(t)
+}
+
+// transaction has the fields of Transaction without its UnmarshalJSON
+// method, so that it can be decoded by encoding/json directly.
+type transaction Transaction
+
+func (tx *Transaction) setFrom(t transaction) error {
+	if len(t.Outputs) > 0 && (t.Recipient != "" || t.Amount != 0) {
+		return fmt.Errorf("transaction must have either a recipient and an amount or outputs")
+	}
+	if len(t.Outputs) == 1 {
+		t.Recipient, t.Amount = t.Outputs[0].Recipient, t.Outputs[0].Amount
+		t.Outputs = nil
+	}
+	*tx = Transaction(t)
+	return nil
+}
+
+// DecodeTransaction reads a single transaction submitted by a client. Unlike
+// UnmarshalJSON, which also reads the blocks of peers, it rejects unknown
+// fields, so that a typo like "ammount" isn't silently dropped, and reports
+// which field was wrong.
+func DecodeTransaction(r io.Reader) (Transaction, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	var t transaction
+	if err := dec.Decode(&t); err != nil {
+		return Transaction{}, fmt.Errorf("%w: %v", ErrInvalidTransaction, fieldError(err))
+	}
+	if dec.More() {
+		return Transaction{}, fmt.Errorf("%w: unexpected data after the transaction", ErrInvalidTransaction)
+	}
+	var tx Transaction
+	if err := tx.setFrom(t); err != nil {
+		return Transaction{}, fmt.Errorf("%w: %v", ErrInvalidTransaction, err)
+	}
+	return tx, nil
+}
+
+// fieldError rewrites the errors of encoding/json that concern a single
+// field to name that field.
+func fieldError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fmt.Errorf("field %q must be of type %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	// encoding/json has no error type for unknown fields.
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		return fmt.Errorf("unknown field %s", strings.TrimPrefix(msg, "json: unknown field "))
+	}
+	return err
+}
+
+// check validates the transaction on its own, without looking at any
+// balance.
+func (tx Transaction) check() error {
+	if tx.Sender == "" {
+		return fmt.Errorf("%w: transaction has no sender", ErrInvalidTransaction)
+	}
+	if tx.Fee < 0 {
+		return fmt.Errorf("%w: fee must not be negative", ErrInvalidTransaction)
+	}
+	if tx.LockUntil < 0 {
+		return fmt.Errorf("%w: lock_until must not be negative", ErrInvalidTransaction)
+	}
+	cost := tx.Fee
+	for _, out := range tx.payouts() {
+		if out.Recipient == "" {
+			return fmt.Errorf("%w: transaction has no recipient", ErrInvalidTransaction)
+		}
+		if out.Amount <= 0 {
+			return fmt.Errorf("%w: amount must be positive", ErrInvalidTransaction)
+		}
+		var ok bool
+		if cost, ok = addInt64(cost, out.Amount); !ok {
+			return fmt.Errorf("%w: amounts and fee add up to more than %d", ErrInvalidTransaction, int64(math.MaxInt64))
+		}
+	}
+	return nil
+}
+
+// payouts returns the payments made by the transaction, whichever form it
+// was written in.
+func (tx Transaction) payouts() []Output {
+	if len(tx.Outputs) > 0 {
+		return tx.Outputs
+	}
+	return []Output{{Recipient: tx.Recipient, Amount: tx.Amount}}
+}
+
+// cost returns what the transaction takes from the sender: all of its
+// outputs plus the fee. It only fits in an int64 if check passes.
+func (tx Transaction) cost() int64 {
+	cost := tx.Fee
+	for _, out := range tx.payouts() {
+		cost += out.Amount
+	}
+	return cost
+}
+
+// addInt64 returns a+b, or false if the sum overflows an int64.
+func addInt64(a, b int64) (int64, bool) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, false
+	}
+	return sum, true
+}
+
+// balanceChange returns how the transaction changes the balance of address.
+func (tx Transaction) balanceChange(address string) int64 {
+	var change int64
+	if tx.Sender == address {
+		change -= tx.cost()
+	}
+	for _, out := range tx.payouts() {
+		if out.Recipient == address {
+			change += out.Amount
+		}
+	}
+	return change
+}
+
+// touches reports whether address is the sender or one of the recipients of
+// the transaction.
+func (tx Transaction) touches(address string) bool {
+	if tx.Sender == address {
+		return true
+	}
+	for _, out := range tx.payouts() {
+		if out.Recipient == address {
+			return true
+		}
+	}
+	return false
+}
+
+// copy returns a copy of the transaction that shares no memory with it.
+func (tx Transaction) copy() Transaction {
+	tx.Outputs = append([]Output(nil), tx.Outputs...)
+	tx.Data = append([]byte(nil), tx.Data...)
+	return tx
+}
+
+// CanonicalBytes returns the byte representation of the transaction used for
+// hashing. It doesn't depend on JSON and never changes for a given
+// transaction. Integers are 8 bytes big endian and strings are prefixed by
+// their length as such an integer. The layout is:
+//
+//	sender
+//	number of outputs
+//	for every output: recipient, amount
+//	fee
+//	data, if there is any or a lock, prefixed by its length
+//	lock_until, if there is a lock
+//
+// A single recipient transaction is laid out as one output. Data and the lock
+// are left out when empty so that transactions without them keep the id they
+// had before they existed. With a lock, the data is written even when empty,
+// so that the length prefix of the data always tells the layouts apart.
+func (tx Transaction) CanonicalBytes() []byte {
+	var buf bytes.Buffer
+	writeString(&buf, tx.Sender)
+	outputs := tx.payouts()
+	writeInt64(&buf, int64(len(outputs)))
+	for _, out := range outputs {
+		writeString(&buf, out.Recipient)
+		writeInt64(&buf, out.Amount)
+	}
+	writeInt64(&buf, tx.Fee)
+	if len(tx.Data) > 0 || tx.LockUntil != 0 {
+		writeString(&buf, string(tx.Data))
+	}
+	if tx.LockUntil != 0 {
+		writeInt64(&buf, tx.LockUntil)
+	}
+	return buf.Bytes()
+}
+
+// ID returns the SHA-256 of the canonical bytes of the transaction.
+func (tx Transaction) ID() string {
+	return ComputeHashSha256(tx.CanonicalBytes())
+}
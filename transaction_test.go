@@ -0,0 +1,274 @@
+package gochain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransactionOutputsJSON(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		want Transaction
+	}{
+		{`{"sender": "a", "recipient": "b", "amount": 1, "fee": 0}`, Transaction{Sender: "a", Recipient: "b", Amount: 1}},
+		// A single output has one representation only.
+		{`{"sender": "a", "outputs": [{"recipient": "b", "amount": 1}], "fee": 0}`, Transaction{Sender: "a", Recipient: "b", Amount: 1}},
+		{`{"sender": "a", "outputs": [{"recipient": "b", "amount": 1}, {"recipient": "c", "amount": 2}], "fee": 1}`,
+			Transaction{Sender: "a", Outputs: []Output{{"b", 1}, {"c", 2}}, Fee: 1}},
+	} {
+		var tx Transaction
+		if err := json.Unmarshal([]byte(tc.json), &tx); err != nil {
+			t.Errorf("%s: %v", tc.json, err)
+			continue
+		}
+		if !reflect.DeepEqual(tx, tc.want) {
+			t.Errorf("%s decoded to %+v, want %+v", tc.json, tx, tc.want)
+		}
+	}
+
+	var tx Transaction
+	if err := json.Unmarshal([]byte(`{"sender": "a", "recipient": "b", "amount": 1, "outputs": [{"recipient": "c", "amount": 2}]}`), &tx); err == nil {
+		t.Error("transaction with both a recipient and outputs decoded")
+	}
+}
+
+func TestMultipleOutputs(t *testing.T) {
+	miner, alice, bob := testAddress("miner"), testAddress("alice"), testAddress("bob")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 5, miner)
+
+	tx := Transaction{Sender: miner, Outputs: []Output{{alice, 1}, {bob, 2}}, Fee: 1}
+	if err := tx.check(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tx.cost(); got != 4 {
+		t.Errorf("cost is %d, want 4", got)
+	}
+	if _, err := bc.NewTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1, testAddress("other"))
+	if bc.Balance(miner) != 1 || bc.Balance(alice) != 1 || bc.Balance(bob) != 2 {
+		t.Errorf("balances are %d, %d and %d, want 1, 1 and 2", bc.Balance(miner), bc.Balance(alice), bc.Balance(bob))
+	}
+
+	for _, outputs := range [][]Output{{{alice, 1}, {"", 1}}, {{alice, 1}, {bob, 0}}, {{alice, 1}, {bob, -1}}} {
+		if err := (Transaction{Sender: miner, Outputs: outputs}).check(); err == nil {
+			t.Errorf("outputs %v accepted", outputs)
+		}
+	}
+	if _, err := bc.NewTransaction(Transaction{Sender: miner, Outputs: []Output{{alice, 1}, {bob, 1}}}); err == nil {
+		t.Error("outputs adding up to more than the balance accepted")
+	}
+}
+
+// TestCanonicalBytes pins the encoding transaction ids, Merkle leaves and
+// signatures are computed from. Don't update it unless breaking consensus
+// is intended.
+func TestCanonicalBytes(t *testing.T) {
+	for _, tc := range []struct {
+		tx    Transaction
+		bytes string
+		id    string
+	}{
+		{
+			Transaction{Sender: "a", Recipient: "b", Amount: 5, Fee: 1},
+			"0000000000000001" + "61" + "0000000000000001" + "0000000000000001" + "62" + "0000000000000005" + "0000000000000001",
+			"7ed68fb22613369f088bf4ea867e274deb05ee0cf7ad75c288ee1eecd2d8b43d",
+		},
+		{
+			Transaction{Sender: "bob", Outputs: []Output{{"carol", 2}, {"dave", 3}}, Fee: 2},
+			"0000000000000003626f62000000000000000200000000000000056361726f6c000000000000000200000000000000046461766500000000000000030000000000000002",
+			"71a2183198c2f7d9ec84ae613d47953cd3c15ebbd5cf58b41a2055022f8bd5fe",
+		},
+		{
+			Transaction{Sender: "a", Recipient: "b", Amount: 1, Data: []byte("memo")},
+			"00000000000000016100000000000000010000000000000001620000000000000001000000000000000000000000000000046d656d6f",
+			"e153a34fa73deffe065829808140897c3df92e472354d34e2565b34c816efee0",
+		},
+		{
+			Transaction{Sender: "a", Recipient: "b", Amount: 1, LockUntil: 7},
+			"00000000000000016100000000000000010000000000000001620000000000000001000000000000000000000000000000000000000000000007",
+			"af97d50f43529bd990b1400b583f4f97564236069f74b136d0faaa983024f6ab",
+		},
+	} {
+		if got := hex.EncodeToString(tc.tx.CanonicalBytes()); got != tc.bytes {
+			t.Errorf("canonical bytes of %+v are %s, want %s", tc.tx, got, tc.bytes)
+		}
+		if got := tc.tx.ID(); got != tc.id {
+			t.Errorf("id of %+v is %s, want %s", tc.tx, got, tc.id)
+		}
+	}
+
+	// Both forms of a single payment are the same transaction.
+	single := Transaction{Sender: "a", Recipient: "b", Amount: 5}
+	output := Transaction{Sender: "a", Outputs: []Output{{"b", 5}}}
+	if single.ID() != output.ID() {
+		t.Error("a payment has two ids")
+	}
+}
+
+func TestDecodeTransaction(t *testing.T) {
+	tx, err := DecodeTransaction(strings.NewReader(`{"sender": "a", "recipient": "b", "amount": 1}`))
+	if err != nil || !reflect.DeepEqual(tx, Transaction{Sender: "a", Recipient: "b", Amount: 1}) {
+		t.Fatalf("decoded %+v, %v", tx, err)
+	}
+
+	for _, tc := range []struct {
+		body, reason string
+	}{
+		{`{"sender": "a", "recipient": "b", "ammount": 1}`, `unknown field "ammount"`},
+		{`{"sender": "a", "recipient": "b", "amount": "1"}`, `field "amount" must be of type int64, got string`},
+		{`{"sender": 1, "recipient": "b", "amount": 1}`, `field "sender" must be of type string, got number`},
+		{`{"sender": "a", "recipient": "b", "amount": 1} {}`, "unexpected data"},
+		{`{"sender": "a", "recipient": "b", "amount": 1, "outputs": [{"recipient": "c", "amount": 1}]}`, "either a recipient"},
+	} {
+		_, err := DecodeTransaction(strings.NewReader(tc.body))
+		if !errors.Is(err, ErrInvalidTransaction) || !strings.Contains(err.Error(), tc.reason) {
+			t.Errorf("%s: %v, want ErrInvalidTransaction for %q", tc.body, err, tc.reason)
+		}
+	}
+}
+
+func TestTransactionData(t *testing.T) {
+	miner, alice := testAddress("miner"), testAddress("alice")
+	bc := newTestBlockchain(t, WithMaxTxData(8))
+	mineBlocks(t, bc, 2, miner)
+	h := NewHandler(bc, testAddress("node"))
+	tx := func(data string) string {
+		return `{"sender": "` + miner + `", "recipient": "` + alice + `", "amount": 1, "data": "` + data + `"}`
+	}
+
+	// "aW52b2ljZSA0Mg==" is "invoice 42", 10 bytes.
+	if rec := serve(h, http.MethodPost, "/transactions/new", tx("aW52b2ljZSA0Mg=="), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("10 bytes of data: status %d, want 400", rec.Code)
+	}
+	if rec := serve(h, http.MethodPost, "/transactions/new", tx("not base64"), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("data not in base64: status %d, want 400", rec.Code)
+	}
+	// "bWVtbw==" is "memo".
+	if rec := serve(h, http.MethodPost, "/transactions/new", tx("bWVtbw=="), nil); rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	mineBlocks(t, bc, 1, miner)
+
+	got := bc.LastBlock().Transactions[0]
+	if string(got.Data) != "memo" {
+		t.Fatalf("data of the mined transaction is %q, want memo", got.Data)
+	}
+	without := got
+	without.Data = nil
+	if got.ID() == without.ID() {
+		t.Error("data doesn't change the transaction id")
+	}
+	// Peers check the data through the hash of the block.
+	chain := bc.Chain()
+	chain[3].Transactions[0].Data = []byte("mema")
+	if err := newTestBlockchain(t).ValidateChain(chain); !errors.Is(err, ErrInvalidChain) {
+		t.Errorf("chain with changed data: %v, want ErrInvalidChain", err)
+	}
+}
+
+func TestLockUntil(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 1, miner)
+	tx := Transaction{Sender: miner, Recipient: testAddress("alice"), Amount: 1, LockUntil: 4}
+	index, err := bc.NewTransaction(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 4 {
+		t.Errorf("locked transaction will be mined in block %d, want 4", index)
+	}
+
+	mineBlocks(t, bc, 1, miner)
+	if got := bc.lastBlock().Transactions; len(got) != 1 {
+		t.Fatalf("block 3 holds %v, want only the reward", got)
+	}
+	if n := len(bc.PendingTransactions()); n != 1 {
+		t.Fatalf("%d transactions pending, want the locked one", n)
+	}
+	mineBlocks(t, bc, 1, miner)
+	if n := len(bc.PendingTransactions()); n != 0 {
+		t.Fatalf("%d transactions pending after block 4", n)
+	}
+
+	// A block may not hold a transaction locked until a later one.
+	chain := bc.Chain()
+	last := &chain[len(chain)-1]
+	for i := range last.Transactions {
+		if last.Transactions[i].Sender == miner {
+			last.Transactions[i].LockUntil = 5
+		}
+	}
+	reseal(bc, chain, len(chain)-1)
+	if err := bc.ValidateChain(chain); !errors.Is(err, ErrInvalidChain) || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("chain with a locked transaction: %v, want it rejected as locked", err)
+	}
+}
+
+func TestAddInt64(t *testing.T) {
+	for _, tc := range []struct {
+		a, b int64
+		sum  int64
+		ok   bool
+	}{
+		{1, 2, 3, true},
+		{math.MaxInt64 - 1, 1, math.MaxInt64, true},
+		{math.MaxInt64, 1, 0, false},
+		{math.MaxInt64, math.MaxInt64, 0, false},
+		{math.MinInt64 + 1, -1, math.MinInt64, true},
+		{math.MinInt64, -1, 0, false},
+		{math.MaxInt64, math.MinInt64, -1, true},
+	} {
+		if sum, ok := addInt64(tc.a, tc.b); sum != tc.sum || ok != tc.ok {
+			t.Errorf("%d + %d = %d, %t, want %d, %t", tc.a, tc.b, sum, ok, tc.sum, tc.ok)
+		}
+	}
+}
+
+func TestTransactionOverflow(t *testing.T) {
+	miner, alice, bob := testAddress("miner"), testAddress("alice"), testAddress("bob")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 3, miner)
+	for _, tx := range []Transaction{
+		{Sender: miner, Recipient: alice, Amount: math.MaxInt64, Fee: 1},
+		{Sender: miner, Outputs: []Output{{Recipient: alice, Amount: math.MaxInt64/2 + 1}, {Recipient: bob, Amount: math.MaxInt64/2 + 1}}},
+	} {
+		// Wrapping around, the cost would be negative and look affordable.
+		_, err := bc.NewTransaction(tx)
+		if !errors.Is(err, ErrInvalidTransaction) || !strings.Contains(err.Error(), "add up") {
+			t.Errorf("%+v: %v, want the overflow detected", tx, err)
+		}
+	}
+
+	// Blocks adding up to more than an int64 holds are refused, not wrapped.
+	for _, tc := range []struct {
+		minted []Transaction
+		reason string
+	}{
+		{[]Transaction{
+			{Sender: DefaultCoinbaseSender, Recipient: alice, Amount: math.MaxInt64},
+			{Sender: DefaultCoinbaseSender, Recipient: bob, Amount: 2},
+		}, "mints more than"},
+		// The miner already owns 2 coins.
+		{[]Transaction{{Sender: DefaultCoinbaseSender, Recipient: miner, Amount: math.MaxInt64 - 1}}, "would exceed"},
+	} {
+		chain := bc.Chain()
+		chain[3].Transactions = tc.minted
+		reseal(bc, chain, 3)
+		if err := bc.ValidateChain(chain); !errors.Is(err, ErrInvalidChain) || !strings.Contains(err.Error(), tc.reason) {
+			t.Errorf("%v: %v, want %q", tc.minted, err, tc.reason)
+		}
+	}
+	if got := bc.Balance(miner); got != 3 {
+		t.Errorf("miner owns %d, want 3", got)
+	}
+}
@@ -1,8 +1,10 @@
 package gochain
 
 import (
+    "bytes"
     "crypto/rand"
     "crypto/sha256"
+    "encoding/binary"
     "fmt"
 )
 
@@ -10,6 +12,20 @@ func ComputeHashSha256(bytes []byte) string {
     return fmt.Sprintf("%x", sha256.Sum256(bytes))
 }
 
+// writeInt64 appends v to buf as 8 big endian bytes.
+func writeInt64(buf *bytes.Buffer, v int64) {
+    var b [8]byte
+    binary.BigEndian.PutUint64(b[:], uint64(v))
+    buf.Write(b[:])
+}
+
+// writeString appends s to buf prefixed by its length, so that consecutive
+// strings can't run into each other.
+func writeString(buf *bytes.Buffer, s string) {
+    writeInt64(buf, int64(len(s)))
+    buf.WriteString(s)
+}
+
 func PseudoUUID() string {
     b := make([]byte, 16)
     _, err := rand.Read(b)
@@ -35,6 +51,12 @@ func (set *StringSet) Add(str string) bool {
     return !found
 }
 
+func (set *StringSet) Remove(str string) bool {
+    _, found := set.set[str]
+    delete(set.set, str)
+    return found
+}
+
 func (set *StringSet) Keys() []string {
     var keys []string
     for k, _ := range set.set {
@@ -0,0 +1,4 @@
+package gochain
+
+// Version is the version of gochain, reported by the nodes on /info.
+const Version = "0.1.0"
@@ -0,0 +1,123 @@
+package gochain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// By default a webhook fires as soon as its transaction is mined, and the
+// callback is tried three times, waiting 500ms and then 1s between attempts.
+const (
+	defaultWebhookConfirmations = 1
+	webhookAttempts             = 3
+	webhookRetryDelay           = 500 * time.Millisecond
+	webhookTimeout              = 5 * time.Second
+)
+
+// WithWebhookConfirmations sets how many blocks, counting the one holding
+// it, must confirm a transaction before its webhooks fire.
+func WithWebhookConfirmations(confirmations int64) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.webhookConfirmations = confirmations
+	}
+}
+
+// WebhookEvent is sent to the webhooks of a transaction once it is
+// confirmed.
+type WebhookEvent struct {
+	TxID          string `json:"tx_id"`
+	BlockIndex    int64  `json:"block_index"`
+	Confirmations int64  `json:"confirmations"`
+}
+
+// RegisterWebhook makes the node POST a WebhookEvent to callback once the
+// transaction txID is confirmed. Each webhook fires once.
+func (bc *Blockchain) RegisterWebhook(txID, callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url %q", callback)
+	}
+	if txID == "" {
+		return fmt.Errorf("webhook needs a transaction id")
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.webhooks[txID] = append(bc.webhooks[txID], callback)
+	// The transaction may be confirmed already.
+	bc.fireWebhooks()
+	return nil
+}
+
+// fireWebhooks sends the webhooks of the transactions that have enough
+// confirmations, and forgets them.
+func (bc *Blockchain) fireWebhooks() {
+	if len(bc.webhooks) == 0 {
+		return
+	}
+	tip := bc.lastBlock().Index
+	for _, block := range bc.chain {
+		confirmations := tip - block.Index + 1
+		if confirmations < bc.webhookConfirmations {
+			break
+		}
+		for _, tx := range block.Transactions {
+			id := tx.ID()
+			callbacks, ok := bc.webhooks[id]
+			if !ok {
+				continue
+			}
+			delete(bc.webhooks, id)
+			event := WebhookEvent{TxID: id, BlockIndex: block.Index, Confirmations: confirmations}
+			for _, callback := range callbacks {
+				callback := callback
+				bc.goBackground(func() { bc.sendWebhook(callback, event) })
+			}
+		}
+	}
+}
+
+// sendWebhook posts event to callback, retrying a few times if it fails.
+// Nobody waits for the outcome, so failures are only logged.
+func (bc *Blockchain) sendWebhook(callback string, event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("could not encode webhook event: %v", err)
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(client, callback, body)
+		if err == nil {
+			return
+		}
+		if attempt >= webhookAttempts {
+			break
+		}
+		select {
+		case <-bc.closing:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	log.Printf("webhook %s for transaction %s failed: %v", callback, event.TxID, err)
+}
+
+func postWebhook(client *http.Client, callback string, body []byte) error {
+	resp, err := client.Post(callback, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
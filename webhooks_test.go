@@ -0,0 +1,110 @@
+package gochain
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver returns a server that fails the first failures requests
+// and sends the events of the others on the returned channel.
+func webhookReceiver(t *testing.T, failures int32) (*httptest.Server, <-chan WebhookEvent) {
+	t.Helper()
+	events := make(chan WebhookEvent, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	t.Cleanup(srv.Close)
+	return srv, events
+}
+
+func TestWebhookConfirmations(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t, WithWebhookConfirmations(2))
+	mineBlocks(t, bc, 1, miner)
+	h := NewHandler(bc, testAddress("node"))
+	tx := Transaction{Sender: miner, Recipient: testAddress("alice"), Amount: 1}
+	if _, err := bc.NewTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first attempt fails, the retry succeeds.
+	srv, events := webhookReceiver(t, 1)
+	rec := serve(h, http.MethodPost, "/webhooks", `{"tx_id": "`+tx.ID()+`", "url": "`+srv.URL+`"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	mineBlocks(t, bc, 1, miner)
+	select {
+	case event := <-events:
+		t.Fatalf("webhook fired after 1 confirmation: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+	mineBlocks(t, bc, 1, miner)
+	select {
+	case event := <-events:
+		if want := (WebhookEvent{TxID: tx.ID(), BlockIndex: 3, Confirmations: 2}); event != want {
+			t.Errorf("event is %+v, want %+v", event, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook never fired")
+	}
+
+	// Webhooks fire once.
+	mineBlocks(t, bc, 1, miner)
+	select {
+	case event := <-events:
+		t.Errorf("webhook fired again: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookOfConfirmedTransaction(t *testing.T) {
+	miner := testAddress("miner")
+	bc := newTestBlockchain(t)
+	mineBlocks(t, bc, 1, miner)
+	tx := Transaction{Sender: miner, Recipient: testAddress("alice"), Amount: 1}
+	if _, err := bc.NewTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 2, miner)
+
+	srv, events := webhookReceiver(t, 0)
+	if err := bc.RegisterWebhook(tx.ID(), srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if want := (WebhookEvent{TxID: tx.ID(), BlockIndex: 3, Confirmations: 2}); event != want {
+			t.Errorf("event is %+v, want %+v", event, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook never fired")
+	}
+}
+
+func TestRegisterWebhookRejectsInvalidInput(t *testing.T) {
+	h := NewHandler(newTestBlockchain(t), testAddress("node"))
+	for _, body := range []string{
+		`{"tx_id": "abc", "url": "ftp://example.com/hook"}`,
+		`{"tx_id": "abc", "url": "example.com/hook"}`,
+		`{"tx_id": "", "url": "http://example.com/hook"}`,
+		`{"tx_id": 1}`,
+	} {
+		if rec := serve(h, http.MethodPost, "/webhooks", body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+}